@@ -0,0 +1,385 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	apkIndex   = "APKINDEX.tar.gz"
+	apkPkgInfo = ".PKGINFO"
+)
+
+// apkSuffixes are the version suffixes of apk in ascending order. The empty
+// suffix sorts between the pre-release and post-release suffixes.
+var apkSuffixes = []string{"alpha", "beta", "pre", "rc", "", "cvs", "svn", "git", "hg", "p"}
+
+// apkArch returns the apk arch names usable on platform in order of
+// preference.
+func apkArch(platform v1.Platform) []string {
+	arch := map[string][]string{
+		"amd64": {"x86_64"},
+		"arm64": {"aarch64"},
+		"arm":   {"armv7", "armhf"},
+		"386":   {"x86"},
+	}[platform.Architecture]
+	if arch == nil {
+		arch = []string{platform.Architecture}
+	}
+	return append(arch, "noarch")
+}
+
+// compareNumbers compares two strings of digits numerically.
+func compareNumbers(a, b string) int {
+	a = strings.TrimLeft(a, "0")
+	b = strings.TrimLeft(b, "0")
+	if len(a) != len(b) {
+		return len(a) - len(b)
+	}
+	return strings.Compare(a, b)
+}
+
+// leadingDigits splits s after its leading digits.
+func leadingDigits(s string) (string, string) {
+	i := 0
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+	return s[:i], s[i:]
+}
+
+// apkSuffix returns the position of a suffix like rc1 in apkSuffixes and
+// its number.
+func apkSuffix(s string) (int, string) {
+	i := strings.IndexAny(s, "0123456789")
+	if i == -1 {
+		i = len(s)
+	}
+	for rank, suffix := range apkSuffixes {
+		if suffix == s[:i] {
+			return rank, s[i:]
+		}
+	}
+	return -1, s[i:]
+}
+
+// compareApkVersions compares two versions like 1.2.3a_rc1-r0.
+func compareApkVersions(a, b string) int {
+	split := func(v string) (string, []string, string) {
+		revision := ""
+		if i := strings.LastIndex(v, "-r"); i != -1 {
+			v, revision = v[:i], v[i+2:]
+		}
+		parts := strings.Split(v, "_")
+		return parts[0], parts[1:], revision
+	}
+	baseA, suffixesA, revA := split(a)
+	baseB, suffixesB, revB := split(b)
+
+	numsA := strings.Split(baseA, ".")
+	numsB := strings.Split(baseB, ".")
+	for i := 0; i < len(numsA) && i < len(numsB); i++ {
+		na, letterA := leadingDigits(numsA[i])
+		nb, letterB := leadingDigits(numsB[i])
+		if c := compareNumbers(na, nb); c != 0 {
+			return c
+		}
+		if c := strings.Compare(letterA, letterB); c != 0 {
+			return c
+		}
+	}
+	if len(numsA) != len(numsB) {
+		return len(numsA) - len(numsB)
+	}
+
+	for i := 0; i < len(suffixesA) || i < len(suffixesB); i++ {
+		rankA, na := apkSuffix("")
+		rankB, nb := rankA, na
+		if i < len(suffixesA) {
+			rankA, na = apkSuffix(suffixesA[i])
+		}
+		if i < len(suffixesB) {
+			rankB, nb = apkSuffix(suffixesB[i])
+		}
+		if rankA != rankB {
+			return rankA - rankB
+		}
+		if c := compareNumbers(na, nb); c != 0 {
+			return c
+		}
+	}
+	return compareNumbers(revA, revB)
+}
+
+// parseApkDep parses a dependency like so:libc.musl-x86_64.so.1 or
+// musl>=1.2. It returns false for conflicts like !name.
+func parseApkDep(s string) (pkgDep, bool) {
+	if strings.HasPrefix(s, "!") {
+		return pkgDep{}, false
+	}
+	i := strings.IndexAny(s, "<>=~")
+	if i == -1 {
+		return pkgDep{Name: s}, true
+	}
+	j := i
+	for j < len(s) && strings.ContainsRune("<>=~", rune(s[j])) {
+		j++
+	}
+	op := s[i:j]
+	// fuzzy matches are treated as a minimum version
+	if strings.HasPrefix(op, "~") {
+		op = ">="
+	}
+	return pkgDep{Name: s[:i], Op: op, Version: s[j:]}, true
+}
+
+// apkInfo describes the package with the given fields at path.
+func apkInfo(name, version, arch string, depends, provides []string, path string) *pkgInfo {
+	p := &pkgInfo{
+		ID:      name + "-" + version,
+		Name:    name,
+		Version: version,
+		Arch:    arch,
+		Path:    path,
+	}
+	for _, s := range provides {
+		if dep, ok := parseApkDep(s); ok {
+			p.Provides = append(p.Provides, dep)
+		}
+	}
+	for _, s := range depends {
+		if dep, ok := parseApkDep(s); ok {
+			p.Requires = append(p.Requires, []pkgDep{dep})
+		}
+	}
+	return p
+}
+
+// parsePkgInfo parses the key = value lines of a .PKGINFO.
+func parsePkgInfo(data []byte) map[string][]string {
+	fields := map[string][]string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key := strings.TrimSpace(parts[0])
+		fields[key] = append(fields[key], strings.TrimSpace(parts[1]))
+	}
+	return fields
+}
+
+// pkgInfoInfo describes the apk at path with the given .PKGINFO.
+func pkgInfoInfo(data []byte, path string) (*pkgInfo, error) {
+	fields := parsePkgInfo(data)
+	first := func(key string) string {
+		if len(fields[key]) == 0 {
+			return ""
+		}
+		return fields[key][0]
+	}
+	if first("pkgname") == "" {
+		return nil, fmt.Errorf("%s has no pkgname", path)
+	}
+	return apkInfo(first("pkgname"), first("pkgver"), first("arch"), fields["depend"], fields["provides"], path), nil
+}
+
+// readApkStreams calls fn for each gzip stream of the apk in r until fn
+// returns io.EOF. An apk is a signature, control and data tar, each in its
+// own gzip stream.
+func readApkStreams(r io.Reader, fn func(r io.Reader) error) error {
+	br := bufio.NewReader(r)
+	gz, err := gzip.NewReader(br)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+	for {
+		gz.Multistream(false)
+		if err := fn(gz); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if _, err := io.Copy(ioutil.Discard, gz); err != nil {
+			return err
+		}
+		if err := gz.Reset(br); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// readApkControl reads the files of a control or signature tar. The tars of
+// an apk aren't terminated, so a short read at the end is expected.
+func readApkControl(r io.Reader) (map[string][]byte, error) {
+	files := map[string][]byte{}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return files, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		files[hdr.Name] = data
+	}
+}
+
+// readApkInfo reads the description of the apk at path.
+func readApkInfo(path string) (*pkgInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var info *pkgInfo
+	err = readApkStreams(f, func(r io.Reader) error {
+		control, err := readApkControl(r)
+		if err != nil {
+			return err
+		}
+		data, ok := control[apkPkgInfo]
+		if !ok {
+			// signature
+			return nil
+		}
+		if info, err = pkgInfoInfo(data, path); err != nil {
+			return err
+		}
+		// skip the data
+		return io.EOF
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if info == nil {
+		return nil, fmt.Errorf("%s has no %s", path, apkPkgInfo)
+	}
+	return info, nil
+}
+
+// apkRepoIndex returns the path of the index of the apk repo in dir.
+func apkRepoIndex(dir string) (string, error) {
+	path := filepath.Join(dir, apkIndex)
+	if _, err := os.Stat(path); err != nil {
+		return "", fmt.Errorf("%s has no %s", dir, apkIndex)
+	}
+	return path, nil
+}
+
+// readApkRepo returns the packages in the apk repo in dir.
+func readApkRepo(dir string) ([]*pkgInfo, error) {
+	path, err := apkRepoIndex(dir)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+	// the signature tar isn't terminated, so both tars read as one
+	control, err := readApkControl(gz)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	index, ok := control["APKINDEX"]
+	if !ok {
+		return nil, fmt.Errorf("%s has no APKINDEX", path)
+	}
+	stanzas, err := parseControl(strings.NewReader(string(index)))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	pkgs := []*pkgInfo{}
+	for _, fields := range stanzas {
+		name, version := fields["P"], fields["V"]
+		file := filepath.Join(dir, name+"-"+version+".apk")
+		pkgs = append(pkgs, apkInfo(name, version, fields["A"],
+			strings.Fields(fields["D"]), strings.Fields(fields["p"]), file))
+	}
+	return pkgs, nil
+}
+
+// installApk extracts the data of the apk at path into the tree of t and
+// runs its pre-install and post-install scripts if scripts is set. It
+// returns the description of the apk with the files it installed.
+func installApk(path string, t *treeExtractor, ex executor, scripts bool) (*pkgInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	name := filepath.Base(path)
+	var info *pkgInfo
+	var control map[string][]byte
+	err = readApkStreams(f, func(r io.Reader) error {
+		var err error
+		if info != nil {
+			// the data follows the control tar
+			info.Files, err = extractTar(r, t)
+			return err
+		}
+		if control, err = readApkControl(r); err != nil {
+			return err
+		}
+		data, ok := control[apkPkgInfo]
+		if !ok {
+			// signature
+			return nil
+		}
+		if info, err = pkgInfoInfo(data, path); err != nil {
+			return err
+		}
+		if !scripts {
+			return nil
+		}
+		return runApkScript(t.root, ex, name, control, ".pre-install", info.Version)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	if info == nil {
+		return nil, fmt.Errorf("%s has no %s", name, apkPkgInfo)
+	}
+	if scripts {
+		if err := runApkScript(t.root, ex, name, control, ".post-install", info.Version); err != nil {
+			return nil, err
+		}
+	}
+	return info, nil
+}
+
+// runApkScript runs a script of an apk if it has one.
+func runApkScript(root string, ex executor, name string, control map[string][]byte, script string, arg ...string) error {
+	data, ok := control[script]
+	if !ok {
+		return nil
+	}
+	return runScript(root, ex, name, nil, string(data), arg...)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCompareApkVersions(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		expected int
+	}{
+		{"1.0", "1.0", 0},
+		{"1.0", "2.0", -1},
+		{"1.10", "1.9", 1},
+		{"1.0.1", "1.0", 1},
+		{"1.0a", "1.0", 1},
+		{"1.0_rc1", "1.0", -1},
+		{"1.0_alpha2", "1.0_beta1", -1},
+		{"1.0_p1", "1.0", 1},
+		{"1.0-r1", "1.0-r10", -1},
+		{"1.0-r1", "1.0-r1", 0},
+	}
+	for _, test := range tests {
+		got := compareApkVersions(test.a, test.b)
+		if got > 0 {
+			got = 1
+		} else if got < 0 {
+			got = -1
+		}
+		if got != test.expected {
+			t.Errorf("compareApkVersions(%q, %q) = %d, expected %d", test.a, test.b, got, test.expected)
+		}
+	}
+}
+
+func TestMuslPaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smith-test-")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	interp := "/lib/ld-musl-x86_64.so.1"
+	if paths := muslPaths(dir, "/lib64/ld-linux-x86-64.so.2"); paths != nil {
+		t.Fatalf("Got musl paths %v for glibc", paths)
+	}
+	if paths := muslPaths(dir, interp); !reflect.DeepEqual(paths, []string{"/lib", "/usr/local/lib", "/usr/lib"}) {
+		t.Fatalf("Unexpected default paths %v", paths)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "etc"), 0755); err != nil {
+		t.Fatalf("%v", err)
+	}
+	path := filepath.Join(dir, "etc/ld-musl-x86_64.path")
+	if err := ioutil.WriteFile(path, []byte("/opt/lib:/usr/lib\n/lib\n"), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if paths := muslPaths(dir, interp); !reflect.DeepEqual(paths, []string{"/opt/lib", "/usr/lib", "/lib"}) {
+		t.Fatalf("Unexpected paths %v", paths)
+	}
+
+	// the path applies to the whole tree once the loader is found
+	defer SetMuslPaths("")
+	SetMuslPaths(dir)
+	if muslLibPaths != nil {
+		t.Fatalf("Got musl paths %v without a loader", muslLibPaths)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "lib"), 0755); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, interp), nil, 0755); err != nil {
+		t.Fatalf("%v", err)
+	}
+	SetMuslPaths(dir)
+	if !reflect.DeepEqual(muslLibPaths, []string{"/opt/lib", "/usr/lib", "/lib"}) {
+		t.Fatalf("Unexpected tree paths %v", muslLibPaths)
+	}
+}
+
+// writeTestApk writes an apk with the given .PKGINFO and files to path.
+func writeTestApk(t *testing.T, path, pkginfo string, files map[string]string) {
+	var b bytes.Buffer
+	b.Write(testTarGz(map[string]string{".SIGN.RSA.test.rsa.pub": "sig"}, false))
+	b.Write(testTarGz(map[string]string{apkPkgInfo: pkginfo}, false))
+	b.Write(testTarGz(files, true))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := ioutil.WriteFile(path, b.Bytes(), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+}
+
+func TestBuildApk(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smith-test-")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo := filepath.Join(dir, "repo")
+	writeTestApk(t, filepath.Join(repo, "lib-1.0-r0.apk"),
+		"pkgname = lib\npkgver = 1.0-r0\narch = noarch\nprovides = so:libtest.so.1=1\n",
+		map[string]string{"usr/lib/libtest.txt": "lib"})
+	var index bytes.Buffer
+	index.Write(testTarGz(map[string]string{".SIGN.RSA.test.rsa.pub": "sig"}, false))
+	index.Write(testTarGz(map[string]string{
+		"DESCRIPTION": "test",
+		"APKINDEX":    "P:lib\nV:1.0-r0\nA:noarch\np:so:libtest.so.1=1\n\n",
+	}, true))
+	if err := ioutil.WriteFile(filepath.Join(repo, apkIndex), index.Bytes(), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+	app := filepath.Join(dir, "app-1.0-r0.apk")
+	writeTestApk(t, app,
+		"# Generated by abuild\npkgname = app\npkgver = 1.0-r0\narch = noarch\ndepend = so:libtest.so.1\ndepend = !conflict\n",
+		map[string]string{"usr/bin/app": "app"})
+
+	pkg := &ConfigDef{
+		Type:    "apk",
+		Package: app,
+		Paths:   []string{"/usr/bin/app", "/usr/lib/libtest.txt"},
+		Apk:     NativeDef{Repos: []string{repo}},
+	}
+	outputDir := filepath.Join(dir, "out")
+	packages, err := buildNative(&buildOptions{}, outputDir, pkg, hostPlatform())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if expected := []string{"app-1.0-r0", "lib-1.0-r0"}; !reflect.DeepEqual(packages, expected) {
+		t.Fatalf("Installed %v, expected %v", packages, expected)
+	}
+	for path, content := range map[string]string{"usr/bin/app": "app", "usr/lib/libtest.txt": "lib"} {
+		data, err := ioutil.ReadFile(filepath.Join(outputDir, path))
+		if err != nil || string(data) != content {
+			t.Fatalf("Unexpected content of %v: %q %v", path, data, err)
+		}
+	}
+
+	// missing dependencies are an error
+	pkg.Apk.Repos = nil
+	if _, err := buildNative(&buildOptions{}, outputDir, pkg, hostPlatform()); err == nil {
+		t.Fatalf("buildNative succeeded with a missing dependency")
+	}
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	// identityTokenUser is the username docker credential helpers use for
+	// identity tokens. The password is an oauth2 refresh token.
+	identityTokenUser = "<token>"
+	clientID          = "smith"
+	// defaultTokenLifetime is used when the auth server doesn't send
+	// expires_in, as specified by the docker token spec.
+	defaultTokenLifetime = 60 * time.Second
+	tokenExpiryMargin    = 10 * time.Second
+	// tokens received more recently than this are not requested again
+	// if the registry rejects them
+	freshTokenAge = 5 * time.Second
+)
+
+// GetTokenResponse is a type that provides the json structure of token
+// response.
+type GetTokenResponse struct {
+	Token        string `json:"token,omitempty"`
+	AccessToken  string `json:"access_token,omitempty"`
+	ExpiresIn    int    `json:"expires_in,omitempty"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+}
+
+// parseChallenge parses a WWW-Authenticate header into its scheme and
+// parameters. Parameter values may be quoted and quoted values may contain
+// commas and escaped characters.
+func parseChallenge(val string) (string, map[string]string, error) {
+	val = strings.TrimSpace(val)
+	i := strings.IndexAny(val, " \t")
+	if i == -1 {
+		if val == "" {
+			return "", nil, fmt.Errorf("empty WWW-Authenticate header")
+		}
+		return val, map[string]string{}, nil
+	}
+	scheme := val[:i]
+	rest := val[i:]
+	params := map[string]string{}
+	for {
+		rest = strings.TrimLeft(rest, " \t,")
+		if rest == "" {
+			break
+		}
+		eq := strings.Index(rest, "=")
+		if eq <= 0 {
+			return "", nil, fmt.Errorf("invalid value in WWW-Authenticate header: '%s'", val)
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = strings.TrimLeft(rest[eq+1:], " \t")
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			var buf []byte
+			j := 1
+			for ; j < len(rest) && rest[j] != '"'; j++ {
+				if rest[j] == '\\' && j+1 < len(rest) {
+					j++
+				}
+				buf = append(buf, rest[j])
+			}
+			if j == len(rest) {
+				return "", nil, fmt.Errorf("unterminated quote in WWW-Authenticate header: '%s'", val)
+			}
+			value = string(buf)
+			rest = rest[j+1:]
+		} else {
+			end := strings.IndexAny(rest, ", \t")
+			if end == -1 {
+				end = len(rest)
+			}
+			value = rest[:end]
+			rest = rest[end:]
+		}
+		params[key] = value
+	}
+	return scheme, params, nil
+}
+
+// extractAuth reads the challenge from a 401 response and stores how to
+// authenticate in info.
+func extractAuth(resp *http.Response, info *RepoInfo) error {
+	val := resp.Header.Get("WWW-Authenticate")
+	scheme, params, err := parseChallenge(val)
+	if err != nil {
+		return err
+	}
+	setCredentials(info)
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if info.Username == "" {
+			return fmt.Errorf("registry %s requires a username and password", info.Host)
+		}
+		info.Basic = true
+	case "bearer":
+		info.Auth = params["realm"]
+		if info.Auth == "" {
+			return fmt.Errorf("realm not found in WWW-Authenticate header: '%s'", val)
+		}
+		info.Service = params["service"]
+		info.Scope = params["scope"]
+	default:
+		return fmt.Errorf("unsupported auth scheme in WWW-Authenticate header: '%s'", val)
+	}
+	return nil
+}
+
+// authorize adds credentials for info to req. Tokens that have expired are
+// refreshed first.
+func (r *RegistryClient) authorize(req *http.Request, info *RepoInfo) error {
+	if info.Basic {
+		req.SetBasicAuth(info.Username, info.Password)
+		return nil
+	}
+	if info.Auth != "" && info.actions != nil &&
+		(info.Token == "" || time.Now().After(info.Expiry)) {
+		logrus.Debugf("Refreshing token for %s", info.Reponame)
+		if err := r.GetToken(info, info.actions); err != nil {
+			return err
+		}
+	}
+	if info.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+info.Token)
+	}
+	return nil
+}
+
+// reauthorize handles a 401 response. It discards a rejected token so the
+// request can be retried with a new one. An error is returned if retrying
+// would not help.
+func (r *RegistryClient) reauthorize(resp *http.Response, info *RepoInfo) error {
+	if info.Basic {
+		return fmt.Errorf("Credentials are invalid for %s", info.Host)
+	}
+	if info.Token != "" {
+		if time.Since(info.Issued) < freshTokenAge {
+			return fmt.Errorf("Token is invalid for %s", info.Reponame)
+		}
+		logrus.Debugf("Token for %s was rejected, requesting a new one", info.Reponame)
+		info.Token = ""
+	}
+	return extractAuth(resp, info)
+}
+
+// GetToken gets an authentication token that will be used for authentication
+// of calls made on the reciever RegistryClient.
+func (r *RegistryClient) GetToken(info *RepoInfo, actions []string) error {
+	if info.Host == "" {
+		return fmt.Errorf("Host must be specified")
+	}
+	if info.Reponame == "" {
+		return fmt.Errorf("Reponame must be specified")
+	}
+	info.actions = actions
+	scope := fmt.Sprintf("repository:%s:%s", info.Reponame, strings.Join(actions, ","))
+	scopes := []string{scope}
+	// request access to the repositories blobs may be mounted from
+	for _, repo := range info.MountFrom {
+		scopes = append(scopes, fmt.Sprintf("repository:%s:pull", repo))
+	}
+	if info.Scope != "" && info.Scope != scope {
+		scopes = append(scopes, info.Scope)
+	}
+	return r.requestToken(info, scopes)
+}
+
+// requestToken requests a token for scopes from the auth server. A refresh
+// token is used if there is one, otherwise the username and password.
+func (r *RegistryClient) requestToken(info *RepoInfo, scopes []string) error {
+	setCredentials(info)
+	if info.RefreshToken == "" && info.Username == identityTokenUser {
+		info.RefreshToken = info.Password
+	}
+	if info.RefreshToken != "" {
+		err := r.refreshToken(info, scopes)
+		if err == nil || info.Username == "" || info.Username == identityTokenUser {
+			return err
+		}
+		logrus.Debugf("Refresh token was rejected, using password: %v", err)
+		info.RefreshToken = ""
+	}
+
+	params := url.Values{}
+	if info.Service != "" {
+		params.Set("service", info.Service)
+	}
+	for _, scope := range scopes {
+		params.Add("scope", scope)
+	}
+	if info.Username != "" {
+		// ask for a refresh token so the password is only sent once
+		params.Set("offline_token", "true")
+		params.Set("client_id", clientID)
+	}
+	u := info.Auth
+	if len(params) != 0 {
+		sep := "?"
+		if strings.Contains(u, "?") {
+			sep = "&"
+		}
+		u += sep + params.Encode()
+	}
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	if info.Username != "" {
+		req.SetBasicAuth(info.Username, info.Password)
+	}
+	logrus.Debugf("Making auth request to %s", u)
+	resp, err := r.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return responseError("Auth server", resp)
+	}
+	return setToken(info, resp.Body)
+}
+
+// refreshToken requests a token with the oauth2 refresh token grant.
+func (r *RegistryClient) refreshToken(info *RepoInfo, scopes []string) error {
+	form := url.Values{}
+	form.Set("grant_type", "refresh_token")
+	form.Set("refresh_token", info.RefreshToken)
+	form.Set("client_id", clientID)
+	if info.Service != "" {
+		form.Set("service", info.Service)
+	}
+	if len(scopes) != 0 {
+		form.Set("scope", strings.Join(scopes, " "))
+	}
+	req, err := http.NewRequest("POST", info.Auth, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	logrus.Debugf("Making oauth2 refresh request to %s", info.Auth)
+	resp, err := r.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return responseError("Auth server", resp)
+	}
+	return setToken(info, resp.Body)
+}
+
+// setToken stores the token from an auth server response in info. The expiry
+// is computed from the local clock to avoid problems with clock skew.
+func setToken(info *RepoInfo, body io.Reader) error {
+	tokenResponse := GetTokenResponse{}
+	if err := json.NewDecoder(body).Decode(&tokenResponse); err != nil {
+		return err
+	}
+	token := tokenResponse.Token
+	if token == "" {
+		token = tokenResponse.AccessToken
+	}
+	if token == "" {
+		return fmt.Errorf("Auth server did not return a token")
+	}
+	lifetime := defaultTokenLifetime
+	if tokenResponse.ExpiresIn > 0 {
+		lifetime = time.Duration(tokenResponse.ExpiresIn) * time.Second
+	}
+	// refresh a little early so the token doesn't expire in flight
+	if lifetime > 2*tokenExpiryMargin {
+		lifetime -= tokenExpiryMargin
+	}
+	info.Token = token
+	info.Issued = time.Now()
+	info.Expiry = info.Issued.Add(lifetime)
+	if tokenResponse.RefreshToken != "" {
+		info.RefreshToken = tokenResponse.RefreshToken
+	}
+	return nil
+}
+
+// CheckLogin verifies that the registry accepts the credentials in info.
+func (r *RegistryClient) CheckLogin(info *RepoInfo) error {
+	u := fmt.Sprintf("%s://%s/v2/", info.Scheme, info.Host)
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := r.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == 200 {
+		logrus.Warnf("Registry %s does not require authentication", info.Host)
+		return nil
+	}
+	if resp.StatusCode != 401 {
+		return fmt.Errorf("Registry returned invalid response %d", resp.StatusCode)
+	}
+	if err := extractAuth(resp, info); err != nil {
+		return err
+	}
+	if !info.Basic {
+		return r.requestToken(info, nil)
+	}
+	if err := r.authorize(req, info); err != nil {
+		return err
+	}
+	resp, err = r.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("Registry returned invalid response %d", resp.StatusCode)
+	}
+	return nil
+}
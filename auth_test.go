@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseChallenge(t *testing.T) {
+	tests := []struct {
+		header string
+		scheme string
+		params map[string]string
+	}{
+		{`Basic realm="Registry Realm"`, "Basic",
+			map[string]string{"realm": "Registry Realm"}},
+		{`Bearer realm="https://auth.example.com/token",service="registry.example.com",scope="repository:a/b:pull,push"`,
+			"Bearer", map[string]string{
+				"realm":   "https://auth.example.com/token",
+				"service": "registry.example.com",
+				"scope":   "repository:a/b:pull,push",
+			}},
+		{`Bearer realm=https://auth/token, service=reg, error="insufficient_scope"`,
+			"Bearer", map[string]string{
+				"realm":   "https://auth/token",
+				"service": "reg",
+				"error":   "insufficient_scope",
+			}},
+		{`Bearer realm="a \"quoted\" realm"`, "Bearer",
+			map[string]string{"realm": `a "quoted" realm`}},
+		{`Basic`, "Basic", map[string]string{}},
+	}
+	for _, test := range tests {
+		scheme, params, err := parseChallenge(test.header)
+		if err != nil {
+			t.Errorf("parseChallenge(%q) failed: %v", test.header, err)
+			continue
+		}
+		if scheme != test.scheme || !reflect.DeepEqual(params, test.params) {
+			t.Errorf("parseChallenge(%q) = %q %v, expected %q %v",
+				test.header, scheme, params, test.scheme, test.params)
+		}
+	}
+	for _, header := range []string{"", `Bearer realm="open`, "Bearer =x"} {
+		if _, _, err := parseChallenge(header); err == nil {
+			t.Errorf("parseChallenge(%q) succeeded, expected error", header)
+		}
+	}
+}
+
+// authRegistry requires a valid token or basic credentials in front of a
+// fakeRegistry and serves tokens from /token.
+type authRegistry struct {
+	*fakeRegistry
+	basic     bool
+	valid     map[string]bool
+	tokens    int
+	refreshes int
+}
+
+func (a *authRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/token" {
+		a.serveToken(w, req)
+		return
+	}
+	if a.basic {
+		user, pass, ok := req.BasicAuth()
+		if !ok || user != "user" || pass != "pass" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="fake"`)
+			w.WriteHeader(401)
+			return
+		}
+	} else {
+		auth := req.Header.Get("Authorization")
+		if !a.valid[strings.TrimPrefix(auth, "Bearer ")] {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(
+				`Bearer realm="http://%s/token",service="fake, registry"`, req.Host))
+			w.WriteHeader(401)
+			return
+		}
+	}
+	a.fakeRegistry.ServeHTTP(w, req)
+}
+
+func (a *authRegistry) serveToken(w http.ResponseWriter, req *http.Request) {
+	resp := GetTokenResponse{ExpiresIn: 300}
+	if req.Method == "POST" {
+		req.ParseForm()
+		if req.Form.Get("grant_type") != "refresh_token" || req.Form.Get("refresh_token") != "refresh" {
+			w.WriteHeader(401)
+			return
+		}
+		a.refreshes++
+	} else {
+		user, pass, ok := req.BasicAuth()
+		if !ok || user != "user" || pass != "pass" ||
+			req.URL.Query().Get("service") != "fake, registry" {
+			w.WriteHeader(401)
+			return
+		}
+		if req.URL.Query().Get("offline_token") == "true" {
+			resp.RefreshToken = "refresh"
+		}
+	}
+	a.tokens++
+	resp.AccessToken = fmt.Sprintf("token-%d", a.tokens)
+	a.valid[resp.AccessToken] = true
+	json.NewEncoder(w).Encode(resp)
+}
+
+func TestTokenRefresh(t *testing.T) {
+	reg := &authRegistry{fakeRegistry: newFakeRegistry(), valid: map[string]bool{}}
+	reg.manifests["latest"] = []byte("manifest")
+	server := httptest.NewServer(reg)
+	defer server.Close()
+
+	info, err := parseRepoInfo("http://user:pass@"+server.Listener.Addr().String()+"/test/repo", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewRegistryClient(false)
+	if _, err := r.GetObject(info, "manifests/latest"); err != nil {
+		t.Fatalf("Failed to get manifest: %v", err)
+	}
+	if reg.tokens != 1 || info.RefreshToken != "refresh" {
+		t.Fatalf("expected one token and a refresh token, got %d %q", reg.tokens, info.RefreshToken)
+	}
+
+	// an expired token is refreshed before the request
+	info.Expiry = time.Now().Add(-time.Second)
+	if _, err := r.GetObject(info, "manifests/latest"); err != nil {
+		t.Fatalf("Failed to get manifest with expired token: %v", err)
+	}
+	if reg.refreshes != 1 {
+		t.Fatalf("expected the refresh token to be used, got %d refreshes", reg.refreshes)
+	}
+
+	// a token revoked by the registry is replaced
+	reg.valid = map[string]bool{}
+	info.Issued = time.Now().Add(-time.Minute)
+	if _, err := r.GetObject(info, "manifests/latest"); err != nil {
+		t.Fatalf("Failed to get manifest with revoked token: %v", err)
+	}
+
+	// a freshly issued token that is rejected is an error
+	reg.valid = map[string]bool{}
+	info.Expiry = time.Now().Add(-time.Second)
+	r.Client.Transport = rejectAfterToken{reg, r.Client.Transport}
+	if _, err := r.GetObject(info, "manifests/latest"); err == nil {
+		t.Fatalf("expected an error for a rejected fresh token")
+	}
+}
+
+// rejectAfterToken invalidates every token as soon as it is issued.
+type rejectAfterToken struct {
+	reg  *authRegistry
+	next http.RoundTripper
+}
+
+func (r rejectAfterToken) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := r.next.RoundTrip(req)
+	if req.URL.Path == "/token" {
+		r.reg.valid = map[string]bool{}
+	}
+	return resp, err
+}
+
+func TestBasicAuth(t *testing.T) {
+	reg := &authRegistry{fakeRegistry: newFakeRegistry(), basic: true}
+	reg.manifests["latest"] = []byte("manifest")
+	server := httptest.NewServer(reg)
+	defer server.Close()
+
+	r := NewRegistryClient(false)
+	info, err := parseRepoInfo("http://user:pass@"+server.Listener.Addr().String()+"/test/repo", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.CheckLogin(info); err != nil {
+		t.Fatalf("Failed to login: %v", err)
+	}
+	data, err := r.GetObject(info, "manifests/latest")
+	if err != nil || string(data) != "manifest" {
+		t.Fatalf("Failed to get manifest: %q %v", data, err)
+	}
+
+	info.Password = "wrong"
+	if _, err := r.GetObject(info, "manifests/latest"); err == nil {
+		t.Fatalf("expected an error for invalid credentials")
+	}
+}
+
+func TestLazyCredentials(t *testing.T) {
+	reg := &authRegistry{fakeRegistry: newFakeRegistry(), basic: true}
+	reg.manifests["latest"] = []byte("manifest")
+	server := httptest.NewServer(reg)
+	defer server.Close()
+
+	defer os.Setenv(userEnv, os.Getenv(userEnv))
+	defer os.Setenv(passwordEnv, os.Getenv(passwordEnv))
+	os.Setenv(userEnv, "")
+	info, err := parseRepoInfo("http://"+server.Listener.Addr().String()+"/test/repo", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Username != "" {
+		t.Fatalf("Credentials were looked up while parsing")
+	}
+	os.Setenv(userEnv, "user")
+	os.Setenv(passwordEnv, "pass")
+	data, err := NewRegistryClient(false).GetObject(info, "manifests/latest")
+	if err != nil || string(data) != "manifest" {
+		t.Fatalf("Failed to get manifest: %q %v", data, err)
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/Sirupsen/logrus"
+	gdigest "github.com/opencontainers/go-digest"
+)
+
+// Blob is a piece of content that can be read multiple times without holding
+// all of it in memory.
+type Blob interface {
+	Open() (io.ReadCloser, error)
+	Size() int64
+}
+
+type bytesBlob []byte
+
+func (b bytesBlob) Open() (io.ReadCloser, error) {
+	return NopCloser(bytes.NewReader(b)), nil
+}
+
+func (b bytesBlob) Size() int64 {
+	return int64(len(b))
+}
+
+// fileBlob is a blob stored in a file on disk.
+type fileBlob struct {
+	path string
+	size int64
+}
+
+func (b *fileBlob) Open() (io.ReadCloser, error) {
+	return os.Open(b.path)
+}
+
+func (b *fileBlob) Size() int64 {
+	return b.size
+}
+
+// sectionBlob is a blob stored in a section of a larger file.
+type sectionBlob struct {
+	r      io.ReaderAt
+	offset int64
+	size   int64
+}
+
+func (b *sectionBlob) Open() (io.ReadCloser, error) {
+	return NopCloser(io.NewSectionReader(b.r, b.offset, b.size)), nil
+}
+
+func (b *sectionBlob) Size() int64 {
+	return b.size
+}
+
+// readBlob reads the entire contents of a blob into memory. It should only be
+// used for small blobs like manifests and configs.
+func readBlob(b Blob) ([]byte, error) {
+	in, err := b.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	return ioutil.ReadAll(in)
+}
+
+// verifyingReader checks the digest of the data read through it and returns
+// an error at EOF if it doesn't match.
+type verifyingReader struct {
+	io.ReadCloser
+	verifier gdigest.Verifier
+	digest   gdigest.Digest
+}
+
+func newVerifyingReader(in io.ReadCloser, digest gdigest.Digest) io.ReadCloser {
+	if digest.Validate() != nil {
+		return in
+	}
+	return &verifyingReader{in, digest.Verifier(), digest}
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.ReadCloser.Read(p)
+	v.verifier.Write(p[:n])
+	if err == io.EOF && !v.verifier.Verified() {
+		return n, fmt.Errorf("content does not match digest %s", v.digest)
+	}
+	return n, err
+}
+
+// countingReader keeps track of the number of bytes read from it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// ociLayout is an index of the files in an oci layout tarball. The tarball is
+// read in a single pass and the files are served from offsets into an
+// uncompressed copy of it.
+type ociLayout struct {
+	path    string
+	file    *os.File
+	entries map[string]*sectionBlob
+}
+
+// openLayout indexes the oci layout tarball at path. If the tarball is
+// compressed, it is decompressed into an unlinked temporary file so the
+// blobs can be read at random. Close releases the file.
+func openLayout(path string) (*ociLayout, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		logrus.Errorf("Failed to open %v: %v", path, err)
+		return nil, err
+	}
+	file := in
+	magic := make([]byte, 2)
+	if _, err := io.ReadFull(in, magic); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		file, err = decompressToTemp(in)
+		in.Close()
+		if err != nil {
+			logrus.Errorf("Failed to decompress %v: %v", path, err)
+			return nil, err
+		}
+	}
+	if _, err := file.Seek(0, 0); err != nil {
+		file.Close()
+		return nil, err
+	}
+	layout := &ociLayout{path: path, file: file, entries: map[string]*sectionBlob{}}
+	counter := &countingReader{r: bufio.NewReader(file)}
+	tarIn := tar.NewReader(counter)
+	for {
+		hdr, err := tarIn.Next()
+		if err == io.EOF {
+			// end of tar archive
+			break
+		}
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("Error reading tar entry: %v", err)
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+		// the data of the entry starts where the header ends
+		clean := filepath.Clean(hdr.Name)
+		layout.entries[clean] = &sectionBlob{file, counter.n, hdr.Size}
+	}
+	return layout, nil
+}
+
+func decompressToTemp(in io.ReadSeeker) (*os.File, error) {
+	if _, err := in.Seek(0, 0); err != nil {
+		return nil, err
+	}
+	gzipIn, err := MaybeGzipReader(NopCloser(in))
+	if err != nil {
+		return nil, err
+	}
+	defer gzipIn.Close()
+	tmp, err := ioutil.TempFile("", "smith-layout-")
+	if err != nil {
+		return nil, err
+	}
+	// unlink immediately so the file is cleaned up when it is closed
+	os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, gzipIn); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	return tmp, nil
+}
+
+// Close closes the file the blobs of the layout are read from.
+func (l *ociLayout) Close() error {
+	return l.file.Close()
+}
+
+// Blob returns the file at filename in the layout.
+func (l *ociLayout) Blob(filename string) (Blob, error) {
+	b, ok := l.entries[filepath.Clean(filename)]
+	if !ok {
+		return nil, fmt.Errorf("Could not find %s in %s", filename, l.path)
+	}
+	return b, nil
+}
+
+// DigestBlob returns the blob for digest in the layout.
+func (l *ociLayout) DigestBlob(digest gdigest.Digest) (Blob, error) {
+	parts := append([]string{"blobs"}, string(digest.Algorithm()), digest.Hex())
+	return l.Blob(filepath.Join(parts...))
+}
+
+// Extractor returns a function that reads small blobs from the layout.
+func (l *ociLayout) Extractor() Extractor {
+	return func(digest gdigest.Digest) ([]byte, error) {
+		b, err := l.DigestBlob(digest)
+		if err != nil {
+			return nil, err
+		}
+		return readBlob(b)
+	}
+}
+
+// gzipReaderFromStream decompresses in if it is gzipped. Unlike
+// MaybeGzipReader it doesn't need to seek so it can be used on streams.
+func gzipReaderFromStream(in io.Reader) (io.ReadCloser, error) {
+	buffered := bufio.NewReader(in)
+	magic, err := buffered.Peek(2)
+	if err != nil || magic[0] != 0x1f || magic[1] != 0x8b {
+		logrus.Debugf("Stream is not a gzip, assuming tar")
+		return ioutil.NopCloser(buffered), nil
+	}
+	if !HasPigz() {
+		return gzip.NewReader(buffered)
+	}
+	pigzReader, err := NewPigzReader(buffered)
+	if err != nil {
+		logrus.Errorf("Failed to read with pigz")
+		return nil, err
+	}
+	return pigzReader, nil
+}
@@ -1,32 +1,36 @@
 package main
 
 import (
+	"debug/elf"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"sort"
-	"strconv"
 	"strings"
 	"syscall"
-	"time"
 
 	"github.com/oracle/smith/execute"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/opencontainers/image-spec/specs-go/v1"
 )
 
 const (
-	rootfs = "rootfs"
+	rootfs            = "rootfs"
+	defaultChrootPath = "/usr/sbin:/usr/bin:/sbin:/bin"
 )
 
 type buildOptions struct {
-	insecure bool
-	fast     bool
-	conf     string
-	dir      string
-	buildNo  string
+	insecure     bool
+	fast         bool
+	conf         string
+	dir          string
+	buildNo      string
+	reproducible bool
+	noCache      bool
+	cacheSize    int64
 }
 
 func isOci(uri string) bool {
@@ -50,8 +54,21 @@ func isOci(uri string) bool {
 	return false
 }
 
+// mockConfig returns the mock config that builds pkg for platform. The
+// default config builds for the host, so other platforms need an entry in
+// mock.configs.
+func mockConfig(pkg *ConfigDef, platform v1.Platform) (string, error) {
+	if config, ok := pkg.Mock.Configs[platformString(platform)]; ok {
+		return config, nil
+	}
+	if !platformMatches(hostPlatform(), platform) {
+		return "", fmt.Errorf("mock.configs has no config for %s", platformString(platform))
+	}
+	return pkg.Mock.Config, nil
+}
+
 // installPackage returns a list of all packages installed if applicable
-func installPackage(buildOpts *buildOptions, outputDir string, pkg *ConfigDef) ([]string, error) {
+func installPackage(buildOpts *buildOptions, outputDir string, pkg *ConfigDef, platform v1.Platform) ([]string, error) {
 	logrus.Infof("Installing package %v", pkg.Package)
 	if pkg.Type == "" {
 		if isOci(pkg.Package) {
@@ -65,21 +82,73 @@ func installPackage(buildOpts *buildOptions, outputDir string, pkg *ConfigDef) (
 		if pkg.Mock.Config == "" {
 			pkg.Mock.Config = "/etc/mock/default.cfg"
 		}
-		pkgMfst := NewRPMManifest()
-		if err := buildMock(buildOpts, outputDir, pkg, pkgMfst); err != nil {
+		// use a copy so the platform specific config isn't normalized
+		platformPkg := *pkg
+		config, err := mockConfig(pkg, platform)
+		if err != nil {
 			return nil, err
 		}
-		packages := []string{}
-		for key := range pkgMfst.PkgsInstalled {
-			packages = append(packages, key)
+		platformPkg.Mock.Config = config
+		install := func() ([]string, error) {
+			pkgMfst := NewRPMManifest()
+			if err := buildMock(buildOpts, outputDir, &platformPkg, pkgMfst); err != nil {
+				return nil, err
+			}
+			packages := []string{}
+			for key := range pkgMfst.PkgsInstalled {
+				packages = append(packages, key)
+			}
+			sort.Strings(packages)
+			return packages, nil
+		}
+		key, err := cacheKey(&platformPkg, platform, nil)
+		if err != nil {
+			// without the repo metadata a cached install could be stale
+			logrus.Infof("Not caching the mock install: %v", err)
+			return install()
 		}
-		sort.Strings(packages)
-		return packages, nil
+		entry := &cacheEntry{Type: pkg.Type, Package: pkg.Package, Platform: platformString(platform)}
+		return cachedInstall(buildOpts, key, outputDir, entry, install)
 	case "oci":
-		if err := buildOci(buildOpts, outputDir, pkg); err != nil {
+		image, err := ociBaseImage(buildOpts, pkg, platform)
+		if err != nil {
 			return nil, err
 		}
-		return nil, nil
+		defer image.Close()
+		// pull the existing data out of the image
+		setDefaultsFromImage(pkg, image)
+		key, err := cacheKey(pkg, platform, image)
+		if err != nil {
+			return nil, err
+		}
+		entry := &cacheEntry{Type: pkg.Type, Package: pkg.Package, Platform: platformString(platform)}
+		return cachedInstall(buildOpts, key, outputDir, entry, func() ([]string, error) {
+			return nil, buildOci(buildOpts, outputDir, pkg, platform, image)
+		})
+	case "static":
+		// copying a few files from the host is cheaper than the cache
+		return nil, buildStatic(buildOpts, outputDir, pkg, platform)
+	case "dir":
+		// the directory can change without smith noticing, so it isn't cached
+		return nil, buildLocal(buildOpts, outputDir, pkg, platform)
+	case "tar":
+		key, err := cacheKey(pkg, platform, nil)
+		if err != nil {
+			return nil, err
+		}
+		entry := &cacheEntry{Type: pkg.Type, Package: pkg.Package, Platform: platformString(platform)}
+		return cachedInstall(buildOpts, key, outputDir, entry, func() ([]string, error) {
+			return nil, buildLocal(buildOpts, outputDir, pkg, platform)
+		})
+	case "rpm", "deb", "apk":
+		key, err := cacheKey(pkg, platform, nil)
+		if err != nil {
+			return nil, err
+		}
+		entry := &cacheEntry{Type: pkg.Type, Package: pkg.Package, Platform: platformString(platform)}
+		return cachedInstall(buildOpts, key, outputDir, entry, func() ([]string, error) {
+			return buildNative(buildOpts, outputDir, pkg, platform)
+		})
 	default:
 		return nil, fmt.Errorf("Package type %v not recognized", pkg.Type)
 	}
@@ -89,7 +158,7 @@ func getMetadata() *ImageMetadata {
 	return &ImageMetadata{
 		SmithVer:  ver,
 		SmithSha:  sha,
-		BuildTime: time.Now().UTC(),
+		BuildTime: buildTime(false),
 	}
 }
 
@@ -127,6 +196,16 @@ func buildContainer(tarfile string, buildOpts *buildOptions) bool {
 		return false
 	}
 
+	platformNames := pkg.Platforms
+	if pkg.Platform != "" {
+		platformNames = append(platformNames, pkg.Platform)
+	}
+	platforms, err := parsePlatforms(platformNames)
+	if err != nil {
+		logrus.Errorf("Failed to parse platforms: %v", err)
+		return false
+	}
+
 	buildDir, err := ioutil.TempDir("", "smith-build-")
 	if err != nil {
 		logrus.Errorf("Unable to get temp dir: %v", err)
@@ -147,38 +226,44 @@ func buildContainer(tarfile string, buildOpts *buildOptions) bool {
 	}
 	logrus.Infof("Building in %v", buildDir)
 
-	outputDir, err := rootfsDir(buildDir, rootfs)
-	if err != nil {
-		logrus.Errorf("Failed to get rootfs dir: %v", err)
-		return false
-	}
-
-	nss, err := PopulateNss(outputDir, pkg.User, pkg.Groups, pkg.Nss)
-	if err != nil {
-		logrus.Errorf("Failed to populate nss: %v", err)
-		return false
-	}
-	// force nss on if named users or groups were specified
-	if nss {
-		pkg.Nss = true
-	}
-
-	// build package
-	var packages []string
-	if pkg.Package != "" {
-		packages, err = installPackage(buildOpts, outputDir, pkg)
-		if err != nil {
-			logrus.Errorf("Failed to install %v: %v", pkg.Package, err)
-			return false
+	// each output has a config and directory per platform
+	outputs := []string{outpath}
+	if len(pkg.Images) != 0 {
+		outputs = []string{}
+		for _, image := range pkg.Images {
+			outputs = append(outputs, imageOutput(outpath, image))
 		}
 	}
+	defs := make([][]*ConfigDef, len(outputs))
+	dirs := make([][]string, len(outputs))
 
-	for _, mnt := range pkg.Mounts {
-		err = os.MkdirAll(filepath.Join(outputDir, mnt), 0755)
+	// build each platform in its own directory
+	platformPackages := [][]string{}
+	for _, platform := range platforms {
+		platformDir := buildDir
+		if len(platforms) > 1 {
+			name := strings.Replace(platformString(platform), "/", "-", -1)
+			platformDir = filepath.Join(buildDir, name)
+		}
+		logrus.Infof("Building for platform %v", platformString(platform))
+		var packages []string
+		if len(pkg.Images) == 0 {
+			packages, err = buildPlatform(buildOpts, path, platformDir, pkg, platform)
+			defs[0] = append(defs[0], pkg)
+			dirs[0] = append(dirs[0], platformDir)
+		} else {
+			var imageDefs []*ConfigDef
+			imageDefs, packages, err = buildImages(buildOpts, path, platformDir, pkg, platform)
+			for i, def := range imageDefs {
+				defs[i] = append(defs[i], def)
+				dirs[i] = append(dirs[i], filepath.Join(platformDir, pkg.Images[i].Name))
+			}
+		}
 		if err != nil {
-			logrus.Errorf("Failed to create %v dir: %v", mnt, err)
+			logrus.Errorf("Failed to build for %v: %v", platformString(platform), err)
 			return false
 		}
+		platformPackages = append(platformPackages, packages)
 	}
 
 	// ensure meta directory
@@ -191,24 +276,114 @@ func buildContainer(tarfile string, buildOpts *buildOptions) bool {
 	}
 
 	// write build metadata
-	extraBlobs := []OpaqueBlob{}
 	metadata := getMetadata()
 	metadata.Buildno = buildOpts.buildNo
-	if hostname, err := os.Hostname(); err == nil {
+	if buildOpts.reproducible {
+		metadata.BuildTime = buildTime(true)
+	} else if hostname, err := os.Hostname(); err == nil {
 		metadata.BuildHost = hostname
 	}
 
+	for i, output := range outputs {
+		if err := packBuild(buildOpts, output, defs[i], dirs[i], platforms, platformPackages, metadata); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// packBuild creates an image for each platform from the config and build
+// directory of that platform and packs them into outpath.
+func packBuild(buildOpts *buildOptions, outpath string, defs []*ConfigDef, dirs []string, platforms []v1.Platform, packages [][]string, metadata *ImageMetadata) error {
 	// write the normalized config to metadata
-	smithJSON, err := json.Marshal(pkg)
+	extraBlobs := []OpaqueBlob{}
+	smithJSON, err := json.Marshal(defs[len(defs)-1])
 	if err == nil {
-		newBlob := OpaqueBlob{"application/vnd.smith.spec+json", smithJSON}
+		newBlob := OpaqueBlob{specMT, smithJSON}
 		extraBlobs = append(extraBlobs, newBlob)
 	}
 
-	if packages != nil {
-		newBlob := OpaqueBlob{"application/vnd.smith.packages",
-			[]byte(strings.Join(packages, "\n"))}
-		extraBlobs = append(extraBlobs, newBlob)
+	images := []*Image{}
+	for i, platform := range platforms {
+		image, err := imageFromBuild(defs[i], dirs[i], platform, buildOpts.reproducible)
+		if err != nil {
+			logrus.Errorf("Failed to create image for %v: %v", platformString(platform), err)
+			return err
+		}
+		// the layers of the parent are read from its layout until packed
+		defer image.Close()
+		image.AdditionalBlobs = append([]OpaqueBlob{}, extraBlobs...)
+		if packages[i] != nil {
+			newBlob := OpaqueBlob{packagesMT,
+				[]byte(strings.Join(packages[i], "\n"))}
+			image.AdditionalBlobs = append(image.AdditionalBlobs, newBlob)
+		}
+		image.Metadata = metadata
+		images = append(images, image)
+	}
+
+	// pack
+	logrus.Infof("Packing image into %v", outpath)
+	if err := os.MkdirAll(filepath.Dir(outpath), 0755); err != nil {
+		logrus.Errorf("Failed to create dir for %v: %v", outpath, err)
+		return err
+	}
+	if err := WriteOciTarGz(images, outpath, buildOpts.reproducible); err != nil {
+		logrus.Errorf("Failed to pack dir into %v: %v", outpath, err)
+		return err
+	}
+	return nil
+}
+
+// buildPlatform creates the rootfs for a single platform in buildDir and
+// overlays the files from path. It returns the list of packages installed.
+func buildPlatform(buildOpts *buildOptions, path, buildDir string, pkg *ConfigDef, platform v1.Platform) ([]string, error) {
+	outputDir, err := rootfsDir(buildDir, rootfs)
+	if err != nil {
+		logrus.Errorf("Failed to get rootfs dir: %v", err)
+		return nil, err
+	}
+
+	nss, err := PopulateNss(outputDir, pkg.User, pkg.Groups, pkg.Nss)
+	if err != nil {
+		logrus.Errorf("Failed to populate nss: %v", err)
+		return nil, err
+	}
+	// force nss on if named users or groups were specified
+	if nss {
+		pkg.Nss = true
+	}
+
+	// only follow libraries that match the target platform
+	SetTargetMachine(platformMachine(platform))
+	defer SetTargetMachine(elf.EM_NONE)
+
+	// build package
+	var packages []string
+	if pkg.Package != "" || pkg.Type == "static" {
+		packages, err = installPackage(buildOpts, outputDir, pkg, platform)
+		if err != nil {
+			logrus.Errorf("Failed to install %v: %v", pkg.Package, err)
+			return nil, err
+		}
+	}
+
+	if err := overlayPlatform(buildOpts, path, buildDir, pkg, platform); err != nil {
+		return nil, err
+	}
+	return packages, nil
+}
+
+// overlayPlatform adds the mounts, the overlay from path and the rendered
+// templates to the rootfs in buildDir and splits it into layers.
+func overlayPlatform(buildOpts *buildOptions, path, buildDir string, pkg *ConfigDef, platform v1.Platform) error {
+	outputDir := filepath.Join(buildDir, rootfs)
+	for _, mnt := range pkg.Mounts {
+		err := os.MkdirAll(filepath.Join(outputDir, mnt), 0755)
+		if err != nil {
+			logrus.Errorf("Failed to create %v dir: %v", mnt, err)
+			return err
+		}
 	}
 
 	// perform overlay
@@ -217,19 +392,23 @@ func buildContainer(tarfile string, buildOpts *buildOptions) bool {
 	if pkg.Parent != "" {
 		files = append(files, strings.Split(pkg.Parent, ":")[0])
 	}
-	err = CopyTree(path, buildDir, files, nil, pkg.Nss, false, false)
+	err := CopyTree(path, buildDir, files, nil, pkg.Nss, false, false)
 	if err != nil {
 		logrus.Errorf("Failed to copy %v to %v: %v", path, buildDir, err)
-		return false
+		return err
 	}
 
-	// pack
-	logrus.Infof("Packing image into %v", outpath)
-	if err := WriteOciFromBuild(pkg, buildDir, outpath, metadata, extraBlobs); err != nil {
-		logrus.Errorf("Failed to pack dir into %v: %v", outpath, err)
-		return false
+	data := newTemplateData(buildOpts, pkg, platform)
+	if err := renderTemplates(path, outputDir, data); err != nil {
+		logrus.Errorf("Failed to render templates: %v", err)
+		return err
 	}
-	return true
+
+	if err := splitLayers(pkg, path, buildDir); err != nil {
+		logrus.Errorf("Failed to split %v into layers: %v", outputDir, err)
+		return err
+	}
+	return nil
 }
 
 func rootfsDir(buildDir string, rootDir string) (string, error) {
@@ -329,52 +508,27 @@ func buildMock(buildOpts *buildOptions, outputDir string, pkg *ConfigDef, pkgMfs
 	return nil
 }
 
-func buildOci(buildOpts *buildOptions, outputDir string, pkg *ConfigDef) error {
-	uid, gid := os.Getuid(), os.Getgid()
-	unpackDir := filepath.Join(os.TempDir(), "smith-unpack-"+strconv.Itoa(uid))
-
-	var image *Image
-	var err error
+// ociBaseImage loads the image for platform that an oci build starts from.
+func ociBaseImage(buildOpts *buildOptions, pkg *ConfigDef, platform v1.Platform) (*Image, error) {
 	if strings.HasPrefix(pkg.Package, "http://") ||
 		strings.HasPrefix(pkg.Package, "https://") {
 		info, err := parseRepoInfo(pkg.Package, false)
 		if err != nil {
-			return err
-		}
-
-		image, err = NewRegistryClient(buildOpts.insecure).ImageFromRepo(info)
-	} else {
-		image, err = imageFromFile(pkg.Package)
-	}
-	if err != nil {
-		return err
-	}
-	// pull the existing data out of the image
-	setDefaultsFromImage(pkg, image)
-
-	if !buildOpts.fast {
-		// remove directory
-		logrus.Debugf("Removing %v", unpackDir)
-		if err := os.RemoveAll(unpackDir); err != nil {
-			logrus.Errorf("Failed to remove %v: %v", unpackDir, err)
-			return err
+			return nil, err
 		}
+		return NewRegistryClient(buildOpts.insecure).ImageFromRepo(info, &platform)
 	}
+	return imageFromFile(pkg.Package, &platform)
+}
 
-	// set path for executor
-	path := "/usr/sbin:/usr/bin:/sbin:/bin"
-	ld_library_path := ""
-	for _, e := range pkg.Env {
-		if strings.HasPrefix(e, "PATH=") {
-			path = e[len("PATH="):]
-		}
-		if strings.HasPrefix(e, "LD_LIBRARY_PATH=") {
-			ld_library_path = e[len("LD_LIBRARY_PATH="):]
-		}
-	}
-	executor := func(name string, arg ...string) (string, string, error) {
+// chrootExecutor returns an executor that runs commands chrooted into
+// rootDir, in a user namespace if smith isn't running as root. Commands
+// without a slash are looked up in path inside the chroot.
+func chrootExecutor(rootDir, path string) executor {
+	uid, gid := os.Getuid(), os.Getgid()
+	return func(name string, arg ...string) (string, string, error) {
 		attr := &syscall.SysProcAttr{
-			Chroot: unpackDir,
+			Chroot: rootDir,
 		}
 		attr, err := setAttrMappings(attr, uid, gid)
 		if err != nil {
@@ -390,7 +544,7 @@ func buildOci(buildOpts *buildOptions, outputDir string, pkg *ConfigDef) error {
 					// Unix shell semantics: path element "" means "."
 					dir = "."
 				}
-				path := filepath.Join(unpackDir, dir, name)
+				path := filepath.Join(rootDir, dir, name)
 				d, err := os.Lstat(path)
 				if err != nil {
 					continue
@@ -398,27 +552,45 @@ func buildOci(buildOpts *buildOptions, outputDir string, pkg *ConfigDef) error {
 				if m := d.Mode(); m.IsDir() || m&0111 == 0 {
 					continue
 				}
-				name = path[len(unpackDir):]
+				name = path[len(rootDir):]
 				break
 			}
 		}
 		return execute.AttrExecuteQuiet(attr, name, arg...)
 	}
+}
 
-	// only unpack if the directory doesn't already exist
-	if _, err := os.Stat(unpackDir); os.IsNotExist(err) {
-		if err := os.MkdirAll(unpackDir, 0755); err != nil {
-			return err
-		}
-		if err := ExtractOci(image, unpackDir); err != nil {
-			return err
+// chrootEnv returns the PATH for the executor and the LD_LIBRARY_PATH
+// entries to preload from the environment of an image.
+func chrootEnv(env []string) (string, []string) {
+	path := defaultChrootPath
+	ld_library_path := ""
+	for _, e := range env {
+		if strings.HasPrefix(e, "PATH=") {
+			path = e[len("PATH="):]
 		}
-		if err := readablePathsFromExecutor(executor, pkg.Paths); err != nil {
-			logrus.Warnf("Could not make paths readable: %v", err)
+		if strings.HasPrefix(e, "LD_LIBRARY_PATH=") {
+			ld_library_path = e[len("LD_LIBRARY_PATH="):]
 		}
 	}
+	return path, strings.Split(ld_library_path, ":")
+}
+
+func buildOci(buildOpts *buildOptions, outputDir string, pkg *ConfigDef, platform v1.Platform, image *Image) error {
+	unpackDir, release, err := unpackImage(image, buildOpts.fast)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	path, preload := chrootEnv(pkg.Env)
+	executor := chrootExecutor(unpackDir, path)
+
+	// the unpack dir may be shared with builds that use other paths
+	if err := readablePathsFromExecutor(executor, pkg.Paths); err != nil {
+		logrus.Warnf("Could not make paths readable: %v", err)
+	}
 
-	preload := strings.Split(ld_library_path, ":")
 	if err := SetSoPathsFromExecutor(executor, preload); err != nil {
 		return err
 	}
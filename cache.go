@@ -0,0 +1,418 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	gdigest "github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	cacheDirEnv      = "SMITH_CACHE_DIR"
+	cacheVersion     = 1
+	defaultCacheSize = 10 << 30
+	cacheEntryFile   = "entry.json"
+	cachePackages    = "packages"
+)
+
+// cacheKeyData is everything that affects the output of a package install.
+// The cache key is the digest of its json encoding.
+type cacheKeyData struct {
+	Version     int              `json:"version"`
+	SmithSha    string           `json:"smithSha,omitempty"`
+	Type        string           `json:"type"`
+	Package     string           `json:"package"`
+	PackageFile gdigest.Digest   `json:"packageFile,omitempty"`
+	Platform    string           `json:"platform"`
+	Paths       []string         `json:"paths,omitempty"`
+	Excludes    []string         `json:"excludes,omitempty"`
+	Nss         bool             `json:"nss,omitempty"`
+	User        string           `json:"user,omitempty"`
+	Groups      []string         `json:"groups,omitempty"`
+	Mock        *MockDef         `json:"mock,omitempty"`
+	Native      *NativeDef       `json:"native,omitempty"`
+	Inputs      []gdigest.Digest `json:"inputs,omitempty"`
+	MockConfig  gdigest.Digest   `json:"mockConfig,omitempty"`
+	Base        gdigest.Digest   `json:"base,omitempty"`
+	Env         []string         `json:"env,omitempty"`
+}
+
+// cacheEntry describes a cached package install.
+type cacheEntry struct {
+	Key      string    `json:"key"`
+	Type     string    `json:"type"`
+	Package  string    `json:"package"`
+	Platform string    `json:"platform"`
+	Size     int64     `json:"size"`
+	Created  time.Time `json:"created"`
+	LastUsed time.Time `json:"lastUsed"`
+	dir      string
+}
+
+// cacheDir returns the directory of the build cache, honoring
+// SMITH_CACHE_DIR and XDG_CACHE_HOME.
+func cacheDir() string {
+	if dir := os.Getenv(cacheDirEnv); dir != "" {
+		return dir
+	}
+	base := os.Getenv("XDG_CACHE_HOME")
+	if base == "" {
+		base = filepath.Join(os.Getenv("HOME"), ".cache")
+	}
+	return filepath.Join(base, "smith")
+}
+
+// fileDigest returns the digest of the contents of a file or an empty
+// digest if it doesn't exist.
+func fileDigest(path string) (gdigest.Digest, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return digest(data), nil
+}
+
+// fileDigests returns the digests of the contents of files.
+func fileDigests(files []string) ([]gdigest.Digest, error) {
+	digests := []gdigest.Digest{}
+	for _, file := range files {
+		d, err := fileDigest(file)
+		if err != nil {
+			return nil, err
+		}
+		digests = append(digests, d)
+	}
+	return digests, nil
+}
+
+// cacheKey computes the cache key for installing pkg for platform. For oci
+// builds base is the base image.
+func cacheKey(pkg *ConfigDef, platform v1.Platform, base *Image) (string, error) {
+	data := cacheKeyData{
+		Version:  cacheVersion,
+		SmithSha: sha,
+		Type:     pkg.Type,
+		Package:  pkg.Package,
+		Platform: platformString(platform),
+		Paths:    pkg.Paths,
+		Excludes: pkg.Excludes,
+		Nss:      pkg.Nss,
+		User:     pkg.User,
+		Groups:   pkg.Groups,
+	}
+	var err error
+	switch pkg.Type {
+	case "mock":
+		data.Mock = &pkg.Mock
+		config, err := readMockConfig(pkg.Mock.Config, map[string]bool{})
+		if err != nil {
+			return "", err
+		}
+		data.MockConfig = digest(config)
+		// the repos of the config are keyed on their metadata
+		if data.Inputs, err = mockRepoDigests(config); err != nil {
+			return "", err
+		}
+		// local rpms are keyed on their contents
+		if strings.HasSuffix(pkg.Package, ".rpm") {
+			if data.PackageFile, err = fileDigest(pkg.Package); err != nil {
+				return "", err
+			}
+		}
+	case "rpm", "deb", "apk":
+		data.Native = nativeDef(pkg, pkg.Type)
+		// local packages and repo metadata are keyed on their contents
+		files, err := nativeInputs(pkg)
+		if err != nil {
+			return "", err
+		}
+		if data.Inputs, err = fileDigests(files); err != nil {
+			return "", err
+		}
+	case "tar":
+		if data.Inputs, err = fileDigests([]string{pkg.Package}); err != nil {
+			return "", err
+		}
+		data.Env = pkg.Env
+	case "oci":
+		configData, err := serializeConfig(base)
+		if err != nil {
+			return "", err
+		}
+		data.Base = digest(configData)
+		// PATH and LD_LIBRARY_PATH affect which dependencies are found
+		data.Env = pkg.Env
+	}
+	b, err := json.Marshal(data)
+	if err != nil {
+		return "", err
+	}
+	return digest(b).Hex(), nil
+}
+
+// copyDir copies the tree at src into dst preserving modes and symlinks.
+// Files are hard linked when possible.
+func copyDir(src, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		switch {
+		case info.IsDir():
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+			return os.Chmod(target, info.Mode().Perm())
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			os.Remove(target)
+			return os.Symlink(link, target)
+		case info.Mode().IsRegular():
+			os.Remove(target)
+			if err := Copy(path, target); err != nil {
+				return err
+			}
+			return os.Chmod(target, info.Mode().Perm())
+		}
+		logrus.Debugf("Skipping special file %v", path)
+		return nil
+	})
+}
+
+// dirSize returns the total size of the regular files under dir.
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+func readCacheEntry(dir string) (*cacheEntry, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, cacheEntryFile))
+	if err != nil {
+		return nil, err
+	}
+	entry := &cacheEntry{}
+	if err := json.Unmarshal(data, entry); err != nil {
+		return nil, fmt.Errorf("error unmarshaling %s: %v", cacheEntryFile, err)
+	}
+	entry.dir = dir
+	return entry, nil
+}
+
+func (e *cacheEntry) write() error {
+	data, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(e.dir, cacheEntryFile), data, 0644)
+}
+
+// restoreCache copies the cached install for key into outputDir. It returns
+// false if there is no such entry.
+func restoreCache(key, outputDir string) (bool, []string, error) {
+	entry, err := readCacheEntry(filepath.Join(cacheDir(), key))
+	if os.IsNotExist(err) {
+		return false, nil, nil
+	}
+	if err != nil {
+		return false, nil, err
+	}
+	if err := copyDir(filepath.Join(entry.dir, rootfs), outputDir); err != nil {
+		return false, nil, err
+	}
+	var packages []string
+	data, err := ioutil.ReadFile(filepath.Join(entry.dir, cachePackages))
+	if err == nil {
+		packages = []string{}
+		if len(data) != 0 {
+			packages = strings.Split(string(data), "\n")
+		}
+	} else if !os.IsNotExist(err) {
+		return false, nil, err
+	}
+	entry.LastUsed = time.Now().UTC()
+	if err := entry.write(); err != nil {
+		logrus.Warnf("Failed to update cache entry %s: %v", key, err)
+	}
+	return true, packages, nil
+}
+
+// storeCache saves the contents of outputDir and the installed packages in
+// the cache under key.
+func storeCache(key string, entry *cacheEntry, outputDir string, packages []string) error {
+	dir := cacheDir()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmpDir, err := ioutil.TempDir(dir, "tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+	if err := copyDir(outputDir, filepath.Join(tmpDir, rootfs)); err != nil {
+		return err
+	}
+	if packages != nil {
+		data := []byte(strings.Join(packages, "\n"))
+		if err := ioutil.WriteFile(filepath.Join(tmpDir, cachePackages), data, 0644); err != nil {
+			return err
+		}
+	}
+	entry.Key = key
+	entry.dir = tmpDir
+	entry.Created = time.Now().UTC()
+	entry.LastUsed = entry.Created
+	if entry.Size, err = dirSize(tmpDir); err != nil {
+		return err
+	}
+	if err := entry.write(); err != nil {
+		return err
+	}
+	// the rename fails if a concurrent build already stored the same key
+	if err := os.Rename(tmpDir, filepath.Join(dir, key)); err != nil {
+		logrus.Debugf("Not replacing cache entry %s: %v", key, err)
+	}
+	return nil
+}
+
+// cachedInstall restores the install for key into outputDir from the cache
+// or runs install and stores the result.
+func cachedInstall(buildOpts *buildOptions, key, outputDir string, entry *cacheEntry, install func() ([]string, error)) ([]string, error) {
+	if buildOpts.noCache {
+		return install()
+	}
+	ok, packages, err := restoreCache(key, outputDir)
+	if err != nil {
+		logrus.Warnf("Failed to restore cache entry %s: %v", key, err)
+	} else if ok {
+		logrus.Infof("Using cached install %s", key[:12])
+		return packages, nil
+	}
+	packages, err = install()
+	if err != nil {
+		return nil, err
+	}
+	if err := storeCache(key, entry, outputDir, packages); err != nil {
+		logrus.Warnf("Failed to store cache entry %s: %v", key, err)
+		return packages, nil
+	}
+	if _, err := pruneCache(buildOpts.cacheSize); err != nil {
+		logrus.Warnf("Failed to prune cache: %v", err)
+	}
+	return packages, nil
+}
+
+// cacheEntries returns the entries in the cache, most recently used first.
+func cacheEntries() ([]*cacheEntry, error) {
+	dir := cacheDir()
+	infos, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	entries := []*cacheEntry{}
+	for _, info := range infos {
+		if !info.IsDir() || strings.HasPrefix(info.Name(), "tmp-") {
+			continue
+		}
+		entry, err := readCacheEntry(filepath.Join(dir, info.Name()))
+		if err != nil {
+			logrus.Warnf("Ignoring invalid cache entry %s: %v", info.Name(), err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].LastUsed.After(entries[j].LastUsed)
+	})
+	return entries, nil
+}
+
+// pruneCache removes the least recently used entries until the cache is no
+// larger than maxSize. It returns the removed entries.
+func pruneCache(maxSize int64) ([]*cacheEntry, error) {
+	entries, err := cacheEntries()
+	if err != nil {
+		return nil, err
+	}
+	var total int64
+	removed := []*cacheEntry{}
+	for _, entry := range entries {
+		if total+entry.Size <= maxSize {
+			total += entry.Size
+			continue
+		}
+		logrus.Debugf("Removing cache entry %s", entry.Key)
+		if err := os.RemoveAll(entry.dir); err != nil {
+			return removed, err
+		}
+		removed = append(removed, entry)
+	}
+	return removed, nil
+}
+
+func listCache() bool {
+	entries, err := cacheEntries()
+	if err != nil {
+		logrus.Errorf("Failed to read cache: %v", err)
+		return false
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "KEY\tTYPE\tPACKAGE\tPLATFORM\tSIZE\tLAST USED\n")
+	var total int64
+	for _, e := range entries {
+		total += e.Size
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\n", e.Key[:12], e.Type, e.Package,
+			e.Platform, e.Size, e.LastUsed.Local().Format(time.RFC3339))
+	}
+	w.Flush()
+	fmt.Printf("%d entries, %d bytes in %s\n", len(entries), total, cacheDir())
+	return true
+}
+
+func pruneCacheCommand(maxSize int64, all bool) bool {
+	if all {
+		maxSize = -1
+	}
+	removed, err := pruneCache(maxSize)
+	if err != nil {
+		logrus.Errorf("Failed to prune cache: %v", err)
+		return false
+	}
+	var freed int64
+	for _, e := range removed {
+		freed += e.Size
+	}
+	logrus.Infof("Removed %d entries, freed %d bytes", len(removed), freed)
+	return true
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCacheKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smith-test-")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+	config := filepath.Join(dir, "mock.cfg")
+	if err := ioutil.WriteFile(config, []byte("config_opts['root'] = 'a'"), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+	pkg := &ConfigDef{Type: "mock", Package: "coreutils", Paths: []string{"/usr/bin/cat"}}
+	pkg.Mock.Config = config
+	key, err := cacheKey(pkg, hostPlatform(), nil)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	same, err := cacheKey(pkg, hostPlatform(), nil)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if key != same {
+		t.Fatalf("cacheKey is not stable")
+	}
+	if err := ioutil.WriteFile(config, []byte("config_opts['root'] = 'b'"), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+	changed, err := cacheKey(pkg, hostPlatform(), nil)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if key == changed {
+		t.Fatalf("cacheKey didn't change with the mock config contents")
+	}
+	pkg.Excludes = []string{"/usr/bin/ls"}
+	excluded, err := cacheKey(pkg, hostPlatform(), nil)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if excluded == changed {
+		t.Fatalf("cacheKey didn't change with the excludes")
+	}
+}
+
+func TestCachedInstall(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smith-test-")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+	defer os.Setenv(cacheDirEnv, os.Getenv(cacheDirEnv))
+	os.Setenv(cacheDirEnv, filepath.Join(dir, "cache"))
+
+	installs := 0
+	install := func(outputDir string) func() ([]string, error) {
+		return func() ([]string, error) {
+			installs++
+			if err := os.MkdirAll(filepath.Join(outputDir, "bin"), 0755); err != nil {
+				return nil, err
+			}
+			if err := ioutil.WriteFile(filepath.Join(outputDir, "bin", "tool"), []byte("tool"), 0755); err != nil {
+				return nil, err
+			}
+			return []string{"a-1.0", "b-2.0"}, os.Symlink("bin/tool", filepath.Join(outputDir, "tool"))
+		}
+	}
+	buildOpts := &buildOptions{cacheSize: defaultCacheSize}
+	for i, outputDir := range []string{filepath.Join(dir, "out1"), filepath.Join(dir, "out2")} {
+		entry := &cacheEntry{Type: "mock", Package: "tool"}
+		packages, err := cachedInstall(buildOpts, strings.Repeat("a", 64), outputDir, entry, install(outputDir))
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if strings.Join(packages, " ") != "a-1.0 b-2.0" {
+			t.Fatalf("Install %d returned packages %v", i, packages)
+		}
+		info, err := os.Stat(filepath.Join(outputDir, "bin", "tool"))
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if info.Mode().Perm() != 0755 {
+			t.Fatalf("Install %d has mode %v for tool", i, info.Mode())
+		}
+		if link, err := os.Readlink(filepath.Join(outputDir, "tool")); err != nil || link != "bin/tool" {
+			t.Fatalf("Install %d has wrong symlink %q: %v", i, link, err)
+		}
+	}
+	if installs != 1 {
+		t.Fatalf("Install ran %d times, expected the second to be cached", installs)
+	}
+
+	entries, err := cacheEntries()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	// the tool and the package list
+	if len(entries) != 1 || entries[0].Size != int64(len("tool")+len("a-1.0\nb-2.0")) {
+		t.Fatalf("Unexpected cache entries %+v", entries)
+	}
+	removed, err := pruneCache(0)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(removed) != 1 {
+		t.Fatalf("pruneCache removed %d entries", len(removed))
+	}
+	if entries, _ := cacheEntries(); len(entries) != 0 {
+		t.Fatalf("Cache still has %d entries after pruning", len(entries))
+	}
+}
+
+func TestMockCacheKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smith-test-")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+	repomd := filepath.Join(dir, "repo", "x86_64", "repodata", "repomd.xml")
+	repos := "config_opts['dnf.conf'] = \"\"\"\n[main]\nkeepcache=1\n\n" +
+		"[base]\nbaseurl=file://" + dir + "/repo/$basearch\n\n" +
+		"[updates]\nmetalink=https://example.com/metalink\nenabled=0\n\"\"\"\n"
+	writeTestFiles(t, dir, map[string]string{
+		"repos.tpl":                       repos,
+		"mock.cfg":                        "include('" + filepath.Join(dir, "repos.tpl") + "')\nconfig_opts['target_arch'] = 'x86_64'\n",
+		"repo/x86_64/repodata/repomd.xml": "<repomd>1</repomd>",
+	})
+	pkg := &ConfigDef{Type: "mock", Package: "coreutils"}
+	pkg.Mock.Config = filepath.Join(dir, "mock.cfg")
+	key, err := cacheKey(pkg, hostPlatform(), nil)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := ioutil.WriteFile(repomd, []byte("<repomd>2</repomd>"), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+	changed, err := cacheKey(pkg, hostPlatform(), nil)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if key == changed {
+		t.Fatalf("cacheKey didn't change with the repo metadata")
+	}
+
+	// repos that need a mirror to find their metadata can't be cached
+	enabled := strings.Replace(repos, "enabled=0", "enabled=1", 1)
+	if err := ioutil.WriteFile(filepath.Join(dir, "repos.tpl"), []byte(enabled), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, err := cacheKey(pkg, hostPlatform(), nil); err == nil || !strings.Contains(err.Error(), "updates") {
+		t.Fatalf("Expected an error for the metalink repo, got %v", err)
+	}
+}
@@ -1,25 +1,69 @@
 package main
 
 import (
+	"fmt"
 	"io/ioutil"
+	"os"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/ghodss/yaml"
 )
 
 type MockDef struct {
-	Config     string   `json:"config,omitempty"`
-	PreBuild   string   `json:"pre-build,omitempty"`
-	PostBuild  string   `json:"post-build,omitempty"`
-	Deps       []string `json:"deps,omitempty"`
-	DebugInfo  bool     `json:"debuginfo,omitempty"`
-	DebugDeps  []string `json:"debugdeps,omitempty"`
-	DebugPaths []string `json:"debugpaths,omitempty"`
+	Config     string            `json:"config,omitempty"`
+	Configs    map[string]string `json:"configs,omitempty"` // per platform configs
+	PreBuild   string            `json:"pre-build,omitempty"`
+	PostBuild  string            `json:"post-build,omitempty"`
+	Deps       []string          `json:"deps,omitempty"`
+	DebugInfo  bool              `json:"debuginfo,omitempty"`
+	DebugDeps  []string          `json:"debugdeps,omitempty"`
+	DebugPaths []string          `json:"debugpaths,omitempty"`
+}
+
+// NativeDef configures the native package types, which install packages
+// without the package manager. Packages are local package files or names
+// found in the local repos.
+type NativeDef struct {
+	Repos   []string `json:"repos,omitempty"` // dirs containing the repo index
+	Deps    []string `json:"deps,omitempty"`
+	Scripts bool     `json:"scripts,omitempty"` // run install scripts
+}
+
+// StaticDef configures the static type, which copies static binaries built
+// on the host into an image without any package manager.
+type StaticDef struct {
+	Binaries []string `json:"binaries,omitempty"` // src[:dest], dest defaults to /usr/bin/<name>
+	Certs    bool     `json:"certs,omitempty"`    // copy the ca certificates of the host
+	Tzdata   bool     `json:"tzdata,omitempty"`   // copy the timezone data of the host
+}
+
+// LayerDef is a group of paths that is packed into its own layer. The
+// layers named package and overlay hold the files that aren't in any group.
+type LayerDef struct {
+	Name  string   `json:"name"`
+	Paths []string `json:"paths,omitempty"`
+}
+
+// ImageDef is one of several images built from a single package install.
+// Its paths and excludes are added to the ones of the config and the other
+// fields replace them.
+type ImageDef struct {
+	Name       string   `json:"name"`
+	Output     string   `json:"output,omitempty"` // defaults to name.tar.gz
+	Paths      []string `json:"paths,omitempty"`
+	Excludes   []string `json:"excludes,omitempty"`
+	Entrypoint []string `json:"entrypoint,omitempty"`
+	Cmd        []string `json:"cmd,omitempty"`
+	User       string   `json:"user,omitempty"`
 }
 
 type ConfigDef struct {
 	Type       string              `json:"type,omitempty"` //defaults to "mock"
 	Mock       MockDef             `json:"mock,omitempty"`
+	Rpm        NativeDef           `json:"rpm,omitempty"`
+	Deb        NativeDef           `json:"deb,omitempty"`
+	Apk        NativeDef           `json:"apk,omitempty"`
+	Static     StaticDef           `json:"static,omitempty"`
 	Package    string              `json:"package,omitempty"`
 	Paths      []string            `json:"paths,omitempty"`
 	Excludes   []string            `json:"excludes,omitempty"`
@@ -35,28 +79,39 @@ type ConfigDef struct {
 	Env        []string            `json:"env,omitempty"`
 	Labels     map[string]string   `json:"labels,omitempty"`
 	Ports      map[string]struct{} `json:"ports,omitempty"`
+	Platform   string              `json:"platform,omitempty"`  // defaults to host
+	Platforms  []string            `json:"platforms,omitempty"` // defaults to host
+	Layers     []LayerDef          `json:"layers,omitempty"`    // defaults to one layer
+	Values     map[string]string   `json:"values,omitempty"`    // used by templates
+	Images     []ImageDef          `json:"images,omitempty"`    // defaults to one image
+	Extends    string              `json:"extends,omitempty"`   // base config
+	Include    []string            `json:"include,omitempty"`   // merged before this file
 }
 
+// ReadConfig reads and validates the config at path for the project in the
+// current directory. Unknown fields are errors so typos don't silently
+// produce a broken image.
 func ReadConfig(path string) (*ConfigDef, error) {
-	ydef, err := ioutil.ReadFile(path)
-	if err != nil {
-		logrus.Errorf("Failed to read %v: %v", path, err)
-		return nil, err
+	def, errs := loadConfig(path, ".")
+	for _, err := range errs {
+		logrus.Errorf("%s", formatConfigError(path, err))
 	}
-	var def ConfigDef
-	err = yaml.Unmarshal(ydef, &def)
-	if err != nil {
-		logrus.Errorf("Failed to unmarshall %v: %v", path, err)
-		return nil, err
+	if len(errs) != 0 {
+		return nil, fmt.Errorf("%s has %d errors", path, len(errs))
 	}
-	return &def, nil
+	return def, nil
 }
 
+// WriteConfig writes the normalized config to path, or stdout if path is -.
 func (n *ConfigDef) WriteConfig(path string) error {
 	data, err := yaml.Marshal(n)
 	if err != nil {
 		return err
 	}
+	if path == "-" {
+		_, err := os.Stdout.Write(data)
+		return err
+	}
 	logrus.Debugf("Writing normalized config to %v", path)
 	return ioutil.WriteFile(path, data, 0644)
 }
@@ -26,6 +26,7 @@ func CopyTree(baseDir, outputDir string, globs []string, excludes []string, nss,
 	if chroot == true {
 		chrootDir = baseDir
 	}
+	SetMuslPaths(chrootDir)
 
 	exs := map[string]struct{}{}
 	for _, glob := range excludes {
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/oracle/smith/execute"
+)
+
+const (
+	dockerHubHost  = "registry-1.docker.io"
+	dockerHubIndex = "https://index.docker.io/v1/"
+	userEnv        = "SMITH_REGISTRY_USER"
+	passwordEnv    = "SMITH_REGISTRY_PASSWORD"
+)
+
+// dockerAuth is an entry in the auths section of a docker config.json.
+type dockerAuth struct {
+	Auth          string `json:"auth,omitempty"`
+	Username      string `json:"username,omitempty"`
+	Password      string `json:"password,omitempty"`
+	IdentityToken string `json:"identitytoken,omitempty"`
+}
+
+// dockerConfig holds the credential related parts of a docker config.json.
+// The raw contents are kept so unrelated settings survive a rewrite.
+type dockerConfig struct {
+	path        string
+	raw         map[string]json.RawMessage
+	Auths       map[string]dockerAuth
+	CredHelpers map[string]string
+	CredsStore  string
+}
+
+// helperCredentials is the json format used by docker-credential-* helpers.
+type helperCredentials struct {
+	ServerURL string `json:"ServerURL,omitempty"`
+	Username  string `json:"Username"`
+	Secret    string `json:"Secret"`
+}
+
+// dockerConfigPath returns the location of the docker config.json, honoring
+// the DOCKER_CONFIG environment variable.
+func dockerConfigPath() string {
+	dir := os.Getenv("DOCKER_CONFIG")
+	if dir == "" {
+		dir = filepath.Join(os.Getenv("HOME"), ".docker")
+	}
+	return filepath.Join(dir, "config.json")
+}
+
+// readDockerConfig reads the docker config.json at path. A missing file
+// results in an empty config.
+func readDockerConfig(path string) (*dockerConfig, error) {
+	conf := &dockerConfig{
+		path:        path,
+		raw:         map[string]json.RawMessage{},
+		Auths:       map[string]dockerAuth{},
+		CredHelpers: map[string]string{},
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return conf, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &conf.raw); err != nil {
+		return nil, fmt.Errorf("error unmarshaling %s: %v", path, err)
+	}
+	if val, ok := conf.raw["auths"]; ok {
+		if err := json.Unmarshal(val, &conf.Auths); err != nil {
+			return nil, fmt.Errorf("error unmarshaling auths in %s: %v", path, err)
+		}
+	}
+	if val, ok := conf.raw["credHelpers"]; ok {
+		if err := json.Unmarshal(val, &conf.CredHelpers); err != nil {
+			return nil, fmt.Errorf("error unmarshaling credHelpers in %s: %v", path, err)
+		}
+	}
+	if val, ok := conf.raw["credsStore"]; ok {
+		if err := json.Unmarshal(val, &conf.CredsStore); err != nil {
+			return nil, fmt.Errorf("error unmarshaling credsStore in %s: %v", path, err)
+		}
+	}
+	return conf, nil
+}
+
+// write saves the config, preserving any settings smith doesn't know about.
+func (c *dockerConfig) write() error {
+	auths, err := json.Marshal(c.Auths)
+	if err != nil {
+		return err
+	}
+	c.raw["auths"] = auths
+	data, err := json.MarshalIndent(c.raw, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0700); err != nil {
+		return err
+	}
+	logrus.Debugf("Writing credentials to %v", c.path)
+	return ioutil.WriteFile(c.path, data, 0600)
+}
+
+// registryKey returns the key docker uses for a registry host in config.json.
+func registryKey(host string) string {
+	if host == dockerHubHost {
+		return dockerHubIndex
+	}
+	return host
+}
+
+// normalizeRegistry strips the scheme and path from a config.json key so it
+// can be compared with a host.
+func normalizeRegistry(key string) string {
+	if key == dockerHubIndex {
+		return dockerHubHost
+	}
+	key = strings.TrimPrefix(key, "https://")
+	key = strings.TrimPrefix(key, "http://")
+	if i := strings.Index(key, "/"); i != -1 {
+		key = key[:i]
+	}
+	if key == "index.docker.io" || key == "docker.io" {
+		return dockerHubHost
+	}
+	return key
+}
+
+// helper returns the name of the credential helper for host if there is one.
+func (c *dockerConfig) helper(host string) string {
+	for key, helper := range c.CredHelpers {
+		if normalizeRegistry(key) == host {
+			return helper
+		}
+	}
+	return c.CredsStore
+}
+
+// lookup returns the username and password stored for host.
+func (c *dockerConfig) lookup(host string) (string, string, error) {
+	if helper := c.helper(host); helper != "" {
+		creds, err := helperGet(helper, registryKey(host))
+		if err != nil {
+			return "", "", err
+		}
+		if creds != nil {
+			return creds.Username, creds.Secret, nil
+		}
+	}
+	for key, auth := range c.Auths {
+		if normalizeRegistry(key) != host {
+			continue
+		}
+		if auth.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+			if err != nil {
+				return "", "", fmt.Errorf("invalid auth for %s in %s", key, c.path)
+			}
+			parts := strings.SplitN(string(decoded), ":", 2)
+			if len(parts) != 2 {
+				return "", "", fmt.Errorf("invalid auth for %s in %s", key, c.path)
+			}
+			return parts[0], parts[1], nil
+		}
+		return auth.Username, auth.Password, nil
+	}
+	return "", "", nil
+}
+
+// store saves the username and password for host in the credential helper
+// if one is configured or in the auths section otherwise.
+func (c *dockerConfig) store(host, username, password string) error {
+	if helper := c.helper(host); helper != "" {
+		creds := helperCredentials{registryKey(host), username, password}
+		return helperStore(helper, &creds)
+	}
+	c.Auths[registryKey(host)] = dockerAuth{
+		Auth: base64.StdEncoding.EncodeToString([]byte(username + ":" + password)),
+	}
+	return c.write()
+}
+
+// erase removes the credentials for host.
+func (c *dockerConfig) erase(host string) error {
+	if helper := c.helper(host); helper != "" {
+		if err := helperErase(helper, registryKey(host)); err != nil {
+			return err
+		}
+	}
+	for key := range c.Auths {
+		if normalizeRegistry(key) == host {
+			delete(c.Auths, key)
+		}
+	}
+	return c.write()
+}
+
+// runHelper executes docker-credential-<helper> with the action and passes
+// input on stdin.
+func runHelper(helper, action string, input []byte) ([]byte, error) {
+	name := "docker-credential-" + helper
+	cmd := exec.Command(name, action)
+	cmd.Stdin = bytes.NewReader(input)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	logrus.Debugf("Running %s %s", name, action)
+	if err := cmd.Run(); err != nil {
+		// helpers report errors like missing credentials on stdout
+		msg := strings.TrimSpace(stdout.String() + stderr.String())
+		return nil, fmt.Errorf("%s %s failed: %v: %s", name, action, err, msg)
+	}
+	return stdout.Bytes(), nil
+}
+
+// helperGet retrieves credentials for serverURL from a helper. It returns
+// nil if the helper has no credentials for the server.
+func helperGet(helper, serverURL string) (*helperCredentials, error) {
+	out, err := runHelper(helper, "get", []byte(serverURL))
+	if err != nil {
+		if strings.Contains(err.Error(), "credentials not found") {
+			return nil, nil
+		}
+		return nil, err
+	}
+	creds := helperCredentials{}
+	if err := json.Unmarshal(out, &creds); err != nil {
+		return nil, fmt.Errorf("invalid output from credential helper %s: %v", helper, err)
+	}
+	return &creds, nil
+}
+
+func helperStore(helper string, creds *helperCredentials) error {
+	input, err := json.Marshal(creds)
+	if err != nil {
+		return err
+	}
+	_, err = runHelper(helper, "store", input)
+	return err
+}
+
+func helperErase(helper, serverURL string) error {
+	_, err := runHelper(helper, "erase", []byte(serverURL))
+	return err
+}
+
+// setCredentials fills in the username and password of info if they weren't
+// given in the url. Environment variables are checked first and then the
+// docker config.json and its credential helpers. The lookup is done the first
+// time the registry asks for credentials.
+func setCredentials(info *RepoInfo) {
+	if info.credentialsSet || info.Username != "" {
+		return
+	}
+	info.credentialsSet = true
+	if user := os.Getenv(userEnv); user != "" {
+		info.Username = user
+		info.Password = os.Getenv(passwordEnv)
+		return
+	}
+	conf, err := readDockerConfig(dockerConfigPath())
+	if err != nil {
+		logrus.Warnf("Failed to read docker config: %v", err)
+		return
+	}
+	username, password, err := conf.lookup(info.Host)
+	if err != nil {
+		logrus.Warnf("Failed to lookup credentials for %s: %v", info.Host, err)
+		return
+	}
+	if username != "" {
+		logrus.Debugf("Using stored credentials for %s", info.Host)
+		info.Username = username
+		info.Password = password
+	}
+}
+
+// readPassword reads a single line password from stdin.
+func readPassword() (string, error) {
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func loginRegistry(remote, username string, passwordStdin, insecure bool) bool {
+	info, err := parseRepoInfo(remote, false)
+	if err != nil {
+		logrus.Errorf("Failed to parse registry: %v", err)
+		return false
+	}
+	if username == "" {
+		username = info.Username
+	}
+	password := info.Password
+	if passwordStdin {
+		password, err = readPassword()
+		if err != nil {
+			logrus.Errorf("Failed to read password from stdin: %v", err)
+			return false
+		}
+	} else if password == "" && username != "" && execute.IsTerminal(os.Stdin.Fd()) {
+		fmt.Fprint(os.Stderr, "Password: ")
+		password, err = execute.ReadPassword(os.Stdin.Fd())
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			logrus.Errorf("Failed to read password: %v", err)
+			return false
+		}
+	}
+	if username == "" || password == "" {
+		logrus.Errorf("Username and password must be specified")
+		return false
+	}
+	info.Username = username
+	info.Password = password
+	if err := NewRegistryClient(insecure).CheckLogin(info); err != nil {
+		logrus.Errorf("Failed to login to %s: %v", info.Host, err)
+		return false
+	}
+	conf, err := readDockerConfig(dockerConfigPath())
+	if err != nil {
+		logrus.Errorf("Failed to read docker config: %v", err)
+		return false
+	}
+	if err := conf.store(info.Host, username, password); err != nil {
+		logrus.Errorf("Failed to store credentials: %v", err)
+		return false
+	}
+	logrus.Infof("Login to %s succeeded", info.Host)
+	return true
+}
+
+func logoutRegistry(remote string) bool {
+	info, err := parseRepoInfo(remote, false)
+	if err != nil {
+		logrus.Errorf("Failed to parse registry: %v", err)
+		return false
+	}
+	conf, err := readDockerConfig(dockerConfigPath())
+	if err != nil {
+		logrus.Errorf("Failed to read docker config: %v", err)
+		return false
+	}
+	if err := conf.erase(info.Host); err != nil {
+		logrus.Errorf("Failed to remove credentials: %v", err)
+		return false
+	}
+	logrus.Infof("Removed credentials for %s", info.Host)
+	return true
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNormalizeRegistry(t *testing.T) {
+	tests := []struct {
+		key  string
+		host string
+	}{
+		{"https://index.docker.io/v1/", "registry-1.docker.io"},
+		{"docker.io", "registry-1.docker.io"},
+		{"myregistry.com", "myregistry.com"},
+		{"https://myregistry.com:5000/v2/", "myregistry.com:5000"},
+		{"http://localhost:5000", "localhost:5000"},
+	}
+	for _, test := range tests {
+		if host := normalizeRegistry(test.key); host != test.host {
+			t.Errorf("normalizeRegistry(%q) = %q, expected %q", test.key, host, test.host)
+		}
+	}
+}
+
+func TestDockerConfigAuths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smith-creds-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.json")
+	data := `{"auths": {"https://myregistry.com/v1/": {"auth": "dXNlcjpwYXNzOndvcmQ="}}, "detachKeys": "ctrl-x"}`
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	conf, err := readDockerConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, pass, err := conf.lookup("myregistry.com")
+	if err != nil || user != "user" || pass != "pass:word" {
+		t.Fatalf("lookup returned %q %q %v", user, pass, err)
+	}
+	if err := conf.store(dockerHubHost, "hub", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if err := conf.erase("myregistry.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	conf, err = readDockerConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := conf.Auths[dockerHubIndex]; !ok {
+		t.Errorf("credentials for docker hub not stored under %s", dockerHubIndex)
+	}
+	if user, _, _ := conf.lookup("myregistry.com"); user != "" {
+		t.Errorf("credentials for myregistry.com not erased")
+	}
+	if string(conf.raw["detachKeys"]) != `"ctrl-x"` {
+		t.Errorf("unrelated settings were not preserved")
+	}
+}
+
+func TestCredentialHelper(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smith-creds-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	script := "#!/bin/sh\nread server\n" +
+		"if [ \"$server\" = myregistry.com ]; then\n" +
+		"echo '{\"ServerURL\":\"myregistry.com\",\"Username\":\"helper\",\"Secret\":\"s3cret\"}'\n" +
+		"else echo 'credentials not found in native keychain'; exit 1; fi\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "docker-credential-fake"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	conf := &dockerConfig{
+		Auths:       map[string]dockerAuth{},
+		CredHelpers: map[string]string{"myregistry.com": "fake"},
+	}
+	user, pass, err := conf.lookup("myregistry.com")
+	if err != nil || user != "helper" || pass != "s3cret" {
+		t.Fatalf("lookup returned %q %q %v", user, pass, err)
+	}
+	conf.CredsStore = "fake"
+	user, _, err = conf.lookup("other.com")
+	if err != nil || user != "" {
+		t.Fatalf("lookup of missing credentials returned %q %v", user, err)
+	}
+}
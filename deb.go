@@ -0,0 +1,417 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	arMagic        = "!<arch>\n"
+	arHeaderSize   = 60
+	debControl     = "control.tar"
+	debData        = "data.tar"
+	debControlFile = "./control"
+)
+
+// debIndexes are the names of the index of a flat apt repo in order of
+// preference.
+var debIndexes = []string{"Packages", "Packages.gz", "Packages.xz"}
+
+// readAr calls fn for each member of the ar archive in r.
+func readAr(r io.Reader, fn func(name string, r io.Reader) error) error {
+	magic := make([]byte, len(arMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return err
+	}
+	if string(magic) != arMagic {
+		return fmt.Errorf("not an ar archive")
+	}
+	header := make([]byte, arHeaderSize)
+	for {
+		if _, err := io.ReadFull(r, header); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		name := strings.TrimRight(strings.TrimSpace(string(header[:16])), "/")
+		size, err := strconv.ParseInt(strings.TrimSpace(string(header[48:58])), 10, 64)
+		if err != nil {
+			return fmt.Errorf("bad ar header for %s: %v", name, err)
+		}
+		member := io.LimitReader(r, size)
+		if err := fn(name, member); err != nil {
+			return err
+		}
+		// skip the rest of the member and its padding
+		if _, err := io.Copy(ioutil.Discard, member); err != nil {
+			return err
+		}
+		if size%2 != 0 {
+			if _, err := io.CopyN(ioutil.Discard, r, 1); err != nil && err != io.EOF {
+				return err
+			}
+		}
+	}
+}
+
+// arMemberFormat returns the compression of a member like data.tar.xz.
+func arMemberFormat(name, prefix string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(name, prefix), ".")
+}
+
+// parseControl parses the stanzas of a debian control file.
+func parseControl(r io.Reader) ([]map[string]string, error) {
+	stanzas := []map[string]string{}
+	stanza := map[string]string{}
+	key := ""
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.TrimSpace(line) == "":
+			if len(stanza) != 0 {
+				stanzas = append(stanzas, stanza)
+				stanza = map[string]string{}
+			}
+		case line[0] == ' ' || line[0] == '\t':
+			if key != "" {
+				stanza[key] += "\n" + strings.TrimSpace(line)
+			}
+		default:
+			i := strings.Index(line, ":")
+			if i == -1 {
+				return nil, fmt.Errorf("bad control line %q", line)
+			}
+			key = line[:i]
+			stanza[key] = strings.TrimSpace(line[i+1:])
+		}
+	}
+	if len(stanza) != 0 {
+		stanzas = append(stanzas, stanza)
+	}
+	return stanzas, scanner.Err()
+}
+
+// parseDebDeps parses a comma separated list of dependencies with
+// alternatives separated by |. Arch qualifiers, arch restrictions and build
+// profiles are ignored.
+func parseDebDeps(s string) [][]pkgDep {
+	ops := map[string]string{"<<": "<", "<=": "<=", "=": "=", ">=": ">=", ">>": ">", "<": "<=", ">": ">="}
+	deps := [][]pkgDep{}
+	for _, group := range strings.Split(s, ",") {
+		alts := []pkgDep{}
+		for _, alt := range strings.Split(group, "|") {
+			constraint := ""
+			if i := strings.Index(alt, "("); i != -1 {
+				constraint = alt[i+1:]
+				if j := strings.Index(constraint, ")"); j != -1 {
+					constraint = constraint[:j]
+				}
+				alt = alt[:i]
+			}
+			if i := strings.IndexAny(alt, "[<"); i != -1 {
+				alt = alt[:i]
+			}
+			alt = strings.TrimSpace(alt)
+			if alt == "" {
+				continue
+			}
+			dep := pkgDep{}
+			if constraint = strings.TrimSpace(constraint); constraint != "" {
+				fields := strings.Fields(constraint)
+				if len(fields) == 1 {
+					// no space between the operator and version
+					j := strings.IndexFunc(constraint, func(r rune) bool { return !strings.ContainsRune("<=>", r) })
+					if j > 0 {
+						fields = []string{constraint[:j], constraint[j:]}
+					}
+				}
+				if len(fields) == 2 {
+					dep.Op, dep.Version = ops[fields[0]], fields[1]
+				}
+			}
+			dep.Name = strings.SplitN(alt, ":", 2)[0]
+			alts = append(alts, dep)
+		}
+		if len(alts) != 0 {
+			deps = append(deps, alts)
+		}
+	}
+	return deps
+}
+
+// debInfo describes the package with the control fields at path.
+func debInfo(fields map[string]string, path string) *pkgInfo {
+	p := &pkgInfo{
+		Name:    fields["Package"],
+		Version: fields["Version"],
+		Arch:    fields["Architecture"],
+		Path:    path,
+	}
+	p.ID = p.Name + "_" + p.Version + "_" + p.Arch
+	for _, alts := range parseDebDeps(fields["Provides"]) {
+		p.Provides = append(p.Provides, alts...)
+	}
+	p.Requires = append(parseDebDeps(fields["Pre-Depends"]), parseDebDeps(fields["Depends"])...)
+	return p
+}
+
+// debArch returns the debian arch names usable on platform in order of
+// preference.
+func debArch(platform v1.Platform) []string {
+	arch := map[string]string{
+		"arm":     "armhf",
+		"386":     "i386",
+		"ppc64le": "ppc64el",
+	}[platform.Architecture]
+	if arch == "" {
+		arch = platform.Architecture
+	}
+	return []string{arch, "all"}
+}
+
+// debvercmp compares a debian upstream version or revision the way dpkg
+// does. Letters sort before other characters, ~ before everything and
+// runs of digits compare numerically.
+func debvercmp(a, b string) int {
+	isDigit := func(c byte) bool { return c >= '0' && c <= '9' }
+	order := func(s string) int {
+		switch {
+		case len(s) == 0 || isDigit(s[0]):
+			return 0
+		case s[0] >= 'a' && s[0] <= 'z' || s[0] >= 'A' && s[0] <= 'Z':
+			return int(s[0])
+		case s[0] == '~':
+			return -1
+		}
+		return int(s[0]) + 256
+	}
+	for len(a) != 0 || len(b) != 0 {
+		for (len(a) != 0 && !isDigit(a[0])) || (len(b) != 0 && !isDigit(b[0])) {
+			if c := order(a) - order(b); c != 0 {
+				return c
+			}
+			if len(a) != 0 {
+				a = a[1:]
+			}
+			if len(b) != 0 {
+				b = b[1:]
+			}
+		}
+		a = strings.TrimLeft(a, "0")
+		b = strings.TrimLeft(b, "0")
+		diff := 0
+		for len(a) != 0 && isDigit(a[0]) && len(b) != 0 && isDigit(b[0]) {
+			if diff == 0 {
+				diff = int(a[0]) - int(b[0])
+			}
+			a, b = a[1:], b[1:]
+		}
+		if len(a) != 0 && isDigit(a[0]) {
+			return 1
+		}
+		if len(b) != 0 && isDigit(b[0]) {
+			return -1
+		}
+		if diff != 0 {
+			return diff
+		}
+	}
+	return 0
+}
+
+// compareDebVersions compares two [epoch:]upstream[-revision] versions.
+func compareDebVersions(a, b string) int {
+	split := func(v string) (int, string, string) {
+		epoch := 0
+		if i := strings.Index(v, ":"); i != -1 {
+			epoch, _ = strconv.Atoi(v[:i])
+			v = v[i+1:]
+		}
+		revision := ""
+		if i := strings.LastIndex(v, "-"); i != -1 {
+			v, revision = v[:i], v[i+1:]
+		}
+		return epoch, v, revision
+	}
+	ea, ua, ra := split(a)
+	eb, ub, rb := split(b)
+	if ea != eb {
+		if ea > eb {
+			return 1
+		}
+		return -1
+	}
+	if c := debvercmp(ua, ub); c != 0 {
+		return c
+	}
+	return debvercmp(ra, rb)
+}
+
+// readDebControl reads the control files of the control.tar member in r.
+func readDebControl(r io.Reader, format string) (map[string][]byte, error) {
+	dr, err := decompressReader(r, format)
+	if err != nil {
+		return nil, err
+	}
+	defer dr.Close()
+	files := map[string][]byte{}
+	tr := tar.NewReader(dr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		files["./"+strings.TrimPrefix(hdr.Name, "./")] = data
+	}
+}
+
+// debControlInfo parses the control file among the control files of the
+// deb at path.
+func debControlInfo(control map[string][]byte, path string) (*pkgInfo, error) {
+	stanzas, err := parseControl(strings.NewReader(string(control[debControlFile])))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if len(stanzas) == 0 {
+		return nil, fmt.Errorf("%s has no control file", path)
+	}
+	return debInfo(stanzas[0], path), nil
+}
+
+// readDebInfo reads the description of the deb at path.
+func readDebInfo(path string) (*pkgInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var control map[string][]byte
+	err = readAr(bufio.NewReader(f), func(name string, r io.Reader) error {
+		if !strings.HasPrefix(name, debControl) {
+			return nil
+		}
+		control, err = readDebControl(r, arMemberFormat(name, debControl))
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return debControlInfo(control, path)
+}
+
+// debRepoIndex returns the path of the index of the flat apt repo in dir.
+func debRepoIndex(dir string) (string, error) {
+	for _, name := range debIndexes {
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("%s has no Packages index", dir)
+}
+
+// readDebRepo returns the packages in the flat apt repo in dir.
+func readDebRepo(dir string) ([]*pkgInfo, error) {
+	path, err := debRepoIndex(dir)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r, err := decompressReader(f, strings.TrimPrefix(filepath.Ext(path), "."))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	stanzas, err := parseControl(r)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	pkgs := []*pkgInfo{}
+	for _, fields := range stanzas {
+		pkgs = append(pkgs, debInfo(fields, filepath.Join(dir, fields["Filename"])))
+	}
+	return pkgs, nil
+}
+
+// installDeb extracts the data of the deb at path into the tree of t and
+// runs its preinst and postinst scripts if scripts is set. It returns the
+// description of the deb with the files it installed.
+func installDeb(path string, t *treeExtractor, ex executor, scripts bool) (*pkgInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	name := filepath.Base(path)
+	var control map[string][]byte
+	files := []string{}
+	err = readAr(bufio.NewReader(f), func(member string, r io.Reader) error {
+		switch {
+		case strings.HasPrefix(member, debControl):
+			control, err = readDebControl(r, arMemberFormat(member, debControl))
+			if err != nil || !scripts {
+				return err
+			}
+			return runDebScript(t.root, ex, name, control, "preinst", "install")
+		case strings.HasPrefix(member, debData):
+			dr, err := decompressReader(r, arMemberFormat(member, debData))
+			if err != nil {
+				return err
+			}
+			files, err = extractTar(dr, t)
+			if cerr := dr.Close(); err == nil {
+				err = cerr
+			}
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	if scripts {
+		if err := runDebScript(t.root, ex, name, control, "postinst", "configure"); err != nil {
+			return nil, err
+		}
+	}
+	info, err := debControlInfo(control, path)
+	if err != nil {
+		return nil, err
+	}
+	info.Files = files
+	return info, nil
+}
+
+// runDebScript runs a maintainer script of a deb if it has one.
+func runDebScript(root string, ex executor, name string, control map[string][]byte, script string, arg ...string) error {
+	data, ok := control["./"+script]
+	if !ok {
+		return nil
+	}
+	return runScript(root, ex, name, nil, string(data), arg...)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestCompareDebVersions(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		expected int
+	}{
+		{"1.0", "1.0", 0},
+		{"1.0", "2.0", -1},
+		{"1.10", "1.9", 1},
+		{"1.0~rc1", "1.0", -1},
+		{"1.0~~", "1.0~", -1},
+		{"1.0a", "1.0", 1},
+		{"1.0a", "1.0+", -1},
+		{"1:0.9", "1.0", 1},
+		{"1.0-2", "1.0-10", -1},
+		{"1.0-1ubuntu1", "1.0-1", 1},
+		{"001", "1", 0},
+	}
+	for _, test := range tests {
+		got := compareDebVersions(test.a, test.b)
+		if got > 0 {
+			got = 1
+		} else if got < 0 {
+			got = -1
+		}
+		if got != test.expected {
+			t.Errorf("compareDebVersions(%q, %q) = %d, expected %d", test.a, test.b, got, test.expected)
+		}
+	}
+}
+
+func TestParseDebDeps(t *testing.T) {
+	deps := parseDebDeps("libc6 (>= 2.14), foo:any | bar (<<1.0) [amd64], baz <!nocheck>")
+	expected := [][]pkgDep{
+		{{Name: "libc6", Op: ">=", Version: "2.14"}},
+		{{Name: "foo"}, {Name: "bar", Op: "<", Version: "1.0"}},
+		{{Name: "baz"}},
+	}
+	if !reflect.DeepEqual(deps, expected) {
+		t.Fatalf("Parsed %v, expected %v", deps, expected)
+	}
+}
+
+// testTarGz returns a gzipped tar with the given regular files. Content
+// starting with @ makes a symlink and = a hard link to the rest of the
+// content, and names ending in / are directories. The tar is only terminated
+// if terminate is set, since the control tars of an apk aren't.
+func testTarGz(files map[string]string, terminate bool) []byte {
+	names := []string{}
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b bytes.Buffer
+	gz := gzip.NewWriter(&b)
+	tw := tar.NewWriter(gz)
+	for _, name := range names {
+		if strings.HasPrefix(files[name], "@") {
+			tw.WriteHeader(&tar.Header{Name: name, Mode: 0777, Linkname: files[name][1:], Typeflag: tar.TypeSymlink})
+			continue
+		}
+		if strings.HasSuffix(name, "/") {
+			tw.WriteHeader(&tar.Header{Name: name, Mode: 0755, Typeflag: tar.TypeDir})
+			continue
+		}
+		if strings.HasPrefix(files[name], "=") {
+			tw.WriteHeader(&tar.Header{Name: name, Mode: 0755, Linkname: files[name][1:], Typeflag: tar.TypeLink})
+			continue
+		}
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0755, Size: int64(len(files[name])), Typeflag: tar.TypeReg})
+		tw.Write([]byte(files[name]))
+	}
+	if terminate {
+		tw.Close()
+	} else {
+		tw.Flush()
+	}
+	gz.Close()
+	return b.Bytes()
+}
+
+// writeTestDeb writes a deb with the given control and files to path.
+func writeTestDeb(t *testing.T, path, control string, files map[string]string) {
+	var b bytes.Buffer
+	b.WriteString(arMagic)
+	add := func(name string, data []byte) {
+		fmt.Fprintf(&b, "%-16s%-12d%-6d%-6d%-8o%-10d`\n", name, 0, 0, 0, 0644, len(data))
+		b.Write(data)
+		if len(data)%2 != 0 {
+			b.WriteByte('\n')
+		}
+	}
+	add("debian-binary", []byte("2.0\n"))
+	add("control.tar.gz", testTarGz(map[string]string{"./control": control}, true))
+	add("data.tar.gz", testTarGz(files, true))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := ioutil.WriteFile(path, b.Bytes(), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+}
+
+func TestBuildDeb(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smith-test-")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo := filepath.Join(dir, "repo")
+	libControl := "Package: lib\nVersion: 1.0-1\nArchitecture: all\nProvides: libtest\n"
+	writeTestDeb(t, filepath.Join(repo, "lib_1.0-1_all.deb"), libControl,
+		map[string]string{"./usr/lib/libtest.txt": "lib"})
+	index := libControl + "Filename: lib_1.0-1_all.deb\n\n"
+	if err := ioutil.WriteFile(filepath.Join(repo, "Packages"), []byte(index), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+	app := filepath.Join(dir, "app_1.0-1_all.deb")
+	writeTestDeb(t, app, "Package: app\nVersion: 1.0-1\nArchitecture: all\nDepends: libtest\nDescription: test\n more\n",
+		map[string]string{"./usr/bin/app": "app"})
+
+	pkg := &ConfigDef{
+		Type:    "deb",
+		Package: app,
+		Paths:   []string{"/usr/bin/app", "/usr/lib/libtest.txt"},
+		Deb:     NativeDef{Repos: []string{repo}},
+	}
+	outputDir := filepath.Join(dir, "out")
+	packages, err := buildNative(&buildOptions{}, outputDir, pkg, hostPlatform())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if expected := []string{"app_1.0-1_all", "lib_1.0-1_all"}; !reflect.DeepEqual(packages, expected) {
+		t.Fatalf("Installed %v, expected %v", packages, expected)
+	}
+	for path, content := range map[string]string{"usr/bin/app": "app", "usr/lib/libtest.txt": "lib"} {
+		data, err := ioutil.ReadFile(filepath.Join(outputDir, path))
+		if err != nil || string(data) != content {
+			t.Fatalf("Unexpected content of %v: %q %v", path, data, err)
+		}
+	}
+
+	// missing dependencies are an error
+	pkg.Deb.Repos = nil
+	if _, err := buildNative(&buildOptions{}, outputDir, pkg, hostPlatform()); err == nil {
+		t.Fatalf("buildNative succeeded with a missing dependency")
+	}
+}
@@ -2,18 +2,26 @@ package main
 
 import (
 	"debug/elf"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/Sirupsen/logrus"
 )
 
 var (
-	soMap        map[string]string
-	preloadPaths []string
+	soMap         map[string][]string
+	preloadPaths  []string
+	muslLibPaths  []string
+	targetMachine elf.Machine
 )
 
+// loaderDirs are the directories the loader searches by default in the order
+// it searches them.
+var loaderDirs = []string{"/lib64", "/usr/lib64", "/lib", "/usr/lib"}
+
 type executor func(name string, arg ...string) (string, string, error)
 
 // SetSoPathsFromExecutor executes ldconfig using the given executor
@@ -24,6 +32,8 @@ func SetSoPathsFromExecutor(ex executor, preload []string) error {
 	stdout, stderr, err := ex("ldconfig", "-v", "-N", "-X", "/")
 	if err != nil {
 		logrus.Warnf("ldconfig failed: %v", strings.TrimSpace(stderr))
+		// clear any paths left over from a previous chroot
+		SetSoPaths("", preload)
 		return nil
 	}
 	SetSoPaths(stdout, preload)
@@ -34,7 +44,7 @@ func SetSoPathsFromExecutor(ex executor, preload []string) error {
 // ldconfig -v -N -X and stores the so paths for later use by Deps
 func SetSoPaths(ldconfigout string, preload []string) {
 	lines := strings.Split(ldconfigout, "\n")
-	soMap = map[string]string{}
+	soMap = map[string][]string{}
 	preloadPaths = preload
 	path := ""
 	for _, line := range lines {
@@ -54,26 +64,106 @@ func SetSoPaths(ldconfigout string, preload []string) {
 		parts := strings.Split(line, "->")
 		if len(parts) > 1 {
 			// we use the source name for the mapping because we want to
-			// keep the symlink around for the loader
+			// keep the symlink around for the loader. All locations are
+			// stored so multilib systems can choose the right machine type
 			source := strings.TrimSpace(parts[0])
-			if _, ok := soMap[source]; !ok {
-				soMap[source] = filepath.Join(path, source)
+			soMap[source] = append(soMap[source], filepath.Join(path, source))
+		}
+	}
+}
+
+// SetSoPathsFromDir stores the paths of the shared libraries below dir for
+// later use by Deps. It replaces ldconfig for trees that were already copied
+// out of a chroot and don't contain ldconfig themselves. Libraries in the
+// default directories of the loader are preferred in its search order.
+func SetSoPathsFromDir(dir string, preload []string) error {
+	soMap = map[string][]string{}
+	preloadPaths = preload
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name := info.Name()
+		if info.IsDir() || !(strings.HasSuffix(name, ".so") || strings.Contains(name, ".so.")) {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		soMap[name] = append(soMap[name], "/"+filepath.ToSlash(rel))
+		return nil
+	})
+	rank := func(path string) int {
+		for i, dir := range loaderDirs {
+			if filepath.Dir(path) == dir {
+				return i
 			}
 		}
+		return len(loaderDirs)
+	}
+	for _, paths := range soMap {
+		sort.SliceStable(paths, func(i, j int) bool {
+			return rank(paths[i]) < rank(paths[j])
+		})
 	}
+	return err
+}
+
+// ResetSoPaths forgets the so paths stored for a previous tree.
+func ResetSoPaths() {
+	soMap = nil
+	preloadPaths = nil
+}
+
+// EnsureSoPaths keeps the so paths that ldconfig found while installing dir
+// and searches dir for them if ldconfig didn't run, like when the install was
+// restored from the cache. The preload paths are searched first either way.
+func EnsureSoPaths(dir string, preload []string) error {
+	if soMap == nil {
+		return SetSoPathsFromDir(dir, preload)
+	}
+	preloadPaths = preload
+	return nil
+}
+
+// SetTargetMachine sets the elf machine type that libraries must match to be
+// returned by FindLibrary. EM_NONE allows libraries of any machine type.
+func SetTargetMachine(machine elf.Machine) {
+	targetMachine = machine
+}
+
+// machineMatches returns false if the file at path is an elf of a different
+// machine type than the target. Files that aren't elfs, like linker scripts,
+// always match.
+func machineMatches(path string) bool {
+	if targetMachine == elf.EM_NONE {
+		return true
+	}
+	elfFile, err := elf.Open(path)
+	if err != nil {
+		return true
+	}
+	defer elfFile.Close()
+	if elfFile.Machine != targetMachine {
+		logrus.Debugf("Rejecting %v with machine type %v", path, elfFile.Machine)
+		return false
+	}
+	return true
 }
 
 func FindLibrary(library, chrootDir string, paths []string) string {
 	for _, path := range paths {
 		full := filepath.Clean(filepath.Join(path, library))
 		if _, err := os.Lstat(filepath.Join(chrootDir, full)); err == nil {
-			return full
+			if machineMatches(filepath.Join(chrootDir, full)) {
+				return full
+			}
 		}
 	}
 
-	if soMap != nil {
-		full := soMap[library]
-		if full != "" {
+	for _, full := range soMap[library] {
+		if machineMatches(filepath.Join(chrootDir, full)) {
 			return full
 		}
 	}
@@ -84,12 +174,44 @@ func FindLibrary(library, chrootDir string, paths []string) string {
 		full := filepath.Clean(filepath.Join(path, library))
 		logrus.Debugf("Checking for %v", full)
 		if _, err := os.Lstat(filepath.Join(chrootDir, full)); err == nil {
-			return full
+			if machineMatches(filepath.Join(chrootDir, full)) {
+				return full
+			}
 		}
 	}
 	return ""
 }
 
+// muslPaths returns the library search path of the musl loader interp in
+// chrootDir. It is read from /etc/ld-musl-ARCH.path and falls back to the
+// default path of musl.
+func muslPaths(chrootDir, interp string) []string {
+	base := filepath.Base(interp)
+	if !strings.HasPrefix(base, "ld-musl-") {
+		return nil
+	}
+	arch := strings.TrimSuffix(strings.TrimPrefix(base, "ld-musl-"), ".so.1")
+	data, err := ioutil.ReadFile(filepath.Join(chrootDir, "/etc/ld-musl-"+arch+".path"))
+	if err != nil {
+		return []string{"/lib", "/usr/local/lib", "/usr/lib"}
+	}
+	return strings.FieldsFunc(string(data), func(r rune) bool {
+		return r == ':' || r == '\n'
+	})
+}
+
+// SetMuslPaths stores the library search path of the musl loader in
+// chrootDir for later use by Deps. It is cleared if chrootDir has no musl
+// loader. Shared libraries have no interpreter of their own, so the path is
+// set once for the whole tree.
+func SetMuslPaths(chrootDir string) {
+	muslLibPaths = nil
+	loaders, _ := filepath.Glob(filepath.Join(chrootDir, "/lib/ld-musl-*.so.1"))
+	if len(loaders) != 0 {
+		muslLibPaths = muslPaths(chrootDir, loaders[0])
+	}
+}
+
 // Deps recursively finds all statically linked dependencies of the executable
 // in path within the given chroot. If nss is true, it also includes the
 // relevant libnss libraries.
@@ -103,6 +225,10 @@ func Deps(chrootDir, path string, nss bool) (map[string]struct{}, error) {
 	}
 	defer elfFile.Close()
 
+	if targetMachine != elf.EM_NONE && elfFile.Machine != targetMachine {
+		logrus.Warnf("%v has machine type %v but target is %v", path, elfFile.Machine, targetMachine)
+	}
+
 	needs, err := elfFile.DynString(elf.DT_NEEDED)
 	if err != nil || needs == nil {
 		return result, nil
@@ -122,6 +248,8 @@ func Deps(chrootDir, path string, nss bool) (map[string]struct{}, error) {
 		}
 	}
 
+	paths = append(paths, muslLibPaths...)
+
 	if nss {
 		for _, s := range []string{"libnss_dns.so.2", "libnss_files.so.2", "libnss_compat.so.2"} {
 			full := FindLibrary(s, chrootDir, paths)
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"io/ioutil"
+	"os"
 	"path/filepath"
 	"runtime"
 	"strings"
@@ -100,3 +102,40 @@ func TestFindLibrarySearch(t *testing.T) {
 		t.Fatalf("Libraries don't match")
 	}
 }
+
+func TestSoPathsFromDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smith-test-")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+	writeTestFiles(t, dir, map[string]string{
+		"opt/app/lib/libfoo.so.1": "opt",
+		"usr/lib/libfoo.so.1":     "usr",
+		"lib64/libfoo.so.1":       "lib64",
+		"usr/share/notes.sorted":  "notes",
+	})
+	ResetSoPaths()
+	if err := EnsureSoPaths(dir, []string{"/opt/app/lib"}); err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer ResetSoPaths()
+	if _, ok := soMap["notes.sorted"]; ok {
+		t.Fatalf("File that isn't a library was stored")
+	}
+	if FindLibrary("libfoo.so.1", dir, nil) != "/lib64/libfoo.so.1" {
+		t.Fatalf("Library wasn't found in loader order: %v", soMap["libfoo.so.1"])
+	}
+	if FindLibrary("libfoo.so.1", dir, preloadPaths) != "/opt/app/lib/libfoo.so.1" {
+		t.Fatalf("Preload path wasn't searched first")
+	}
+
+	// so paths from ldconfig are kept
+	SetSoPaths(fakeLdconfig, nil)
+	if err := EnsureSoPaths(dir, nil); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, ok := soMap["libffi.so.6"]; !ok {
+		t.Fatalf("So paths from ldconfig were replaced")
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	gdigest "github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// configChange is a config field that differs between two images. Fields
+// that are sets, like Env, list the entries that were added and removed,
+// other fields list the old and new values.
+type configChange struct {
+	Field   string   `json:"field"`
+	Old     []string `json:"old,omitempty"`
+	New     []string `json:"new,omitempty"`
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+}
+
+// fileChange is a file that was added, removed or modified.
+type fileChange struct {
+	Path      string         `json:"path"`
+	OldMode   string         `json:"oldMode,omitempty"`
+	NewMode   string         `json:"newMode,omitempty"`
+	OldSize   int64          `json:"oldSize"`
+	NewSize   int64          `json:"newSize"`
+	OldDigest gdigest.Digest `json:"oldDigest,omitempty"`
+	NewDigest gdigest.Digest `json:"newDigest,omitempty"`
+	OldLink   string         `json:"oldLink,omitempty"`
+	NewLink   string         `json:"newLink,omitempty"`
+}
+
+type packageChanges struct {
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+}
+
+type fileChanges struct {
+	Added    []fileChange `json:"added,omitempty"`
+	Removed  []fileChange `json:"removed,omitempty"`
+	Modified []fileChange `json:"modified,omitempty"`
+}
+
+// diffOutput describes the differences between two images.
+type diffOutput struct {
+	Old      string         `json:"old"`
+	New      string         `json:"new"`
+	Config   []configChange `json:"config,omitempty"`
+	Packages packageChanges `json:"packages"`
+	Files    fileChanges    `json:"files"`
+}
+
+// Empty returns true if the images are the same.
+func (d *diffOutput) Empty() bool {
+	return len(d.Config) == 0 &&
+		len(d.Packages.Added) == 0 && len(d.Packages.Removed) == 0 &&
+		len(d.Files.Added) == 0 && len(d.Files.Removed) == 0 && len(d.Files.Modified) == 0
+}
+
+// setDiff returns the entries only in b and the entries only in a.
+func setDiff(a, b []string) ([]string, []string) {
+	inA := map[string]struct{}{}
+	for _, s := range a {
+		inA[s] = struct{}{}
+	}
+	inB := map[string]struct{}{}
+	for _, s := range b {
+		inB[s] = struct{}{}
+	}
+	added := []string{}
+	for _, s := range b {
+		if _, ok := inA[s]; !ok {
+			added = append(added, s)
+		}
+	}
+	removed := []string{}
+	for _, s := range a {
+		if _, ok := inB[s]; !ok {
+			removed = append(removed, s)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed
+}
+
+func mapEntries(m map[string]string) []string {
+	entries := []string{}
+	for k, v := range m {
+		entries = append(entries, k+"="+v)
+	}
+	sort.Strings(entries)
+	return entries
+}
+
+func setKeys(m map[string]struct{}) []string {
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func scalar(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return []string{s}
+}
+
+// diffConfigs compares the fields of the configs that smith.yaml controls.
+func diffConfigs(a, b *v1.ImageConfig) []configChange {
+	changes := []configChange{}
+	values := []struct {
+		field string
+		set   bool
+		a, b  []string
+	}{
+		{"User", false, scalar(a.User), scalar(b.User)},
+		{"WorkingDir", false, scalar(a.WorkingDir), scalar(b.WorkingDir)},
+		{"Entrypoint", false, a.Entrypoint, b.Entrypoint},
+		{"Cmd", false, a.Cmd, b.Cmd},
+		{"Env", true, a.Env, b.Env},
+		{"Labels", true, mapEntries(a.Labels), mapEntries(b.Labels)},
+		{"Ports", true, setKeys(a.ExposedPorts), setKeys(b.ExposedPorts)},
+		{"Volumes", true, setKeys(a.Volumes), setKeys(b.Volumes)},
+	}
+	for _, v := range values {
+		if v.set {
+			added, removed := setDiff(v.a, v.b)
+			if len(added) != 0 || len(removed) != 0 {
+				changes = append(changes, configChange{Field: v.field, Added: added, Removed: removed})
+			}
+			continue
+		}
+		if len(v.a) == 0 && len(v.b) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(v.a, v.b) {
+			changes = append(changes, configChange{Field: v.field, Old: v.a, New: v.b})
+		}
+	}
+	return changes
+}
+
+func newFileChange(a, b *fileEntry) fileChange {
+	change := fileChange{}
+	if a != nil {
+		change.Path = a.Path
+		change.OldMode = a.Mode.String()
+		change.OldSize = a.Size
+		change.OldDigest = a.Digest
+		change.OldLink = a.Linkname
+	}
+	if b != nil {
+		change.Path = b.Path
+		change.NewMode = b.Mode.String()
+		change.NewSize = b.Size
+		change.NewDigest = b.Digest
+		change.NewLink = b.Linkname
+	}
+	return change
+}
+
+// fileModified returns true if the file differs in type, content, permissions
+// or ownership.
+func fileModified(a, b *fileEntry) bool {
+	return a.Typeflag != b.Typeflag || a.Mode != b.Mode || a.Uid != b.Uid ||
+		a.Gid != b.Gid || a.Size != b.Size || a.Digest != b.Digest ||
+		a.Linkname != b.Linkname
+}
+
+// diffFiles compares two merged filesystems.
+func diffFiles(a, b map[string]*fileEntry) fileChanges {
+	changes := fileChanges{}
+	for _, f := range sortedFiles(a, "/") {
+		other, ok := b[f.Path]
+		if !ok {
+			changes.Removed = append(changes.Removed, newFileChange(f, nil))
+		} else if fileModified(f, other) {
+			changes.Modified = append(changes.Modified, newFileChange(f, other))
+		}
+	}
+	for _, f := range sortedFiles(b, "/") {
+		if _, ok := a[f.Path]; !ok {
+			changes.Added = append(changes.Added, newFileChange(nil, f))
+		}
+	}
+	return changes
+}
+
+// diffImage loads an image with its files and packages for diffing.
+func diffImage(path string) (*Image, map[string]*fileEntry, []string, error) {
+	image, err := imageFromFile(path, nil)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	// only the config is used after the files are read
+	defer image.Close()
+	files, err := mergedFiles(image, true)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	output, err := inspectFile(path)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	platform := image.GetPlatform()
+	for _, i := range output.Images {
+		if i.Platform == nil || platformMatches(platform, *i.Platform) {
+			return image, files, i.Packages, nil
+		}
+	}
+	return image, files, nil, nil
+}
+
+// diffImages compares the images at paths a and b.
+func diffImages(a, b string) (*diffOutput, error) {
+	imageA, filesA, packagesA, err := diffImage(a)
+	if err != nil {
+		return nil, err
+	}
+	imageB, filesB, packagesB, err := diffImage(b)
+	if err != nil {
+		return nil, err
+	}
+	output := &diffOutput{Old: a, New: b}
+	output.Config = diffConfigs(&imageA.Config.Config, &imageB.Config.Config)
+	output.Packages.Added, output.Packages.Removed = setDiff(packagesA, packagesB)
+	output.Files = diffFiles(filesA, filesB)
+	return output, nil
+}
+
+func sizeDelta(change fileChange) string {
+	delta := change.NewSize - change.OldSize
+	if delta == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" (%+d bytes)", delta)
+}
+
+// printDiff writes a human readable description of output to w.
+func printDiff(w io.Writer, output *diffOutput) {
+	fmt.Fprintf(w, "--- %s\n+++ %s\n", output.Old, output.New)
+	if len(output.Config) != 0 {
+		fmt.Fprintf(w, "Config:\n")
+		for _, c := range output.Config {
+			if c.Added != nil || c.Removed != nil {
+				fmt.Fprintf(w, "  %s:\n", c.Field)
+				for _, s := range c.Removed {
+					fmt.Fprintf(w, "    - %s\n", s)
+				}
+				for _, s := range c.Added {
+					fmt.Fprintf(w, "    + %s\n", s)
+				}
+				continue
+			}
+			fmt.Fprintf(w, "  %s: %s -> %s\n", c.Field, strings.Join(c.Old, " "), strings.Join(c.New, " "))
+		}
+	}
+	if len(output.Packages.Added) != 0 || len(output.Packages.Removed) != 0 {
+		fmt.Fprintf(w, "Packages:\n")
+		for _, p := range output.Packages.Removed {
+			fmt.Fprintf(w, "  - %s\n", p)
+		}
+		for _, p := range output.Packages.Added {
+			fmt.Fprintf(w, "  + %s\n", p)
+		}
+	}
+	files := output.Files
+	if len(files.Added) != 0 || len(files.Removed) != 0 || len(files.Modified) != 0 {
+		fmt.Fprintf(w, "Files:\n")
+		for _, f := range files.Removed {
+			fmt.Fprintf(w, "  - %s %s %d\n", f.OldMode, f.Path, f.OldSize)
+		}
+		for _, f := range files.Added {
+			fmt.Fprintf(w, "  + %s %s %d\n", f.NewMode, f.Path, f.NewSize)
+		}
+		for _, f := range files.Modified {
+			details := []string{}
+			if f.OldMode != f.NewMode {
+				details = append(details, f.OldMode+" -> "+f.NewMode)
+			}
+			if f.OldDigest != f.NewDigest {
+				details = append(details, "content changed")
+			}
+			if f.OldLink != f.NewLink {
+				details = append(details, "link "+f.OldLink+" -> "+f.NewLink)
+			}
+			fmt.Fprintf(w, "  ~ %s %s%s\n", f.Path, strings.Join(details, ", "), sizeDelta(f))
+		}
+	}
+	if output.Empty() {
+		fmt.Fprintf(w, "No differences\n")
+	}
+}
+
+// diffContainers prints the differences between images a and b. The second
+// return value is true if the images differ.
+func diffContainers(a, b string, jsonOutput bool) (bool, bool) {
+	output, err := diffImages(a, b)
+	if err != nil {
+		logrus.Errorf("Failed to diff %s and %s: %v", a, b, err)
+		return false, false
+	}
+	if !jsonOutput {
+		printDiff(os.Stdout, output)
+		return true, !output.Empty()
+	}
+	data, err := json.MarshalIndent(output, "", "  ")
+	if err != nil {
+		logrus.Errorf("Failed to marshal output: %v", err)
+		return false, false
+	}
+	fmt.Println(string(data))
+	return true, !output.Empty()
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestDiffConfigs(t *testing.T) {
+	a := &v1.ImageConfig{
+		User:   "1000",
+		Cmd:    []string{"/bin/a"},
+		Env:    []string{"A=1", "B=2"},
+		Labels: map[string]string{"version": "1"},
+	}
+	b := &v1.ImageConfig{
+		User:         "1000",
+		Cmd:          []string{"/bin/b"},
+		Env:          []string{"B=2", "C=3"},
+		Labels:       map[string]string{"version": "1"},
+		ExposedPorts: map[string]struct{}{"80/tcp": {}},
+	}
+	changes := diffConfigs(a, b)
+	fields := map[string]configChange{}
+	for _, c := range changes {
+		fields[c.Field] = c
+	}
+	if len(fields) != 3 {
+		t.Fatalf("Wrong changes: %+v", changes)
+	}
+	if c := fields["Cmd"]; c.Old[0] != "/bin/a" || c.New[0] != "/bin/b" {
+		t.Errorf("Wrong Cmd change: %+v", c)
+	}
+	if c := fields["Env"]; len(c.Added) != 1 || c.Added[0] != "C=3" || len(c.Removed) != 1 || c.Removed[0] != "A=1" {
+		t.Errorf("Wrong Env change: %+v", c)
+	}
+	if c := fields["Ports"]; len(c.Added) != 1 || c.Added[0] != "80/tcp" {
+		t.Errorf("Wrong Ports change: %+v", c)
+	}
+}
+
+func TestDiffImages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smith-test-")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+	a := writeTestLayout(t, dir, "a", "old", "1")
+	b := writeTestLayout(t, dir, "b", "newer", "2")
+
+	output, err := diffImages(a, a)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !output.Empty() {
+		t.Fatalf("Image differs from itself: %+v", output)
+	}
+	output, err = diffImages(a, b)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	modified := output.Files.Modified
+	if len(modified) != 1 || modified[0].Path != "/data" || modified[0].NewSize-modified[0].OldSize != 2 {
+		t.Fatalf("Wrong modified files: %+v", modified)
+	}
+	if modified[0].OldDigest == modified[0].NewDigest {
+		t.Fatalf("Content change not detected")
+	}
+	if len(output.Files.Added) != 0 || len(output.Files.Removed) != 0 || len(output.Config) != 0 {
+		t.Fatalf("Unexpected changes: %+v", output)
+	}
+}
@@ -106,6 +106,34 @@ func IsTerminal(fd uintptr) bool {
 	return err == 0
 }
 
+// ReadPassword reads a line from the terminal fd without echoing it.
+func ReadPassword(fd uintptr) (string, error) {
+	var termios syscall.Termios
+	if _, _, err := syscall.Syscall6(syscall.SYS_IOCTL, fd, termiosRead, uintptr(unsafe.Pointer(&termios)), 0, 0, 0); err != 0 {
+		return "", err
+	}
+	noecho := termios
+	noecho.Lflag &^= syscall.ECHO
+	noecho.Lflag |= syscall.ICANON | syscall.ISIG
+	if _, _, err := syscall.Syscall6(syscall.SYS_IOCTL, fd, termiosWrite, uintptr(unsafe.Pointer(&noecho)), 0, 0, 0); err != 0 {
+		return "", err
+	}
+	defer syscall.Syscall6(syscall.SYS_IOCTL, fd, termiosWrite, uintptr(unsafe.Pointer(&termios)), 0, 0, 0)
+	var line []byte
+	buf := make([]byte, 1)
+	for {
+		n, err := syscall.Read(int(fd), buf)
+		if n == 1 && buf[0] != '\n' {
+			line = append(line, buf[0])
+			continue
+		}
+		if n == 1 || len(line) != 0 || err == nil {
+			return strings.TrimRight(string(line), "\r"), nil
+		}
+		return "", err
+	}
+}
+
 // execute colorizes output in non-quiet mode and behaves like a pty.
 // This means that lines are terminated with \r\n instead of just \n.
 // It also will pass ctrl-c through to the executed process so that it
@@ -6,4 +6,7 @@ import (
 	"syscall"
 )
 
-const termiosRead = syscall.TCGETS
+const (
+	termiosRead  = syscall.TCGETS
+	termiosWrite = syscall.TCSETS
+)
@@ -6,4 +6,7 @@ import (
 	"syscall"
 )
 
-const termiosRead = syscall.TIOCGETA
+const (
+	termiosRead  = syscall.TIOCGETA
+	termiosWrite = syscall.TIOCSETA
+)
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// configFile is a config file that was merged into a config along with the
+// positions of its keys. The path of the top level config is empty.
+type configFile struct {
+	path      string
+	def       *ConfigDef
+	positions yamlPositions
+}
+
+// resolveConfig loads the config at path and merges it over the file it
+// extends and the files it includes, in that order. Paths in extends and
+// include are relative to the directory of the including file. Only
+// decoding errors are returned, the merged config is validated by the
+// caller since a base may only be complete once merged. The files are
+// returned with path first, followed by the files it is merged over.
+func resolveConfig(path string, stack []string) (*ConfigDef, []configFile, []error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, nil, []error{err}
+	}
+	for _, p := range stack {
+		if p == abs {
+			return nil, nil, []error{fmt.Errorf("%s is included in a cycle: %s", path,
+				strings.Join(append(stack, abs), " -> "))}
+		}
+	}
+	stack = append(stack, abs)
+
+	def, positions, errs := loadConfigFile(path)
+	file := configFile{def: def, positions: positions}
+	if len(stack) > 1 {
+		file.path = path
+		for i, err := range errs {
+			if cerr, ok := err.(*configError); ok {
+				cerr.File = path
+			} else {
+				errs[i] = &configError{File: path, Msg: err.Error()}
+			}
+		}
+	}
+	if def == nil {
+		return nil, nil, errs
+	}
+
+	bases := []string{}
+	if def.Extends != "" {
+		bases = append(bases, def.Extends)
+	}
+	bases = append(bases, def.Include...)
+	files := []configFile{file}
+	merged := &ConfigDef{}
+	for _, base := range bases {
+		if !filepath.IsAbs(base) {
+			base = filepath.Join(filepath.Dir(path), base)
+		}
+		baseDef, baseFiles, baseErrs := resolveConfig(base, stack)
+		errs = append(errs, baseErrs...)
+		files = append(files, baseFiles...)
+		if baseDef != nil {
+			merged = mergeConfig(merged, baseDef)
+		}
+	}
+	merged = mergeConfig(merged, def)
+	merged.Extends = ""
+	merged.Include = nil
+	return merged, files, errs
+}
+
+// locateConfigError finds the file that err in a merged config comes from by
+// validating the files on their own. Errors that only occur once the files
+// are merged are reported for the top level config.
+func locateConfigError(err error, files []configFile, dir string) error {
+	cerr, ok := err.(*configError)
+	if !ok {
+		return err
+	}
+	for _, file := range files {
+		for _, ferr := range validateConfig(file.def, file.positions, dir) {
+			if fcerr, ok := ferr.(*configError); ok && fcerr.Msg == cerr.Msg {
+				fcerr.File = file.path
+				return fcerr
+			}
+		}
+	}
+	return err
+}
+
+// mergeConfig returns child merged over base. Scalars set in child replace
+// the ones in base and bools are set if either sets them. Lists of paths,
+// packages and platforms are appended without duplicates, env is merged by
+// variable name, and maps are merged by key. Entrypoint, cmd, layers and
+// images are replaced as a whole since their entries only make sense
+// together.
+func mergeConfig(base, child *ConfigDef) *ConfigDef {
+	platform, platforms := mergePlatforms(base, child)
+	return &ConfigDef{
+		Type:       mergeString(base.Type, child.Type),
+		Mock:       mergeMock(base.Mock, child.Mock),
+		Rpm:        mergeNative(base.Rpm, child.Rpm),
+		Deb:        mergeNative(base.Deb, child.Deb),
+		Apk:        mergeNative(base.Apk, child.Apk),
+		Static:     mergeStatic(base.Static, child.Static),
+		Package:    mergeString(base.Package, child.Package),
+		Paths:      mergeList(base.Paths, child.Paths),
+		Excludes:   mergeList(base.Excludes, child.Excludes),
+		Parent:     mergeString(base.Parent, child.Parent),
+		Nss:        base.Nss || child.Nss,
+		Root:       base.Root || child.Root,
+		User:       mergeString(base.User, child.User),
+		Groups:     mergeList(base.Groups, child.Groups),
+		Mounts:     mergeList(base.Mounts, child.Mounts),
+		Entrypoint: mergeReplace(base.Entrypoint, child.Entrypoint),
+		Cmd:        mergeReplace(base.Cmd, child.Cmd),
+		Dir:        mergeString(base.Dir, child.Dir),
+		Env:        mergeEnv(base.Env, child.Env),
+		Labels:     mergeMap(base.Labels, child.Labels),
+		Ports:      mergePorts(base.Ports, child.Ports),
+		Platform:   platform,
+		Platforms:  platforms,
+		Layers:     mergeLayers(base.Layers, child.Layers),
+		Values:     mergeMap(base.Values, child.Values),
+		Images:     mergeImages(base.Images, child.Images),
+		Extends:    child.Extends,
+		Include:    child.Include,
+	}
+}
+
+func mergeMock(base, child MockDef) MockDef {
+	return MockDef{
+		Config:     mergeString(base.Config, child.Config),
+		Configs:    mergeMap(base.Configs, child.Configs),
+		PreBuild:   mergeString(base.PreBuild, child.PreBuild),
+		PostBuild:  mergeString(base.PostBuild, child.PostBuild),
+		Deps:       mergeList(base.Deps, child.Deps),
+		DebugInfo:  base.DebugInfo || child.DebugInfo,
+		DebugDeps:  mergeList(base.DebugDeps, child.DebugDeps),
+		DebugPaths: mergeList(base.DebugPaths, child.DebugPaths),
+	}
+}
+
+func mergeNative(base, child NativeDef) NativeDef {
+	return NativeDef{
+		Repos:   mergeList(base.Repos, child.Repos),
+		Deps:    mergeList(base.Deps, child.Deps),
+		Scripts: base.Scripts || child.Scripts,
+	}
+}
+
+func mergeStatic(base, child StaticDef) StaticDef {
+	return StaticDef{
+		Binaries: mergeList(base.Binaries, child.Binaries),
+		Certs:    base.Certs || child.Certs,
+		Tzdata:   base.Tzdata || child.Tzdata,
+	}
+}
+
+// mergePlatforms merges the targets of base and child so that only one of
+// platform and platforms is set. A platform in child replaces all targets of
+// base, and platforms in child are added to the ones of base.
+func mergePlatforms(base, child *ConfigDef) (string, []string) {
+	if child.Platform != "" {
+		return child.Platform, nil
+	}
+	if len(child.Platforms) == 0 {
+		return base.Platform, base.Platforms
+	}
+	platforms := base.Platforms
+	if base.Platform != "" {
+		platforms = mergeList(platforms, []string{base.Platform})
+	}
+	return "", mergeList(platforms, child.Platforms)
+}
+
+func mergeString(base, child string) string {
+	if child != "" {
+		return child
+	}
+	return base
+}
+
+func mergeReplace(base, child []string) []string {
+	if len(child) != 0 {
+		return child
+	}
+	return base
+}
+
+func mergeLayers(base, child []LayerDef) []LayerDef {
+	if len(child) != 0 {
+		return child
+	}
+	return base
+}
+
+func mergeImages(base, child []ImageDef) []ImageDef {
+	if len(child) != 0 {
+		return child
+	}
+	return base
+}
+
+// mergeList appends the entries of child that aren't in base.
+func mergeList(base, child []string) []string {
+	if len(base) == 0 && len(child) == 0 {
+		return nil
+	}
+	result := []string{}
+	seen := map[string]struct{}{}
+	for _, list := range [][]string{base, child} {
+		for _, s := range list {
+			if _, ok := seen[s]; ok {
+				continue
+			}
+			seen[s] = struct{}{}
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+// mergeEnv merges NAME=value entries by name. Variables in child replace
+// the ones in base in place and new ones are appended.
+func mergeEnv(base, child []string) []string {
+	if len(base) == 0 && len(child) == 0 {
+		return nil
+	}
+	result := []string{}
+	index := map[string]int{}
+	for _, list := range [][]string{base, child} {
+		for _, env := range list {
+			name := strings.SplitN(env, "=", 2)[0]
+			if i, ok := index[name]; ok {
+				result[i] = env
+				continue
+			}
+			index[name] = len(result)
+			result = append(result, env)
+		}
+	}
+	return result
+}
+
+func mergeMap(base, child map[string]string) map[string]string {
+	if len(base) == 0 && len(child) == 0 {
+		return nil
+	}
+	result := map[string]string{}
+	for k, v := range base {
+		result[k] = v
+	}
+	for k, v := range child {
+		result[k] = v
+	}
+	return result
+}
+
+func mergePorts(base, child map[string]struct{}) map[string]struct{} {
+	if len(base) == 0 && len(child) == 0 {
+		return nil
+	}
+	result := map[string]struct{}{}
+	for k := range base {
+		result[k] = struct{}{}
+	}
+	for k := range child {
+		result[k] = struct{}{}
+	}
+	return result
+}
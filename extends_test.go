@@ -0,0 +1,163 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMergeConfig(t *testing.T) {
+	base := &ConfigDef{
+		Type:       "mock",
+		Package:    "base",
+		Paths:      []string{"/usr/bin/cat", "/usr/bin/ls"},
+		Env:        []string{"PATH=/bin", "LANG=C"},
+		Labels:     map[string]string{"team": "a", "tier": "1"},
+		Entrypoint: []string{"/usr/bin/cat", "-n"},
+		Mock:       MockDef{Deps: []string{"bash"}},
+	}
+	child := &ConfigDef{
+		Package:    "child",
+		Paths:      []string{"/usr/bin/ls", "/usr/bin/rm"},
+		Env:        []string{"LANG=en_US.UTF-8", "HOME=/root"},
+		Labels:     map[string]string{"tier": "2"},
+		Entrypoint: []string{"/usr/bin/rm"},
+		Nss:        true,
+		Mock:       MockDef{Deps: []string{"sed"}},
+	}
+	expected := &ConfigDef{
+		Type:       "mock",
+		Package:    "child",
+		Paths:      []string{"/usr/bin/cat", "/usr/bin/ls", "/usr/bin/rm"},
+		Env:        []string{"PATH=/bin", "LANG=en_US.UTF-8", "HOME=/root"},
+		Labels:     map[string]string{"team": "a", "tier": "2"},
+		Entrypoint: []string{"/usr/bin/rm"},
+		Nss:        true,
+		Mock:       MockDef{Deps: []string{"bash", "sed"}},
+	}
+	if merged := mergeConfig(base, child); !reflect.DeepEqual(merged, expected) {
+		t.Fatalf("mergeConfig returned %+v, expected %+v", merged, expected)
+	}
+}
+
+func TestMergePlatforms(t *testing.T) {
+	tests := []struct {
+		base, child *ConfigDef
+		platform    string
+		platforms   []string
+	}{
+		{&ConfigDef{Platform: "linux/amd64"}, &ConfigDef{}, "linux/amd64", nil},
+		{&ConfigDef{Platforms: []string{"linux/amd64"}}, &ConfigDef{Platform: "linux/arm64"}, "linux/arm64", nil},
+		{&ConfigDef{Platform: "linux/amd64"}, &ConfigDef{Platforms: []string{"linux/arm64"}}, "", []string{"linux/amd64", "linux/arm64"}},
+	}
+	for _, test := range tests {
+		platform, platforms := mergePlatforms(test.base, test.child)
+		if platform != test.platform || !reflect.DeepEqual(platforms, test.platforms) {
+			t.Errorf("mergePlatforms(%+v, %+v) = %q, %v, expected %q, %v", test.base, test.child, platform, platforms, test.platform, test.platforms)
+		}
+	}
+}
+
+func TestResolveConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smith-test-")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"base/common.yaml": "paths:\n- /usr/bin/cat\nenv:\n- LANG=C\n",
+		"base/debug.yaml":  "paths:\n- /usr/bin/strace\n",
+		"base/mock.yaml":   "extends: common.yaml\ntype: mock\nmock:\n  deps: [bash]\n",
+		"smith.yaml":       "extends: base/mock.yaml\ninclude:\n- base/debug.yaml\npackage: coreutils\npaths:\n- /usr/bin/ls\n",
+	}
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	def, errs := loadConfig(filepath.Join(dir, "smith.yaml"), dir)
+	if len(errs) != 0 {
+		t.Fatalf("loadConfig failed: %v", errs)
+	}
+	expected := &ConfigDef{
+		Type:    "mock",
+		Package: "coreutils",
+		Paths:   []string{"/usr/bin/cat", "/usr/bin/strace", "/usr/bin/ls"},
+		Env:     []string{"LANG=C"},
+		Mock:    MockDef{Deps: []string{"bash"}},
+	}
+	if !reflect.DeepEqual(def, expected) {
+		t.Fatalf("loadConfig returned %+v, expected %+v", def, expected)
+	}
+
+	// errors in included files name the file
+	debug := filepath.Join(dir, "base", "debug.yaml")
+	if err := ioutil.WriteFile(debug, []byte("paths:\n- usr/bin/strace\n"), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+	_, errs = loadConfig(filepath.Join(dir, "smith.yaml"), dir)
+	if len(errs) != 1 {
+		t.Fatalf("loadConfig returned %v, expected one error", errs)
+	}
+	msg := formatConfigError("smith.yaml", errs[0])
+	if msg != debug+`:2:1: paths[0]: path "usr/bin/strace" must be absolute` {
+		t.Fatalf("Unexpected error %q", msg)
+	}
+
+	// cycles are an error instead of recursing forever
+	common := filepath.Join(dir, "base", "common.yaml")
+	if err := ioutil.WriteFile(common, []byte("extends: mock.yaml\n"), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := ioutil.WriteFile(debug, []byte(files["base/debug.yaml"]), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+	_, errs = loadConfig(filepath.Join(dir, "smith.yaml"), dir)
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "cycle") {
+		t.Fatalf("loadConfig returned %v, expected a cycle error", errs)
+	}
+}
+
+func TestResolvePartialBase(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smith-test-")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"bin/app":      "",
+		"rootfs/.keep": "",
+		"static.yaml":  "type: static\nstatic:\n  certs: true\n",
+		"dir.yaml":     "type: dir\npaths:\n- /usr/bin/cat\n",
+		"app.yaml":     "extends: static.yaml\nstatic:\n  binaries: [" + filepath.Join(dir, "bin/app") + "]\n",
+		"rootfs.yaml":  "extends: dir.yaml\npackage: rootfs\n",
+		"missing.yaml": "extends: static.yaml\n",
+	}
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	// bases only need to be valid once merged
+	for _, name := range []string{"app.yaml", "rootfs.yaml"} {
+		if _, errs := loadConfig(filepath.Join(dir, name), dir); len(errs) != 0 {
+			t.Errorf("loadConfig(%s) failed: %v", name, errs)
+		}
+	}
+	_, errs := loadConfig(filepath.Join(dir, "missing.yaml"), dir)
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "at least one binary") {
+		t.Fatalf("loadConfig returned %v, expected a missing binaries error", errs)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const scriptPath = "/tmp/smith-script"
+
+// runScript runs an install script of a package in the build root with
+// the interpreter in prog. The script is written into the root first and
+// executed directly if prog is empty.
+func runScript(root string, ex executor, name string, prog []string, script string, arg ...string) error {
+	args := []string{}
+	if len(prog) > 1 {
+		args = append(args, prog[1:]...)
+	}
+	if script != "" {
+		path, err := resolveInRoot(root, scriptPath, false)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 01777); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(path, []byte(script), 0700); err != nil {
+			return err
+		}
+		defer os.Remove(path)
+		if len(prog) == 0 {
+			prog = []string{scriptPath}
+		} else {
+			args = append(args, scriptPath)
+		}
+	}
+	args = append(args, arg...)
+	if _, stderr, err := ex(prog[0], args...); err != nil {
+		return fmt.Errorf("script of %s failed: %v: %s", name, err, strings.TrimSpace(stderr))
+	}
+	return nil
+}
+
+// extractTar writes the files of the tar archive in r into t. It returns
+// the paths of the files that aren't directories.
+func extractTar(r io.Reader, t *treeExtractor) ([]string, error) {
+	files := []string{}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := filepath.Clean("/" + hdr.Name)
+		switch hdr.Typeflag {
+		case tar.TypeLink:
+			err = t.link(name, hdr.Linkname)
+		default:
+			err = t.file(name, hdr.FileInfo().Mode(), hdr.Linkname, tr)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", hdr.Name, err)
+		}
+		if hdr.Typeflag != tar.TypeDir {
+			files = append(files, name)
+		}
+	}
+}
+
+// treeExtractor writes files into a build root. Directories are kept
+// writable until finish sets their final modes. Symlinks that packages
+// extracted earlier are resolved inside the root, so an absolute link like
+// var/run -> /run can't redirect later files to the host.
+type treeExtractor struct {
+	root string
+	dirs map[string]os.FileMode
+}
+
+func newTreeExtractor(root string) *treeExtractor {
+	return &treeExtractor{root: root, dirs: map[string]os.FileMode{}}
+}
+
+func (t *treeExtractor) mkdir(path string, mode os.FileMode) error {
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return err
+	}
+	t.dirs[path] = mode
+	return os.Chmod(path, mode|0700)
+}
+
+// file writes a file, directory or symlink below the root. The content of
+// regular files is read from r.
+func (t *treeExtractor) file(name string, mode os.FileMode, link string, r io.Reader) error {
+	if mode.IsDir() {
+		// like dpkg, a symlink to a directory stays in place
+		path, err := resolveInRoot(t.root, name, true)
+		if err != nil {
+			return err
+		}
+		return t.mkdir(path, mode.Perm())
+	}
+	path, err := resolveInRoot(t.root, name, false)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if info, err := os.Lstat(path); err == nil && !info.IsDir() {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	switch {
+	case mode&os.ModeSymlink != 0:
+		return os.Symlink(link, path)
+	case mode.IsRegular():
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(f, r); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+		return os.Chmod(path, mode&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky))
+	}
+	logrus.Debugf("Skipping special file %v", name)
+	return nil
+}
+
+// link creates a hard link to an earlier file.
+func (t *treeExtractor) link(name, target string) error {
+	path, err := resolveInRoot(t.root, name, false)
+	if err != nil {
+		return err
+	}
+	targetPath, err := resolveInRoot(t.root, target, false)
+	if err != nil {
+		return err
+	}
+	os.Remove(path)
+	return os.Link(targetPath, path)
+}
+
+// finish sets the final modes of the directories.
+func (t *treeExtractor) finish() error {
+	for path, mode := range t.dirs {
+		if err := os.Chmod(path, mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// makeWritable adds write permission to the directories below dir so it
+// can be removed.
+func makeWritable(dir string) {
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() && info.Mode().Perm()&0700 != 0700 {
+			os.Chmod(path, info.Mode().Perm()|0700)
+		}
+		return nil
+	})
+}
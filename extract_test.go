@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExtractTarInsideRoot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smith-test-")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+	host := filepath.Join(dir, "host")
+	root := filepath.Join(dir, "root")
+	for _, d := range []string{host, root} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	// like var/run -> /run in base-files, followed by files below it
+	data := testTarGz(map[string]string{
+		"var/run":          "@" + host,
+		"var/run/pid":      "1",
+		"var/up":           "@../../..",
+		"var/up/escaped":   "x",
+		"var/up/etc/shell": "sh",
+	}, true)
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	tree := newTreeExtractor(root)
+	if _, err := extractTar(gz, tree); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := tree.finish(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	for _, p := range []string{filepath.Join(host, "pid"), filepath.Join(dir, "escaped"), filepath.Join(dir, "etc")} {
+		if _, err := os.Lstat(p); err == nil {
+			t.Fatalf("%s was written outside of the root", p)
+		}
+	}
+	for p, content := range map[string]string{
+		filepath.Join(host, "pid"): "1",
+		"escaped":                  "x",
+		"etc/shell":                "sh",
+	} {
+		got, err := ioutil.ReadFile(filepath.Join(root, p))
+		if err != nil || string(got) != content {
+			t.Errorf("%s wasn't written inside the root: %q %v", p, got, err)
+		}
+	}
+}
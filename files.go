@@ -0,0 +1,382 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/Sirupsen/logrus"
+	gdigest "github.com/opencontainers/go-digest"
+)
+
+// maxSymlinks is the number of symlinks followed when resolving a path in
+// an image before giving up.
+const maxSymlinks = 40
+
+// fileEntry is a file in the merged filesystem of an image.
+type fileEntry struct {
+	Path     string
+	Mode     os.FileMode
+	Size     int64
+	Uid      int
+	Gid      int
+	Typeflag byte
+	Linkname string
+	// Layer is the index of the layer the file came from.
+	Layer int
+	// Digest is the digest of the content of regular files. It is only set
+	// if mergedFiles was asked to hash the content.
+	Digest gdigest.Digest
+}
+
+// imagePath converts the name of a tar entry into an absolute path.
+func imagePath(name string) string {
+	return path.Clean("/" + name)
+}
+
+// isBelow returns true if p is dir or inside of dir.
+func isBelow(p, dir string) bool {
+	return p == dir || dir == "/" || strings.HasPrefix(p, dir+"/")
+}
+
+// mergedFiles reads the headers of all layers of image and returns the files
+// that are visible once the layers are applied in order. If hash is set, the
+// content of regular files is digested as well.
+func mergedFiles(image *Image, hash bool) (map[string]*fileEntry, error) {
+	files := map[string]*fileEntry{"/": {Path: "/", Mode: os.ModeDir | 0755, Typeflag: tar.TypeDir}}
+	removeBelow := func(dir string, layer int) {
+		for p, f := range files {
+			if p != dir && isBelow(p, dir) && f.Layer < layer {
+				delete(files, p)
+			}
+		}
+	}
+	for i, layer := range image.Layers {
+		err := walkLayer(layer, func(hdr *tar.Header, in io.Reader) error {
+			p := imagePath(hdr.Name)
+			base := path.Base(p)
+			if base == opaqueWhiteout {
+				removeBelow(path.Dir(p), i)
+				return nil
+			}
+			if strings.HasPrefix(base, whiteoutPrefix) {
+				target := path.Join(path.Dir(p), base[len(whiteoutPrefix):])
+				delete(files, target)
+				removeBelow(target, i+1)
+				return nil
+			}
+			if existing, ok := files[p]; ok && existing.Typeflag == tar.TypeDir && hdr.Typeflag != tar.TypeDir {
+				removeBelow(p, i+1)
+			}
+			if hdr.Typeflag == tar.TypeRegA {
+				hdr.Typeflag = tar.TypeReg
+			}
+			entry := &fileEntry{
+				Path:     p,
+				Mode:     hdr.FileInfo().Mode(),
+				Size:     hdr.Size,
+				Uid:      hdr.Uid,
+				Gid:      hdr.Gid,
+				Typeflag: hdr.Typeflag,
+				Linkname: hdr.Linkname,
+				Layer:    i,
+			}
+			if hdr.Typeflag == tar.TypeLink {
+				entry.Linkname = imagePath(hdr.Linkname)
+				if target, ok := files[entry.Linkname]; ok {
+					entry.Size = target.Size
+					entry.Digest = target.Digest
+				}
+			}
+			if hash && hdr.Typeflag == tar.TypeReg {
+				d, err := gdigest.FromReader(in)
+				if err != nil {
+					return err
+				}
+				entry.Digest = d
+			}
+			files[p] = entry
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// resolveImagePath follows symlinks in the directories of p so that it
+// refers to a path that exists in files. Like cp, the last element is only
+// followed if p ends with a slash.
+func resolveImagePath(files map[string]*fileEntry, p string) (string, error) {
+	followLast := strings.HasSuffix(p, "/")
+	p = path.Clean("/" + p)
+	if p == "/" {
+		return p, nil
+	}
+	parts := strings.Split(p[1:], "/")
+	resolved := "/"
+	hops := 0
+	for i := 0; i < len(parts); i++ {
+		next := path.Join(resolved, parts[i])
+		entry, ok := files[next]
+		if !ok {
+			return "", fmt.Errorf("%s not found in image", p)
+		}
+		if (i == len(parts)-1 && !followLast) || entry.Typeflag != tar.TypeSymlink {
+			resolved = next
+			continue
+		}
+		hops++
+		if hops > maxSymlinks {
+			return "", fmt.Errorf("too many levels of symbolic links in %s", p)
+		}
+		target := entry.Linkname
+		if !path.IsAbs(target) {
+			target = path.Join(resolved, target)
+		}
+		// resolve the rest of the path relative to the link target
+		rest := append(strings.Split(strings.TrimPrefix(path.Clean(target), "/"), "/"), parts[i+1:]...)
+		parts = rest
+		resolved = "/"
+		i = -1
+	}
+	return resolved, nil
+}
+
+// sortedFiles returns the files below dir sorted by path.
+func sortedFiles(files map[string]*fileEntry, dir string) []*fileEntry {
+	result := []*fileEntry{}
+	for p, f := range files {
+		if isBelow(p, dir) {
+			result = append(result, f)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Path < result[j].Path })
+	return result
+}
+
+func listImage(inName, dir string) bool {
+	image, err := imageFromFile(inName, nil)
+	if err != nil {
+		logrus.Errorf("Failed to get image from %s: %v", inName, err)
+		return false
+	}
+	defer image.Close()
+	files, err := mergedFiles(image, false)
+	if err != nil {
+		logrus.Errorf("Failed to read layers of %s: %v", inName, err)
+		return false
+	}
+	if dir == "" {
+		dir = "/"
+	}
+	resolved, err := resolveImagePath(files, dir)
+	if err != nil {
+		logrus.Errorf("Failed to find %s: %v", dir, err)
+		return false
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 1, ' ', tabwriter.AlignRight)
+	for _, f := range sortedFiles(files, resolved) {
+		name := f.Path
+		switch f.Typeflag {
+		case tar.TypeSymlink:
+			name += " -> " + f.Linkname
+		case tar.TypeLink:
+			name += " => " + f.Linkname
+		}
+		layer := string(image.Layers[f.Layer].Desc.Digest)
+		if f.Path == "/" {
+			layer = ""
+		} else if len(layer) > 19 {
+			// sha256: plus the first 12 characters of the hex
+			layer = layer[:19]
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t %s\t %s\n", f.Mode, f.Uid, f.Gid, f.Size, layer, name)
+	}
+	w.Flush()
+	return true
+}
+
+// splitImagePath splits an argument in the form file.tar.gz[:name]:/path
+// into the image and the path.
+func splitImagePath(arg string) (string, string, error) {
+	i := strings.Index(arg, ":/")
+	if i == -1 {
+		return "", "", fmt.Errorf("expected image.tar.gz[:name]:/path, got '%s'", arg)
+	}
+	return arg[:i], arg[i+1:], nil
+}
+
+// copyFromImage extracts the file or directory at src in image to dest. Like
+// cp, if dest is an existing directory, src is copied into it.
+func copyFromImage(image *Image, src, dest string) error {
+	files, err := mergedFiles(image, false)
+	if err != nil {
+		return err
+	}
+	src, err = resolveImagePath(files, src)
+	if err != nil {
+		return err
+	}
+	root := files[src]
+	if info, err := os.Stat(dest); err == nil && info.IsDir() && src != "/" {
+		dest = filepath.Join(dest, path.Base(src))
+	}
+	if root.Typeflag == tar.TypeDir {
+		if err := os.MkdirAll(dest, 0755); err != nil {
+			return err
+		}
+	}
+	// map an image path to its location under dest without following
+	// symlinks that were extracted earlier out of dest
+	target := func(p string) (string, error) {
+		return resolveInRoot(dest, strings.TrimPrefix(p, src), false)
+	}
+	// hard links below src to files outside of it get a copy of the data of
+	// their target, which comes before them in the same layer
+	outside := map[int]map[string][]string{}
+	for p, f := range files {
+		if f.Typeflag != tar.TypeLink || !isBelow(p, src) || p == "/" || isBelow(f.Linkname, src) {
+			continue
+		}
+		if outside[f.Layer] == nil {
+			outside[f.Layer] = map[string][]string{}
+		}
+		outside[f.Layer][f.Linkname] = append(outside[f.Layer][f.Linkname], p)
+	}
+	for i, layer := range image.Layers {
+		err := walkLayer(layer, func(hdr *tar.Header, in io.Reader) error {
+			p := imagePath(hdr.Name)
+			if links, ok := outside[i][p]; ok && (hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeRegA) {
+				delete(outside[i], p)
+				return copyLinkTarget(hdr, in, links, target)
+			}
+			f, ok := files[p]
+			// only extract the version of the file that is visible
+			if !ok || f.Layer != i || !isBelow(p, src) || p == "/" {
+				return nil
+			}
+			if hdr.Typeflag == tar.TypeLink && !isBelow(f.Linkname, src) {
+				// extracted along with the target
+				return nil
+			}
+			logrus.Debugf("Extracting %s", p)
+			out, err := target(p)
+			if err != nil {
+				return err
+			}
+			linkPath, err := target(f.Linkname)
+			if err != nil {
+				return err
+			}
+			// the parent may have come from a layer that was skipped
+			if err := os.MkdirAll(filepath.Dir(out), 0755); err != nil {
+				return err
+			}
+			return extractEntry(hdr, in, out, linkPath)
+		})
+		if err != nil {
+			return err
+		}
+		for linkname, links := range outside[i] {
+			return fmt.Errorf("%s is a hard link to %s, which isn't in its layer", links[0], linkname)
+		}
+	}
+	return nil
+}
+
+// copyLinkTarget extracts the file in hdr and in to the location of the
+// first of links and hard links the others to it.
+func copyLinkTarget(hdr *tar.Header, in io.Reader, links []string, target func(string) (string, error)) error {
+	sort.Strings(links)
+	first := ""
+	for _, link := range links {
+		out, err := target(link)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(out), 0755); err != nil {
+			return err
+		}
+		logrus.Debugf("Extracting %s from %s", link, imagePath(hdr.Name))
+		if first == "" {
+			first = out
+			if err := extractEntry(hdr, in, out, ""); err != nil {
+				return err
+			}
+			continue
+		}
+		os.Remove(out)
+		if err := os.Link(first, out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolveInRoot returns the location of p below root with the symlinks in
+// its directories resolved as if root were /, so nothing can be written
+// outside of root through a symlink extracted earlier. The last element is
+// only followed if followLast is set. Missing directories are left for the
+// caller to create.
+func resolveInRoot(root, p string, followLast bool) (string, error) {
+	p = path.Clean("/" + p)
+	if p == "/" {
+		return root, nil
+	}
+	parts := strings.Split(p[1:], "/")
+	resolved := "/"
+	hops := 0
+	for i := 0; i < len(parts); i++ {
+		next := path.Join(resolved, parts[i])
+		if i == len(parts)-1 && !followLast {
+			resolved = next
+			break
+		}
+		target, err := os.Readlink(filepath.Join(root, filepath.FromSlash(next)))
+		if err != nil {
+			// not a symlink or missing
+			resolved = next
+			continue
+		}
+		hops++
+		if hops > maxSymlinks {
+			return "", fmt.Errorf("too many levels of symbolic links in %s", p)
+		}
+		if !path.IsAbs(target) {
+			target = path.Join(resolved, target)
+		}
+		// resolve the rest of the path relative to the link target
+		parts = append(strings.Split(strings.TrimPrefix(path.Clean(target), "/"), "/"), parts[i+1:]...)
+		resolved = "/"
+		i = -1
+	}
+	return filepath.Join(root, filepath.FromSlash(resolved)), nil
+}
+
+func copyFromContainer(srcArg, dest string) bool {
+	inName, src, err := splitImagePath(srcArg)
+	if err != nil {
+		logrus.Errorf("%v", err)
+		return false
+	}
+	image, err := imageFromFile(inName, nil)
+	if err != nil {
+		logrus.Errorf("Failed to get image from %s: %v", inName, err)
+		return false
+	}
+	defer image.Close()
+	if err := copyFromImage(image, src, dest); err != nil {
+		logrus.Errorf("Failed to copy %s from %s: %v", src, inName, err)
+		return false
+	}
+	logrus.Infof("Copied %s from %s to %s", src, inName, dest)
+	return true
+}
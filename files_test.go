@@ -0,0 +1,189 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTestFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if content[0] == '@' {
+			if err := os.Symlink(content[1:], p); err != nil {
+				t.Fatalf("%v", err)
+			}
+			continue
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+}
+
+func TestMergedFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smith-test-")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+	lower := filepath.Join(dir, "lower")
+	upper := filepath.Join(dir, "upper")
+	writeTestFiles(t, lower, map[string]string{
+		"usr/lib/libfoo.so": "foo",
+		"usr/lib/libbar.so": "bar",
+		"etc/old/config":    "old",
+		"opaque/gone":       "gone",
+		"lib":               "@usr/lib",
+	})
+	writeTestFiles(t, upper, map[string]string{
+		"usr/lib/.wh.libbar.so": "x",
+		"usr/lib/libbaz.so":     "baz",
+		"etc/.wh.old":           "x",
+		"opaque/.wh..wh..opq":   "x",
+		"opaque/kept":           "kept",
+	})
+	image := &Image{}
+	for _, d := range []string{lower, upper} {
+		layer, err := layerFromPath(d, dir, 0, 0, false)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		image.Layers = append(image.Layers, layer)
+	}
+
+	files, err := mergedFiles(image, false)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	expected := map[string]int{
+		"/usr/lib/libfoo.so": 0,
+		"/usr/lib/libbaz.so": 1,
+		"/opaque/kept":       1,
+		"/lib":               0,
+	}
+	for p, layer := range expected {
+		f, ok := files[p]
+		if !ok {
+			t.Fatalf("%s missing from merged files", p)
+		}
+		if f.Layer != layer {
+			t.Errorf("%s came from layer %d, expected %d", p, f.Layer, layer)
+		}
+	}
+	for _, p := range []string{"/usr/lib/libbar.so", "/etc/old", "/etc/old/config", "/opaque/gone", "/usr/lib/.wh.libbar.so"} {
+		if _, ok := files[p]; ok {
+			t.Errorf("%s should have been removed", p)
+		}
+	}
+	if resolved, err := resolveImagePath(files, "/lib/libfoo.so"); err != nil || resolved != "/usr/lib/libfoo.so" {
+		t.Errorf("resolveImagePath returned %q %v", resolved, err)
+	}
+
+	out := filepath.Join(dir, "out")
+	if err := copyFromImage(image, "/lib/", out); err != nil {
+		t.Fatalf("%v", err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(out, "libbaz.so"))
+	if err != nil || string(data) != "baz" {
+		t.Fatalf("Failed to copy libbaz.so: %q %v", data, err)
+	}
+	if _, err := os.Stat(filepath.Join(out, "libbar.so")); err == nil {
+		t.Fatalf("Removed file was copied")
+	}
+	if err := copyFromImage(image, "/usr/lib/libfoo.so", out); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(out, "libfoo.so")); err != nil || string(data) != "foo" {
+		t.Fatalf("Failed to copy libfoo.so into dir: %q %v", data, err)
+	}
+}
+
+func TestExtractInsideRoot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smith-test-")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+	host := filepath.Join(dir, "host")
+	if err := os.MkdirAll(host, 0755); err != nil {
+		t.Fatalf("%v", err)
+	}
+	// the file below the symlink and the new file in the opaque directory
+	// come before the marker in the same layer
+	image := &Image{Layers: []*Layer{
+		{Blob: bytesBlob(testTarGz(map[string]string{
+			"opaque/gone": "gone",
+		}, true))},
+		{Blob: bytesBlob(testTarGz(map[string]string{
+			"etc":                 "@" + host,
+			"etc/passwd":          "root",
+			"opaque/+new":         "new",
+			"opaque/.wh..wh..opq": "x",
+		}, true))},
+	}}
+
+	extracted := filepath.Join(dir, "extracted")
+	if err := ExtractOci(image, extracted); err != nil {
+		t.Fatalf("%v", err)
+	}
+	copied := filepath.Join(dir, "copied")
+	if err := copyFromImage(image, "/", copied); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, err := os.Stat(filepath.Join(host, "passwd")); err == nil {
+		t.Fatalf("File was written through a symlink outside of the root")
+	}
+	for _, root := range []string{extracted, copied} {
+		if data, err := ioutil.ReadFile(filepath.Join(root, host, "passwd")); err != nil || string(data) != "root" {
+			t.Errorf("File below symlink was not written inside %s: %q %v", root, data, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(extracted, "opaque", "+new")); err != nil {
+		t.Errorf("Opaque whiteout removed a file from its own layer")
+	}
+	if _, err := os.Stat(filepath.Join(extracted, "opaque", "gone")); err == nil {
+		t.Errorf("Opaque whiteout didn't remove a file from a lower layer")
+	}
+}
+
+func TestCopyHardLink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smith-test-")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+	image := &Image{Layers: []*Layer{
+		{Blob: bytesBlob(testTarGz(map[string]string{
+			"opt/":          "",
+			"opt/app/":      "",
+			"usr/":          "",
+			"usr/bin/":      "",
+			"opt/app/tool":  "tool",
+			"usr/bin/tool":  "=opt/app/tool",
+			"usr/bin/tool2": "=opt/app/tool",
+		}, true))},
+	}}
+
+	// the target of the link is outside of the copied path
+	out := filepath.Join(dir, "tool")
+	if err := copyFromImage(image, "/usr/bin/tool", out); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if data, err := ioutil.ReadFile(out); err != nil || string(data) != "tool" {
+		t.Fatalf("Hard link wasn't copied: %q %v", data, err)
+	}
+	bin := filepath.Join(dir, "bin")
+	if err := copyFromImage(image, "/usr/bin", bin); err != nil {
+		t.Fatalf("%v", err)
+	}
+	a, _ := os.Stat(filepath.Join(bin, "tool"))
+	b, _ := os.Stat(filepath.Join(bin, "tool2"))
+	if a == nil || b == nil || !os.SameFile(a, b) {
+		t.Fatalf("Hard links weren't copied as links")
+	}
+}
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"compress/bzip2"
 	"compress/gzip"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os/exec"
+	"strings"
 	"sync"
 	"syscall"
 
@@ -13,9 +16,10 @@ import (
 	"github.com/Sirupsen/logrus"
 )
 
-var (
-	hasPigz *bool
-)
+var hasPigz *bool
+
+// pinnedGzipLevel is the compression level used for reproducible builds.
+const pinnedGzipLevel = 6
 
 func HasPigz() bool {
 	if hasPigz == nil {
@@ -77,6 +81,27 @@ func MaybeGzipReader(in ReadSeekCloser) (io.ReadCloser, error) {
 	return pigzReader, nil
 }
 
+// decompressReader returns a reader for the data in r compressed with
+// format. Formats without a decoder in the standard library are handled by
+// the xz and zstd binaries.
+func decompressReader(r io.Reader, format string) (io.ReadCloser, error) {
+	switch format {
+	case "", "none":
+		return ioutil.NopCloser(r), nil
+	case "gzip", "gz":
+		return gzip.NewReader(r)
+	case "bzip2", "bz2":
+		return ioutil.NopCloser(bzip2.NewReader(r)), nil
+	case "xz":
+		return newCommandReader(r, "xz", "-d", "-c")
+	case "lzma":
+		return newCommandReader(r, "xz", "--format=lzma", "-d", "-c")
+	case "zstd", "zst":
+		return newCommandReader(r, "zstd", "-d", "-c")
+	}
+	return nil, fmt.Errorf("unsupported compression %v", format)
+}
+
 type PigzReader struct {
 	stdout      io.ReadCloser
 	stdin       io.WriteCloser
@@ -86,9 +111,15 @@ type PigzReader struct {
 }
 
 func NewPigzReader(r io.Reader) (*PigzReader, error) {
+	return newCommandReader(r, "pigz", "-d")
+}
+
+// newCommandReader returns a reader for the output of the command run with r
+// as its input.
+func newCommandReader(r io.Reader, name string, arg ...string) (*PigzReader, error) {
 	z := PigzReader{}
-	z.cmd = exec.Command("pigz", "-d")
-	z.commandLine = "pigz -d"
+	z.cmd = exec.Command(name, arg...)
+	z.commandLine = strings.Join(append([]string{name}, arg...), " ")
 	var err error
 	z.stdout, err = z.cmd.StdoutPipe()
 	if err != nil {
@@ -143,10 +174,18 @@ type PigzWriter struct {
 	wg          sync.WaitGroup
 }
 
-func MaybeGzipWriter(w io.Writer) (io.WriteCloser, error) {
+// MaybeGzipWriter compresses to w with pigz if it is available. If pinned is
+// set the internal gzip is used at a fixed level so the output only depends
+// on the input and the smith binary.
+func MaybeGzipWriter(w io.Writer, pinned bool) (io.WriteCloser, error) {
 	var gzipOut io.WriteCloser
 	var err error
-	if HasPigz() {
+	if pinned {
+		gzipOut, err = gzip.NewWriterLevel(w, pinnedGzipLevel)
+		if err != nil {
+			return nil, err
+		}
+	} else if HasPigz() {
 		gzipOut, err = NewPigzWriter(w)
 		if err != nil {
 			logrus.Errorf("Failed to write gzip: %v", err)
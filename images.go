@@ -0,0 +1,110 @@
+package main
+
+import (
+	"debug/elf"
+	"path/filepath"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const installDir = "install"
+
+// imageOutput returns the file the image is written to. Relative outputs
+// are placed next to outpath.
+func imageOutput(outpath string, image ImageDef) string {
+	output := image.Output
+	if output == "" {
+		output = image.Name + ".tar.gz"
+	}
+	if filepath.IsAbs(output) {
+		return output
+	}
+	return filepath.Join(filepath.Dir(outpath), output)
+}
+
+// imageConfig returns the config for a single image of shared. The paths
+// of the image are added to paths and its other fields replace the ones of
+// shared.
+func imageConfig(shared *ConfigDef, paths []string, image ImageDef) *ConfigDef {
+	def := *shared
+	def.Images = nil
+	def.Paths = mergeList(paths, image.Paths)
+	def.Excludes = mergeList(shared.Excludes, image.Excludes)
+	def.Entrypoint = mergeReplace(shared.Entrypoint, image.Entrypoint)
+	def.Cmd = mergeReplace(shared.Cmd, image.Cmd)
+	def.User = mergeString(shared.User, image.User)
+	return &def
+}
+
+// buildImages installs the package of pkg once into buildDir/install with
+// the paths of all images and then copies the files of each image into
+// buildDir/<name>. It returns the config of each image and the list of
+// packages installed.
+func buildImages(buildOpts *buildOptions, path, buildDir string, pkg *ConfigDef, platform v1.Platform) ([]*ConfigDef, []string, error) {
+	shared := *pkg
+	shared.Images = nil
+	for _, image := range pkg.Images {
+		shared.Paths = mergeList(shared.Paths, image.Paths)
+	}
+
+	nss := make([]bool, len(pkg.Images))
+	for i, image := range pkg.Images {
+		outputDir, err := rootfsDir(filepath.Join(buildDir, image.Name), rootfs)
+		if err != nil {
+			logrus.Errorf("Failed to get rootfs dir: %v", err)
+			return nil, nil, err
+		}
+		user := mergeString(pkg.User, image.User)
+		nss[i], err = PopulateNss(outputDir, user, pkg.Groups, pkg.Nss)
+		if err != nil {
+			logrus.Errorf("Failed to populate nss: %v", err)
+			return nil, nil, err
+		}
+		// the shared install needs the nss libraries if any image does
+		shared.Nss = shared.Nss || nss[i]
+	}
+
+	// only follow libraries that match the target platform
+	SetTargetMachine(platformMachine(platform))
+	defer SetTargetMachine(elf.EM_NONE)
+
+	sharedDir, err := rootfsDir(buildDir, installDir)
+	if err != nil {
+		logrus.Errorf("Failed to get install dir: %v", err)
+		return nil, nil, err
+	}
+	var packages []string
+	ResetSoPaths()
+	if pkg.Package != "" || pkg.Type == "static" {
+		packages, err = installPackage(buildOpts, sharedDir, &shared, platform)
+		if err != nil {
+			logrus.Errorf("Failed to install %v: %v", pkg.Package, err)
+			return nil, nil, err
+		}
+	}
+
+	// the install may have been restored from the cache without running
+	// ldconfig, in which case the libraries are found in the copied tree
+	_, preload := chrootEnv(shared.Env)
+	if err := EnsureSoPaths(sharedDir, preload); err != nil {
+		return nil, nil, err
+	}
+	defs := []*ConfigDef{}
+	for i, image := range pkg.Images {
+		logrus.Infof("Building image %v", image.Name)
+		def := imageConfig(&shared, pkg.Paths, image)
+		def.Nss = pkg.Nss || nss[i]
+		imageDir := filepath.Join(buildDir, image.Name)
+		err := CopyTree(sharedDir, filepath.Join(imageDir, rootfs), def.Paths, def.Excludes, def.Nss, true, true)
+		if err != nil {
+			logrus.Errorf("Failed to copy files for %v: %v", image.Name, err)
+			return nil, nil, err
+		}
+		if err := overlayPlatform(buildOpts, path, imageDir, def, platform); err != nil {
+			return nil, nil, err
+		}
+		defs = append(defs, def)
+	}
+	return defs, packages, nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestBuildImages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smith-test-")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+	base := filepath.Join(dir, "base.tar.gz")
+	buildTestImage(t, filepath.Join(dir, "base"), "config", base)
+
+	projectDir := filepath.Join(dir, "project")
+	if err := os.MkdirAll(projectDir, 0755); err != nil {
+		t.Fatalf("%v", err)
+	}
+	data := `package: ` + base + `
+images:
+- name: server
+  paths: [/etc/config]
+  cmd: [/server]
+- name: data
+  output: out/data-image.tar.gz
+  paths: [/data]
+`
+	if err := ioutil.WriteFile(filepath.Join(projectDir, "smith.yaml"), []byte(data), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+	buildOpts := &buildOptions{conf: "smith.yaml", dir: projectDir, noCache: true}
+	if !buildContainer(filepath.Join(dir, "image.tar.gz"), buildOpts) {
+		t.Fatalf("buildContainer failed")
+	}
+
+	expected := map[string]string{
+		filepath.Join(dir, "server.tar.gz"):            "/etc/config",
+		filepath.Join(dir, "out", "data-image.tar.gz"): "/data",
+	}
+	for out, path := range expected {
+		image, err := imageFromFile(out, nil)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		defer image.Close()
+		files, err := mergedFiles(image, false)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if _, ok := files[path]; !ok {
+			t.Errorf("%v is missing %v", out, path)
+		}
+		for _, other := range expected {
+			if _, ok := files[other]; ok && other != path {
+				t.Errorf("%v contains %v of another image", out, other)
+			}
+		}
+		if filepath.Base(out) == "server.tar.gz" && !reflect.DeepEqual(image.Config.Config.Cmd, []string{"/server"}) {
+			t.Errorf("%v has cmd %v", out, image.Config.Config.Cmd)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "image.tar.gz")); err == nil {
+		t.Errorf("Default image was written for a config with images")
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	gdigest "github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// inspectOutput is everything smith knows about an image.
+type inspectOutput struct {
+	Name   string         `json:"name"`
+	Index  *v1.Index      `json:"index,omitempty"`
+	Images []inspectImage `json:"images"`
+}
+
+// inspectImage describes the image for one platform.
+type inspectImage struct {
+	Platform    *v1.Platform      `json:"platform,omitempty"`
+	Digest      gdigest.Digest    `json:"digest"`
+	MediaType   string            `json:"mediaType"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Manifest    v1.Manifest       `json:"manifest"`
+	Config      v1.Image          `json:"config"`
+	Spec        json.RawMessage   `json:"spec,omitempty"`
+	Packages    []string          `json:"packages,omitempty"`
+}
+
+// inspectDescriptors reads the manifest and config for each of descs. Image
+// indexes are expanded into the manifests they contain.
+func inspectDescriptors(getManifest, getBlob Extractor, descs []v1.Descriptor, depth int) ([]inspectImage, error) {
+	if depth > maxIndexDepth {
+		return nil, fmt.Errorf("image indexes are nested too deeply")
+	}
+	images := []inspectImage{}
+	for _, defn := range descs {
+		data, err := getManifest(defn.Digest)
+		if err != nil {
+			return nil, err
+		}
+		if digest(data) != defn.Digest {
+			return nil, fmt.Errorf("manifest %s does not match its digest", defn.Digest)
+		}
+		if defn.MediaType == indexMT || defn.MediaType == dockerListMT {
+			var index v1.Index
+			if err := json.Unmarshal(data, &index); err != nil {
+				return nil, fmt.Errorf("error unmarshaling index %s: %v", defn.Digest, err)
+			}
+			children, err := inspectDescriptors(getManifest, getBlob, index.Manifests, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			images = append(images, children...)
+			continue
+		}
+		image := inspectImage{
+			Platform:    defn.Platform,
+			Digest:      defn.Digest,
+			MediaType:   defn.MediaType,
+			Annotations: defn.Annotations,
+		}
+		if err := json.Unmarshal(data, &image.Manifest); err != nil {
+			return nil, fmt.Errorf("error unmarshaling manifest %s: %v", defn.Digest, err)
+		}
+		configData, err := getBlob(image.Manifest.Config.Digest)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(configData, &image.Config); err != nil {
+			return nil, fmt.Errorf("error unmarshaling config %s: %v", image.Manifest.Config.Digest, err)
+		}
+		images = append(images, image)
+	}
+	return images, nil
+}
+
+// inspectFile inspects the image named by path in the form
+// file.tar.gz[:name].
+func inspectFile(path string) (*inspectOutput, error) {
+	tarpath, name := splitRef(path)
+	e, err := openLayoutEditor(tarpath)
+	if err != nil {
+		return nil, err
+	}
+	defer e.Close()
+	descs := e.refs(name)
+	if len(descs) == 0 {
+		return nil, fmt.Errorf("unable to locate image named %s in index", name)
+	}
+	extract := e.layout.Extractor()
+	images, err := inspectDescriptors(extract, extract, descs, 0)
+	if err != nil {
+		return nil, err
+	}
+	// find the extra blobs smith linked to the manifest of each image
+	for i := range images {
+		image := &images[i]
+		for _, defn := range e.index.Manifests {
+			if isImageEntry(defn) || defn.Annotations[manifestAnnotation] != string(image.Digest) {
+				continue
+			}
+			switch defn.MediaType {
+			case specMT:
+				image.Spec, err = extract(defn.Digest)
+			case packagesMT:
+				var data []byte
+				data, err = extract(defn.Digest)
+				if len(data) != 0 {
+					image.Packages = strings.Split(string(data), "\n")
+				}
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &inspectOutput{Name: path, Index: e.index, Images: images}, nil
+}
+
+// inspectRemote inspects the image at the tag in info. Registries don't
+// store the extra blobs, so only the index, manifests and configs are shown.
+func inspectRemote(r *RegistryClient, info *RepoInfo) (*inspectOutput, error) {
+	data, err := r.GetObject(info, path.Join("manifests", info.Tag))
+	if err != nil {
+		return nil, err
+	}
+	var m manifestOrIndex
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("error unmarshaling image manifest")
+	}
+	output := &inspectOutput{Name: info.String()}
+	mt := m.MediaType
+	if mt == "" {
+		mt = manifestMT
+		if m.Config == nil && len(m.Manifests) != 0 {
+			mt = indexMT
+		}
+	}
+	top := desc(mt, data, digest(data))
+	getManifest := func(d gdigest.Digest) ([]byte, error) {
+		if d == top.Digest {
+			return data, nil
+		}
+		return r.GetObject(info, path.Join("manifests", string(d)))
+	}
+	getBlob := func(d gdigest.Digest) ([]byte, error) {
+		return r.GetObject(info, path.Join("blobs", string(d)))
+	}
+	if mt == indexMT || mt == dockerListMT {
+		output.Index = &v1.Index{}
+		if err := json.Unmarshal(data, output.Index); err != nil {
+			return nil, fmt.Errorf("error unmarshaling index: %v", err)
+		}
+	}
+	output.Images, err = inspectDescriptors(getManifest, getBlob, []v1.Descriptor{top}, 0)
+	if err != nil {
+		return nil, err
+	}
+	return output, nil
+}
+
+func printList(w io.Writer, title string, items []string) {
+	if len(items) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "  %s:\n", title)
+	for _, item := range items {
+		fmt.Fprintf(w, "    %s\n", item)
+	}
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// printInspect writes a human readable description of output to w.
+func printInspect(w io.Writer, output *inspectOutput) {
+	fmt.Fprintf(w, "Image: %s\n", output.Name)
+	if output.Index != nil {
+		fmt.Fprintf(w, "Index:\n")
+		for _, defn := range output.Index.Manifests {
+			platform := ""
+			if defn.Platform != nil {
+				platform = platformString(*defn.Platform)
+			}
+			fmt.Fprintf(w, "  %s %s %s %s\n", defn.Digest, defn.MediaType,
+				defn.Annotations[v1.AnnotationRefName], platform)
+		}
+	}
+	for _, image := range output.Images {
+		platform := fmt.Sprintf("%s/%s", image.Config.OS, image.Config.Architecture)
+		if image.Platform != nil {
+			platform = platformString(*image.Platform)
+		}
+		fmt.Fprintf(w, "\nPlatform: %s\n", platform)
+		fmt.Fprintf(w, "  Manifest: %s (%s)\n", image.Digest, image.MediaType)
+		fmt.Fprintf(w, "  Config: %s\n", image.Manifest.Config.Digest)
+		if image.Config.Created != nil {
+			fmt.Fprintf(w, "  Created: %s\n", image.Config.Created)
+		}
+		annotations := []string{}
+		for _, k := range sortedKeys(image.Annotations) {
+			annotations = append(annotations, k+": "+image.Annotations[k])
+		}
+		printList(w, "Annotations", annotations)
+		c := image.Config.Config
+		if c.User != "" {
+			fmt.Fprintf(w, "  User: %s\n", c.User)
+		}
+		if c.WorkingDir != "" {
+			fmt.Fprintf(w, "  WorkingDir: %s\n", c.WorkingDir)
+		}
+		printList(w, "Entrypoint", c.Entrypoint)
+		printList(w, "Cmd", c.Cmd)
+		printList(w, "Env", c.Env)
+		ports := []string{}
+		for port := range c.ExposedPorts {
+			ports = append(ports, port)
+		}
+		sort.Strings(ports)
+		printList(w, "Ports", ports)
+		volumes := []string{}
+		for volume := range c.Volumes {
+			volumes = append(volumes, volume)
+		}
+		sort.Strings(volumes)
+		printList(w, "Volumes", volumes)
+		labels := []string{}
+		for _, k := range sortedKeys(c.Labels) {
+			labels = append(labels, k+"="+c.Labels[k])
+		}
+		printList(w, "Labels", labels)
+		layers := []string{}
+		for i, l := range image.Manifest.Layers {
+			layer := fmt.Sprintf("%s %d bytes", l.Digest, l.Size)
+			if i < len(image.Config.RootFS.DiffIDs) {
+				layer += fmt.Sprintf(" (diff %s)", image.Config.RootFS.DiffIDs[i])
+			}
+			layers = append(layers, layer)
+		}
+		printList(w, "Layers", layers)
+		printList(w, "Packages", image.Packages)
+		if len(image.Spec) != 0 {
+			var spec interface{}
+			if err := json.Unmarshal(image.Spec, &spec); err == nil {
+				if data, err := json.MarshalIndent(spec, "    ", "  "); err == nil {
+					fmt.Fprintf(w, "  Spec:\n    %s\n", data)
+				}
+			}
+		}
+	}
+}
+
+func inspectContainer(inName, remote string, insecure, jsonOutput bool) bool {
+	var output *inspectOutput
+	var err error
+	if remote != "" {
+		info, err := parseRepoInfo(remote, false)
+		if err != nil {
+			logrus.Errorf("Failed to parse repo info: %v", err)
+			return false
+		}
+		output, err = inspectRemote(NewRegistryClient(insecure), info)
+		if err != nil {
+			logrus.Errorf("Failed to inspect %s: %v", info, err)
+			return false
+		}
+	} else {
+		output, err = inspectFile(inName)
+		if err != nil {
+			logrus.Errorf("Failed to inspect %s: %v", inName, err)
+			return false
+		}
+	}
+	if !jsonOutput {
+		printInspect(os.Stdout, output)
+		return true
+	}
+	data, err := json.MarshalIndent(output, "", "  ")
+	if err != nil {
+		logrus.Errorf("Failed to marshal output: %v", err)
+		return false
+	}
+	fmt.Println(string(data))
+	return true
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestInspect(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smith-test-")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+	outpath := writeTestLayout(t, dir, "app", `{"cmd": ["/bin/app"]}`, "7")
+
+	output, err := inspectFile(outpath)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(output.Images) != 1 {
+		t.Fatalf("Wrong number of images: %d", len(output.Images))
+	}
+	image := output.Images[0]
+	if image.Annotations[buildAnnotation] != "7" {
+		t.Fatalf("Build annotation missing: %v", image.Annotations)
+	}
+	if string(image.Spec) != `{"cmd": ["/bin/app"]}` {
+		t.Fatalf("Spec not found: %s", image.Spec)
+	}
+	if len(image.Manifest.Layers) != 1 || len(image.Config.RootFS.DiffIDs) != 1 {
+		t.Fatalf("Layers not found")
+	}
+	var buf bytes.Buffer
+	printInspect(&buf, output)
+	if !strings.Contains(buf.String(), string(image.Manifest.Layers[0].Digest)) {
+		t.Fatalf("Layer missing from output:\n%s", buf.String())
+	}
+
+	// reproducible builds have no build number
+	unnumbered := writeTestLayout(t, dir, "unnumbered", "spec", "")
+	reproducible, err := inspectFile(unnumbered)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if string(reproducible.Images[0].Spec) != "spec" {
+		t.Fatalf("Spec of image without a build number not found: %s", reproducible.Images[0].Spec)
+	}
+
+	registry := newFakeRegistry()
+	server := httptest.NewServer(registry)
+	defer server.Close()
+	info, err := parseRepoInfo(server.URL+"/test/repo", false)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	loaded, err := imageFromFile(outpath, nil)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer loaded.Close()
+	r := NewRegistryClient(false)
+	if err := r.ImagesToRepo(info, []*Image{loaded}, nil); err != nil {
+		t.Fatalf("%v", err)
+	}
+	output, err = inspectRemote(r, info)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if output.Index == nil || len(output.Images) != 1 {
+		t.Fatalf("Remote index was not expanded")
+	}
+	if output.Images[0].Manifest.Layers[0].Digest != image.Manifest.Layers[0].Digest {
+		t.Fatalf("Remote layers don't match")
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	packageLayer = "package"
+	overlayLayer = "overlay"
+	layersDir    = "layers"
+)
+
+// layerOrder returns the layers of def in order. The package and overlay
+// layers come first if they aren't listed explicitly.
+func layerOrder(def *ConfigDef) []LayerDef {
+	hasPackage, hasOverlay := false, false
+	for _, layer := range def.Layers {
+		switch layer.Name {
+		case packageLayer:
+			hasPackage = true
+		case overlayLayer:
+			hasOverlay = true
+		}
+	}
+	layers := []LayerDef{}
+	if !hasPackage {
+		layers = append(layers, LayerDef{Name: packageLayer})
+	}
+	if !hasOverlay {
+		layers = append(layers, LayerDef{Name: overlayLayer})
+	}
+	return append(layers, def.Layers...)
+}
+
+// validateLayers checks that the layers in def have unique names and that
+// only the groups have paths.
+func validateLayers(def *ConfigDef) error {
+	seen := map[string]struct{}{}
+	for _, layer := range def.Layers {
+		if layer.Name == "" || strings.ContainsAny(layer.Name, `/\`) || layer.Name[0] == '.' {
+			return fmt.Errorf("invalid layer name %q", layer.Name)
+		}
+		if _, ok := seen[layer.Name]; ok {
+			return fmt.Errorf("layer %s is listed more than once", layer.Name)
+		}
+		seen[layer.Name] = struct{}{}
+		special := layer.Name == packageLayer || layer.Name == overlayLayer
+		if special && len(layer.Paths) != 0 {
+			return fmt.Errorf("layer %s can't have paths", layer.Name)
+		}
+		if !special && len(layer.Paths) == 0 {
+			return fmt.Errorf("layer %s has no paths", layer.Name)
+		}
+	}
+	return nil
+}
+
+// layerGroup returns the name of the first group in layers with a path
+// matching p or one of its parents.
+func layerGroup(layers []LayerDef, p string) string {
+	for _, layer := range layers {
+		for _, glob := range layer.Paths {
+			glob = filepath.Clean("/" + glob)
+			for dir := p; ; dir = filepath.Dir(dir) {
+				if ok, _ := filepath.Match(glob, dir); ok {
+					return layer.Name
+				}
+				if dir == "/" {
+					break
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// ensureParents creates the parent directories of rel in dir with the
+// modes they have below srcDir.
+func ensureParents(srcDir, dir, rel string) error {
+	parent := filepath.Dir(rel)
+	if parent == "." {
+		return nil
+	}
+	if _, err := os.Lstat(filepath.Join(dir, parent)); err == nil {
+		return nil
+	}
+	if err := ensureParents(srcDir, dir, parent); err != nil {
+		return err
+	}
+	info, err := os.Lstat(filepath.Join(srcDir, parent))
+	if err != nil {
+		return err
+	}
+	return os.Mkdir(filepath.Join(dir, parent), info.Mode().Perm())
+}
+
+// splitLayers moves the files in the rootfs of buildDir into a directory
+// per layer below buildDir/layers. Files in the rootfs and templates dirs of
+// projectDir belong to the overlay layer unless a group claims them.
+func splitLayers(def *ConfigDef, projectDir, buildDir string) error {
+	if len(def.Layers) == 0 {
+		return nil
+	}
+	overlay := map[string]struct{}{}
+	for _, name := range []string{rootfs, templatesDir} {
+		overlayDir := filepath.Join(projectDir, name)
+		if _, err := os.Stat(overlayDir); err != nil {
+			continue
+		}
+		err := filepath.Walk(overlayDir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(overlayDir, path)
+			if err != nil {
+				return err
+			}
+			overlay[rel] = struct{}{}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	layers := layerOrder(def)
+	srcDir := filepath.Join(buildDir, rootfs)
+	for _, layer := range layers {
+		if err := os.MkdirAll(filepath.Join(buildDir, layersDir, layer.Name), 0755); err != nil {
+			return err
+		}
+	}
+	return filepath.Walk(srcDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(srcDir, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		name := layerGroup(layers, "/"+rel)
+		if name == "" {
+			name = packageLayer
+			if _, ok := overlay[rel]; ok {
+				name = overlayLayer
+			}
+		}
+		dir := filepath.Join(buildDir, layersDir, name)
+		if err := ensureParents(srcDir, dir, rel); err != nil {
+			return err
+		}
+		target := filepath.Join(dir, rel)
+		if info.IsDir() {
+			if _, err := os.Lstat(target); err == nil {
+				return os.Chmod(target, info.Mode().Perm())
+			}
+			return os.Mkdir(target, info.Mode().Perm())
+		}
+		logrus.Debugf("Adding %v to layer %v", rel, name)
+		return os.Rename(path, target)
+	})
+}
+
+// layerPaths returns the directories to create the layers of def from.
+// Layers without any files are skipped.
+func layerPaths(def *ConfigDef, baseDir string) []string {
+	if len(def.Layers) == 0 {
+		return []string{filepath.Join(baseDir, rootfs)}
+	}
+	paths := []string{}
+	for _, layer := range layerOrder(def) {
+		path := filepath.Join(baseDir, layersDir, layer.Name)
+		if dir, err := os.Open(path); err == nil {
+			names, _ := dir.Readdirnames(1)
+			dir.Close()
+			if len(names) != 0 {
+				paths = append(paths, path)
+			}
+		}
+	}
+	return paths
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// buildLayeredImage builds an image with a package file, a group of data
+// files and an overlay file with content.
+func buildLayeredImage(t *testing.T, dir, content string, def *ConfigDef) *Image {
+	project := filepath.Join(dir, "project")
+	buildDir := filepath.Join(dir, "build")
+	files := map[string]string{
+		filepath.Join(buildDir, rootfs, "usr/bin/tool"):           "tool",
+		filepath.Join(buildDir, rootfs, "usr/share/zoneinfo/UTC"): "utc",
+		filepath.Join(buildDir, rootfs, "etc/app.conf"):           content,
+		filepath.Join(project, rootfs, "etc/app.conf"):            content,
+	}
+	for path, data := range files {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	if err := splitLayers(def, project, buildDir); err != nil {
+		t.Fatalf("%v", err)
+	}
+	image, err := imageFromBuild(def, buildDir, hostPlatform(), false)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	return image
+}
+
+func layerFiles(t *testing.T, layer *Layer) string {
+	names := []string{}
+	err := walkLayer(layer, func(hdr *tar.Header, in io.Reader) error {
+		if hdr.Typeflag != tar.TypeDir {
+			names = append(names, hdr.Name)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	sort.Strings(names)
+	return strings.Join(names, " ")
+}
+
+func TestSplitLayers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smith-test-")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	def := &ConfigDef{Layers: []LayerDef{{Name: "zoneinfo", Paths: []string{"/usr/share/zone*"}}}}
+	if err := validateLayers(def); err != nil {
+		t.Fatalf("%v", err)
+	}
+	first := buildLayeredImage(t, filepath.Join(dir, "first"), "a", def)
+	expected := []string{"usr/bin/tool", "etc/app.conf", "usr/share/zoneinfo/UTC"}
+	if len(first.Layers) != len(expected) {
+		t.Fatalf("Image has %d layers, expected %d", len(first.Layers), len(expected))
+	}
+	for i, layer := range first.Layers {
+		if files := layerFiles(t, layer); files != expected[i] {
+			t.Fatalf("Layer %d contains %q, expected %q", i, files, expected[i])
+		}
+	}
+
+	// changing the overlay only changes its layer
+	second := buildLayeredImage(t, filepath.Join(dir, "second"), "b", def)
+	for i := range first.Layers {
+		same := first.Layers[i].Desc.Digest == second.Layers[i].Desc.Digest
+		if same != (i != 1) {
+			t.Fatalf("Layer %d changed: %v", i, !same)
+		}
+	}
+
+	for _, layers := range [][]LayerDef{
+		{{Name: "data"}},
+		{{Name: "overlay", Paths: []string{"/etc"}}},
+		{{Name: "a/b", Paths: []string{"/etc"}}},
+		{{Name: "data", Paths: []string{"/etc"}}, {Name: "data", Paths: []string{"/usr"}}},
+	} {
+		if err := validateLayers(&ConfigDef{Layers: layers}); err == nil {
+			t.Errorf("validateLayers(%v) succeeded, expected error", layers)
+		}
+	}
+}
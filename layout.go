@@ -0,0 +1,391 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/Sirupsen/logrus"
+	gdigest "github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Index reads the index.json of the layout.
+func (l *ociLayout) Index() (*v1.Index, error) {
+	refBlob, err := l.Blob("index.json")
+	if err != nil {
+		return nil, err
+	}
+	refb, err := readBlob(refBlob)
+	if err != nil {
+		return nil, err
+	}
+	var index v1.Index
+	if err := json.Unmarshal(refb, &index); err != nil {
+		return nil, fmt.Errorf("error unmarshaling index.json from %s", l.path)
+	}
+	return &index, nil
+}
+
+// layoutEditor holds an oci layout while named images are added to and
+// removed from it. Blobs copied from other layouts are kept until the layout
+// is written.
+type layoutEditor struct {
+	layout *ociLayout
+	index  *v1.Index
+	blobs  map[gdigest.Digest]Blob
+}
+
+func openLayoutEditor(path string) (*layoutEditor, error) {
+	layout, err := openLayout(path)
+	if err != nil {
+		return nil, err
+	}
+	index, err := layout.Index()
+	if err != nil {
+		layout.Close()
+		return nil, err
+	}
+	return &layoutEditor{layout, index, map[gdigest.Digest]Blob{}}, nil
+}
+
+// Close releases the layout. Blobs copied from other editors are only valid
+// until those are closed.
+func (e *layoutEditor) Close() error {
+	return e.layout.Close()
+}
+
+// blob returns the blob for digest from the layout or a copied layout.
+func (e *layoutEditor) blob(d gdigest.Digest) (Blob, error) {
+	if b, ok := e.blobs[d]; ok {
+		return b, nil
+	}
+	return e.layout.DigestBlob(d)
+}
+
+// isImageEntry returns true for index entries that refer to manifests or
+// indexes rather than the extra blobs smith stores in the index.
+func isImageEntry(defn v1.Descriptor) bool {
+	switch defn.MediaType {
+	case manifestMT, dockerManifestMT, indexMT, dockerListMT:
+		return true
+	}
+	return false
+}
+
+// names returns the names of the images in the layout in index order.
+func (e *layoutEditor) names() []string {
+	names := []string{}
+	seen := map[string]struct{}{}
+	for _, defn := range e.index.Manifests {
+		name, ok := defn.Annotations[v1.AnnotationRefName]
+		if !ok || !isImageEntry(defn) {
+			continue
+		}
+		if _, ok := seen[name]; ok {
+			continue
+		}
+		seen[name] = struct{}{}
+		names = append(names, name)
+	}
+	return names
+}
+
+// refs returns the manifest entries named name. There is one entry per
+// platform.
+func (e *layoutEditor) refs(name string) []v1.Descriptor {
+	descs := []v1.Descriptor{}
+	for _, defn := range e.index.Manifests {
+		if isImageEntry(defn) && defn.Annotations[v1.AnnotationRefName] == name {
+			descs = append(descs, defn)
+		}
+	}
+	return descs
+}
+
+// remove deletes the images named name along with the extra blobs linked
+// to their manifests if no other image uses them. It returns false if there
+// was no image with the name.
+func (e *layoutEditor) remove(name string) bool {
+	manifests := []v1.Descriptor{}
+	found := false
+	for _, defn := range e.index.Manifests {
+		if isImageEntry(defn) && defn.Annotations[v1.AnnotationRefName] == name {
+			found = true
+			continue
+		}
+		manifests = append(manifests, defn)
+	}
+	images := map[string]struct{}{}
+	for _, defn := range manifests {
+		if isImageEntry(defn) {
+			images[string(defn.Digest)] = struct{}{}
+		}
+	}
+	e.index.Manifests = []v1.Descriptor{}
+	for _, defn := range manifests {
+		if !isImageEntry(defn) {
+			if _, ok := images[defn.Annotations[manifestAnnotation]]; !ok {
+				continue
+			}
+		}
+		e.index.Manifests = append(e.index.Manifests, defn)
+	}
+	return found
+}
+
+// add copies the images named srcName from src into the layout as name,
+// replacing any existing images with that name. The extra blobs linked to
+// their manifests are copied as well.
+func (e *layoutEditor) add(name string, src *layoutEditor, srcName string) error {
+	descs := src.refs(srcName)
+	if len(descs) == 0 {
+		return fmt.Errorf("unable to locate image named %s in %s", srcName, src.layout.path)
+	}
+	images := map[string]struct{}{}
+	for _, defn := range descs {
+		images[string(defn.Digest)] = struct{}{}
+	}
+	for _, defn := range src.index.Manifests {
+		if isImageEntry(defn) {
+			continue
+		}
+		if _, ok := images[defn.Annotations[manifestAnnotation]]; ok {
+			descs = append(descs, defn)
+		}
+	}
+	// collect the blobs from src before changing the index
+	for _, defn := range descs {
+		err := walkBlobs(src.blob, defn, func(d gdigest.Digest, b Blob) {
+			e.blobs[d] = b
+		})
+		if err != nil {
+			return err
+		}
+	}
+	e.remove(name)
+	existing := map[string]struct{}{}
+	for _, defn := range e.index.Manifests {
+		if !isImageEntry(defn) {
+			existing[extraBlobKey(defn)] = struct{}{}
+		}
+	}
+	for _, defn := range descs {
+		if isImageEntry(defn) {
+			defn.Annotations = copyAnnotations(defn.Annotations)
+			defn.Annotations[v1.AnnotationRefName] = name
+		} else if _, ok := existing[extraBlobKey(defn)]; ok {
+			continue
+		}
+		e.index.Manifests = append(e.index.Manifests, defn)
+	}
+	return nil
+}
+
+func copyAnnotations(annotations map[string]string) map[string]string {
+	result := map[string]string{}
+	for k, v := range annotations {
+		result[k] = v
+	}
+	return result
+}
+
+// walkBlobs calls visit for the blob of defn and, for manifests and indexes,
+// for every blob they reference.
+func walkBlobs(get func(gdigest.Digest) (Blob, error), defn v1.Descriptor, visit func(gdigest.Digest, Blob)) error {
+	b, err := get(defn.Digest)
+	if err != nil {
+		return err
+	}
+	visit(defn.Digest, b)
+	children := []v1.Descriptor{}
+	switch defn.MediaType {
+	case manifestMT, dockerManifestMT:
+		data, err := readBlob(b)
+		if err != nil {
+			return err
+		}
+		var manifest v1.Manifest
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			return fmt.Errorf("error unmarshaling manifest %s: %v", defn.Digest, err)
+		}
+		children = append([]v1.Descriptor{manifest.Config}, manifest.Layers...)
+	case indexMT, dockerListMT:
+		data, err := readBlob(b)
+		if err != nil {
+			return err
+		}
+		var index v1.Index
+		if err := json.Unmarshal(data, &index); err != nil {
+			return fmt.Errorf("error unmarshaling index %s: %v", defn.Digest, err)
+		}
+		children = index.Manifests
+	}
+	for _, child := range children {
+		if err := walkBlobs(get, child, visit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// write replaces the layout file with the edited layout. Blobs that are no
+// longer referenced are dropped.
+func (e *layoutEditor) write() error {
+	fileData := map[string]Blob{}
+	for _, defn := range e.index.Manifests {
+		err := walkBlobs(e.blob, defn, func(d gdigest.Digest, b Blob) {
+			parts := append([]string{"blobs"}, string(d.Algorithm()), d.Hex())
+			fileData[filepath.Join(parts...)] = b
+		})
+		if err != nil {
+			return err
+		}
+	}
+	path := e.layout.path
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".smith-layout-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	gzipOut, err := MaybeGzipWriter(tmp, false)
+	if err != nil {
+		return err
+	}
+	tarOut := tar.NewWriter(gzipOut)
+	if err := writeLayoutTar(tarOut, fileData, *e.index); err != nil {
+		gzipOut.Close()
+		return err
+	}
+	if err := tarOut.Close(); err != nil {
+		gzipOut.Close()
+		return err
+	}
+	// explicitly close the gzip so we wait for the write to complete
+	if err := gzipOut.Close(); err != nil {
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// splitRef splits a path in the form file.tar.gz[:name] into the file and
+// the name, which defaults to latest.
+func splitRef(path string) (string, string) {
+	parts := strings.SplitN(path, ":", 2)
+	if len(parts) == 1 {
+		return parts[0], "latest"
+	}
+	return parts[0], parts[1]
+}
+
+func listLayout(path string) bool {
+	e, err := openLayoutEditor(path)
+	if err != nil {
+		logrus.Errorf("Failed to open %s: %v", path, err)
+		return false
+	}
+	defer e.Close()
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tPLATFORM\tDIGEST\tBUILD\tCREATED")
+	for _, name := range e.names() {
+		for _, defn := range e.refs(name) {
+			platform := ""
+			if defn.Platform != nil {
+				platform = platformString(*defn.Platform)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", name, platform, defn.Digest,
+				defn.Annotations[buildAnnotation], defn.Annotations[v1.AnnotationCreated])
+		}
+	}
+	w.Flush()
+	return true
+}
+
+func addToLayout(path, src, name string) bool {
+	e, err := openLayoutEditor(path)
+	if err != nil {
+		logrus.Errorf("Failed to open %s: %v", path, err)
+		return false
+	}
+	defer e.Close()
+	srcPath, srcName := splitRef(src)
+	if name == "" {
+		name = srcName
+	}
+	if !tagPattern.MatchString(name) {
+		logrus.Errorf("Invalid image name '%s'", name)
+		return false
+	}
+	srcEditor, err := openLayoutEditor(srcPath)
+	if err != nil {
+		logrus.Errorf("Failed to open %s: %v", srcPath, err)
+		return false
+	}
+	defer srcEditor.Close()
+	if err := e.add(name, srcEditor, srcName); err != nil {
+		logrus.Errorf("Failed to add %s: %v", src, err)
+		return false
+	}
+	if err := e.write(); err != nil {
+		logrus.Errorf("Failed to write %s: %v", path, err)
+		return false
+	}
+	logrus.Infof("Added %s to %s as %s", src, path, name)
+	return true
+}
+
+func removeFromLayout(path string, names []string) bool {
+	e, err := openLayoutEditor(path)
+	if err != nil {
+		logrus.Errorf("Failed to open %s: %v", path, err)
+		return false
+	}
+	defer e.Close()
+	for _, name := range names {
+		if !e.remove(name) {
+			logrus.Errorf("Unable to locate image named %s in %s", name, path)
+			return false
+		}
+	}
+	if err := e.write(); err != nil {
+		logrus.Errorf("Failed to write %s: %v", path, err)
+		return false
+	}
+	logrus.Infof("Removed %s from %s", strings.Join(names, ", "), path)
+	return true
+}
+
+func tagInLayout(path, src, dst string, move bool) bool {
+	e, err := openLayoutEditor(path)
+	if err != nil {
+		logrus.Errorf("Failed to open %s: %v", path, err)
+		return false
+	}
+	defer e.Close()
+	if !tagPattern.MatchString(dst) {
+		logrus.Errorf("Invalid image name '%s'", dst)
+		return false
+	}
+	if err := e.add(dst, e, src); err != nil {
+		logrus.Errorf("Failed to tag %s: %v", src, err)
+		return false
+	}
+	if move && src != dst {
+		e.remove(src)
+	}
+	if err := e.write(); err != nil {
+		logrus.Errorf("Failed to write %s: %v", path, err)
+		return false
+	}
+	logrus.Infof("Tagged %s as %s in %s", src, dst, path)
+	return true
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func writeTestLayout(t *testing.T, dir, name, content, buildno string) string {
+	buildDir := filepath.Join(dir, name)
+	if err := os.MkdirAll(filepath.Join(buildDir, rootfs), 0755); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(buildDir, rootfs, "data"), []byte(content), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+	image, err := imageFromBuild(&ConfigDef{}, buildDir, hostPlatform(), false)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	image.Metadata = getMetadata()
+	image.Metadata.Buildno = buildno
+	image.AdditionalBlobs = []OpaqueBlob{{specMT, []byte(content)}}
+	outpath := filepath.Join(dir, name+".tar.gz")
+	if err := WriteOciTarGz([]*Image{image}, outpath, false); err != nil {
+		t.Fatalf("%v", err)
+	}
+	return outpath
+}
+
+func TestLayoutEditing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smith-test-")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+	app := writeTestLayout(t, dir, "app", "app", "1")
+	// reproducible builds have no build number
+	debug := writeTestLayout(t, dir, "debug", "debug", "")
+
+	if !addToLayout(app, debug, "app-debug") {
+		t.Fatalf("Failed to add image")
+	}
+	e, err := openLayoutEditor(app)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if blobs := len(e.index.Manifests) - len(e.refs("app-debug")) - len(e.refs("latest")); blobs != 2 {
+		t.Fatalf("Extra blob was not copied, %d extra blobs", blobs)
+	}
+	e.Close()
+	if !tagInLayout(app, "app-debug", "app-test", false) {
+		t.Fatalf("Failed to tag image")
+	}
+	if !tagInLayout(app, "latest", "app", true) {
+		t.Fatalf("Failed to move image")
+	}
+	e, err = openLayoutEditor(app)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer e.Close()
+	if names := strings.Join(e.names(), " "); names != "app-debug app-test app" {
+		t.Fatalf("Wrong names in layout: %s", names)
+	}
+	for _, name := range []string{"app", "app-debug", "app-test"} {
+		image, err := imageFromFile(app+":"+name, nil)
+		if err != nil {
+			t.Fatalf("Failed to load %s: %v", name, err)
+		}
+		image.Close()
+	}
+
+	if !removeFromLayout(app, []string{"app-debug", "app-test"}) {
+		t.Fatalf("Failed to remove images")
+	}
+	e, err = openLayoutEditor(app)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer e.Close()
+	if names := strings.Join(e.names(), " "); names != "app" {
+		t.Fatalf("Wrong names in layout after remove: %s", names)
+	}
+	// the extra blob of the removed image and its layer should be gone
+	blobs := 0
+	for _, defn := range e.index.Manifests {
+		if !isImageEntry(defn) {
+			blobs++
+			if defn.Annotations[manifestAnnotation] != string(e.refs("app")[0].Digest) {
+				t.Fatalf("Blob from removed image was kept")
+			}
+		}
+	}
+	if blobs != 1 {
+		t.Fatalf("Wrong number of extra blobs: %d", blobs)
+	}
+	image, err := imageFromFile(debug, nil)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer image.Close()
+	if _, err := e.layout.DigestBlob(image.Layers[0].Desc.Digest); err == nil {
+		t.Fatalf("Layer of removed image was kept")
+	}
+	if e.refs("app")[0].Annotations[v1.AnnotationRefName] != "app" {
+		t.Fatalf("Image was not renamed")
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// tarFormat returns the compression of a tarball from its name.
+func tarFormat(name string) string {
+	for suffix, format := range map[string]string{
+		".tar.gz":  "gzip",
+		".tgz":     "gzip",
+		".tar.bz2": "bzip2",
+		".tbz2":    "bzip2",
+		".tar.xz":  "xz",
+		".txz":     "xz",
+		".tar.zst": "zstd",
+	} {
+		if strings.HasSuffix(name, suffix) {
+			return format
+		}
+	}
+	return ""
+}
+
+// unpackLocal extracts the tarball at path into a new directory. The
+// returned function removes it.
+func unpackLocal(path string) (string, func(), error) {
+	root, err := ioutil.TempDir("", "smith-tar-")
+	if err != nil {
+		return "", nil, err
+	}
+	release := func() {
+		makeWritable(root)
+		if err := os.RemoveAll(root); err != nil {
+			logrus.Warnf("Failed to remove %v: %v", root, err)
+		}
+	}
+	err = func() error {
+		// the root is the chroot, so it must be traversable
+		if err := os.Chmod(root, 0755); err != nil {
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r, err := decompressReader(f, tarFormat(path))
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		tree := newTreeExtractor(root)
+		if _, err := extractTar(r, tree); err != nil {
+			return err
+		}
+		return tree.finish()
+	}()
+	if err != nil {
+		release()
+		return "", nil, err
+	}
+	return root, release, nil
+}
+
+// buildLocal copies the paths of pkg and their dependencies out of the
+// local directory or tarball named by the package into outputDir.
+func buildLocal(buildOpts *buildOptions, outputDir string, pkg *ConfigDef, platform v1.Platform) error {
+	root, err := filepath.Abs(pkg.Package)
+	if err != nil {
+		return err
+	}
+	if pkg.Type == "tar" {
+		var release func()
+		root, release, err = unpackLocal(root)
+		if err != nil {
+			return err
+		}
+		defer release()
+	}
+
+	path, preload := chrootEnv(pkg.Env)
+	executor := chrootExecutor(root, path)
+	if err := SetSoPathsFromExecutor(executor, preload); err != nil {
+		return err
+	}
+
+	return CopyTree(root, outputDir, pkg.Paths, pkg.Excludes, pkg.Nss, true, true)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBuildLocal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smith-test-")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	sysroot := filepath.Join(dir, "sysroot")
+	files := map[string]string{"./usr/bin/app": "app", "./usr/share/app/data": "data"}
+	for name, content := range files {
+		path := filepath.Join(sysroot, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0755); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	if err := os.Symlink("app", filepath.Join(sysroot, "usr/bin/link")); err != nil {
+		t.Fatalf("%v", err)
+	}
+	tarball := filepath.Join(dir, "sysroot.tar.gz")
+	if err := ioutil.WriteFile(tarball, testTarGz(files, true), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	tests := []struct {
+		typ, pkg string
+		paths    []string
+		expected map[string]string
+	}{
+		{"dir", sysroot, []string{"/usr/bin/link", "/usr/share/app"},
+			map[string]string{"usr/bin/app": "app", "usr/share/app/data": "data"}},
+		{"tar", tarball, []string{"/usr/bin/app"},
+			map[string]string{"usr/bin/app": "app"}},
+	}
+	for _, test := range tests {
+		pkg := &ConfigDef{Type: test.typ, Package: test.pkg, Paths: test.paths}
+		outputDir := filepath.Join(dir, test.typ)
+		if err := buildLocal(&buildOptions{}, outputDir, pkg, hostPlatform()); err != nil {
+			t.Fatalf("%s: %v", test.typ, err)
+		}
+		for path, content := range test.expected {
+			data, err := ioutil.ReadFile(filepath.Join(outputDir, path))
+			if err != nil || string(data) != content {
+				t.Fatalf("%s: unexpected content of %v: %q %v", test.typ, path, data, err)
+			}
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "tar", "usr/share")); !os.IsNotExist(err) {
+		t.Fatalf("Unlisted path was copied from the tarball")
+	}
+	if _, err := os.Stat(sysroot); err != nil {
+		t.Fatalf("Local directory was removed: %v", err)
+	}
+}
@@ -1,20 +1,31 @@
 package main
 
 import (
+	"fmt"
 	"io/ioutil"
+	"net/http"
 	"path/filepath"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/oracle/smith/execute"
 
 	"github.com/Sirupsen/logrus"
+	gdigest "github.com/opencontainers/go-digest"
 )
 
 const (
 	MOCK    = "/usr/bin/mock"
 	SITE    = "/etc/mock/site-defaults.cfg"
 	BASEDIR = "/var/lib/mock"
+	// CONFDIR is where mock looks for relative includes
+	CONFDIR = "/etc/mock"
+)
+
+var (
+	mockIncludePattern = regexp.MustCompile(`(?m)^\s*include\(\s*['"]([^'"]+)['"]\s*\)`)
+	mockOptPattern     = regexp.MustCompile(`(?m)^config_opts\['(target_arch|releasever)'\]\s*=\s*['"]([^'"]+)['"]`)
 )
 
 func MockBuildDebuginfo(pkgMfst *RPMManifest, mock *MockDef) (string, error) {
@@ -150,3 +161,126 @@ func getOutPath(config string) string {
 	}
 	return filepath.Join(basedir, string(rootMatch[1]))
 }
+
+// readMockConfig returns the mock config at path with the files it includes
+// inserted in place of their include statements.
+func readMockConfig(path string, stack map[string]bool) ([]byte, error) {
+	if stack[path] {
+		return nil, fmt.Errorf("%s is included in a cycle", path)
+	}
+	stack[path] = true
+	defer delete(stack, path)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	result := []byte{}
+	last := 0
+	for _, match := range mockIncludePattern.FindAllSubmatchIndex(data, -1) {
+		include := string(data[match[2]:match[3]])
+		if !filepath.IsAbs(include) {
+			include = filepath.Join(CONFDIR, include)
+		}
+		included, err := readMockConfig(include, stack)
+		if err != nil {
+			return nil, err
+		}
+		result = append(append(result, data[last:match[0]]...), included...)
+		last = match[1]
+	}
+	return append(result, data[last:]...), nil
+}
+
+// mockRepo is a repo in the yum or dnf config of a mock config.
+type mockRepo struct {
+	name    string
+	baseurl string
+	enabled bool
+}
+
+// mockRepos returns the repos in the mock config data with the variables
+// mock sets expanded in their baseurl.
+func mockRepos(data []byte) []*mockRepo {
+	vars := map[string]string{}
+	for _, match := range mockOptPattern.FindAllSubmatch(data, -1) {
+		vars[string(match[1])] = string(match[2])
+	}
+	vars["basearch"] = vars["target_arch"]
+	vars["arch"] = vars["target_arch"]
+	repos := []*mockRepo{}
+	var repo *mockRepo
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			repo = &mockRepo{name: line[1 : len(line)-1], enabled: true}
+			if repo.name != "main" {
+				repos = append(repos, repo)
+			}
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if repo == nil || len(parts) != 2 {
+			continue
+		}
+		// the last line of the config may close the python string
+		value := strings.TrimRight(strings.TrimSpace(parts[1]), `"'`)
+		switch strings.TrimSpace(parts[0]) {
+		case "baseurl":
+			urls := strings.Fields(strings.Replace(value, ",", " ", -1))
+			if len(urls) == 0 {
+				continue
+			}
+			repo.baseurl = urls[0]
+			for _, name := range []string{"basearch", "arch", "releasever"} {
+				if vars[name] == "" {
+					continue
+				}
+				repo.baseurl = strings.Replace(repo.baseurl, "${"+name+"}", vars[name], -1)
+				repo.baseurl = strings.Replace(repo.baseurl, "$"+name, vars[name], -1)
+			}
+		case "enabled":
+			repo.enabled = value != "0"
+		}
+	}
+	return repos
+}
+
+// mockRepoDigests returns the digests of the repomd.xml of the enabled repos
+// in the mock config data. Repos without a baseurl, like ones that only use
+// a mirrorlist or metalink, are an error because their metadata can't be
+// found without asking a mirror.
+func mockRepoDigests(data []byte) ([]gdigest.Digest, error) {
+	digests := []gdigest.Digest{}
+	for _, repo := range mockRepos(data) {
+		if !repo.enabled {
+			continue
+		}
+		if repo.baseurl == "" || strings.Contains(repo.baseurl, "$") {
+			return nil, fmt.Errorf("repo %s has no baseurl that smith can expand", repo.name)
+		}
+		repomd, err := readRepomd(repo.baseurl)
+		if err != nil {
+			return nil, fmt.Errorf("repo %s: %v", repo.name, err)
+		}
+		digests = append(digests, digest(repomd))
+	}
+	return digests, nil
+}
+
+// readRepomd reads the repomd.xml of the rpm repo at baseurl.
+func readRepomd(baseurl string) ([]byte, error) {
+	u := strings.TrimSuffix(baseurl, "/") + "/repodata/repomd.xml"
+	if strings.HasPrefix(u, "file://") || filepath.IsAbs(u) {
+		return ioutil.ReadFile(strings.TrimPrefix(u, "file://"))
+	}
+	client := http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("%s returned %d", u, resp.StatusCode)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
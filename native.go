@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// nativeType reads and installs the packages of a package manager that
+// smith replaces, so builds don't need it installed on the host.
+type nativeType struct {
+	ext       string // suffix of local package files
+	arches    func(platform v1.Platform) []string
+	compare   func(a, b string) int
+	readInfo  func(path string) (*pkgInfo, error)
+	repoIndex func(dir string) (string, error)
+	readRepo  func(dir string) ([]*pkgInfo, error)
+	install   func(path string, t *treeExtractor, ex executor, scripts bool) (*pkgInfo, error)
+
+	// unversioned provides satisfy versioned dependencies
+	unversioned bool
+}
+
+var nativeTypes = map[string]*nativeType{
+	"rpm": {
+		ext:       ".rpm",
+		arches:    rpmArch,
+		compare:   compareEVR,
+		readInfo:  readRpmInfo,
+		repoIndex: rpmRepoIndex,
+		readRepo:  readRpmRepo,
+		install:   installRpm,
+
+		unversioned: true,
+	},
+	"deb": {
+		ext:       ".deb",
+		arches:    debArch,
+		compare:   compareDebVersions,
+		readInfo:  readDebInfo,
+		repoIndex: debRepoIndex,
+		readRepo:  readDebRepo,
+		install:   installDeb,
+	},
+	"apk": {
+		ext:       ".apk",
+		arches:    apkArch,
+		compare:   compareApkVersions,
+		readInfo:  readApkInfo,
+		repoIndex: apkRepoIndex,
+		readRepo:  readApkRepo,
+		install:   installApk,
+	},
+}
+
+// nativeDef returns the settings of def for the native type typ.
+func nativeDef(def *ConfigDef, typ string) *NativeDef {
+	switch typ {
+	case "rpm":
+		return &def.Rpm
+	case "deb":
+		return &def.Deb
+	case "apk":
+		return &def.Apk
+	}
+	return nil
+}
+
+// nativePackages returns the names and local files to install for def.
+func nativePackages(def *ConfigDef) []string {
+	return append(strings.Fields(def.Package), nativeDef(def, def.Type).Deps...)
+}
+
+// nativeInputs returns the local package files and repo metadata that a
+// native install of def reads.
+func nativeInputs(def *ConfigDef) ([]string, error) {
+	nt := nativeTypes[def.Type]
+	files := []string{}
+	for _, name := range nativePackages(def) {
+		if strings.HasSuffix(name, nt.ext) {
+			files = append(files, name)
+		}
+	}
+	for _, repo := range nativeDef(def, def.Type).Repos {
+		index, err := nt.repoIndex(repo)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, index)
+	}
+	return files, nil
+}
+
+// nativeIndex indexes the packages in the repos of pkg and the local
+// package files among names. It returns the index and the packages to
+// install.
+func nativeIndex(nt *nativeType, def *NativeDef, platform v1.Platform, names []string) (*pkgIndex, []*pkgInfo, error) {
+	idx := newPkgIndex(nt.compare, nt.arches(platform), nt.unversioned)
+	for _, repo := range def.Repos {
+		pkgs, err := nt.readRepo(repo)
+		if err != nil {
+			return nil, nil, err
+		}
+		logrus.Debugf("Read %d packages from %v", len(pkgs), repo)
+		for _, p := range pkgs {
+			idx.add(p)
+		}
+	}
+	wanted := []*pkgInfo{}
+	for _, name := range names {
+		if !strings.HasSuffix(name, nt.ext) {
+			continue
+		}
+		p, err := nt.readInfo(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		idx.add(p)
+		wanted = append(wanted, p)
+	}
+	for _, name := range names {
+		if strings.HasSuffix(name, nt.ext) {
+			continue
+		}
+		pkgs, err := idx.lookup([]string{name})
+		if err != nil {
+			return nil, nil, err
+		}
+		wanted = append(wanted, pkgs...)
+	}
+	return idx, wanted, nil
+}
+
+// ownerPackages returns the sorted ids of the packages that own a file in
+// dir.
+func ownerPackages(dir string, pkgs []*pkgInfo) ([]string, error) {
+	owners := map[string]string{}
+	for _, p := range pkgs {
+		for _, file := range p.Files {
+			owners[filepath.Clean("/"+file)] = p.ID
+		}
+	}
+	found := map[string]struct{}{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if id, ok := owners["/"+rel]; ok {
+			found[id] = struct{}{}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return setKeys(found), nil
+}
+
+// buildNative installs the package and its dependencies from local package
+// files and repos into a build root without the package manager and copies
+// the paths of pkg into outputDir. It returns the installed packages that
+// own a copied file.
+func buildNative(buildOpts *buildOptions, outputDir string, pkg *ConfigDef, platform v1.Platform) ([]string, error) {
+	nt, ok := nativeTypes[pkg.Type]
+	if !ok {
+		return nil, fmt.Errorf("Package type %v not recognized", pkg.Type)
+	}
+	def := nativeDef(pkg, pkg.Type)
+	idx, wanted, err := nativeIndex(nt, def, platform, nativePackages(pkg))
+	if err != nil {
+		return nil, err
+	}
+	pkgs, err := idx.resolve(wanted)
+	if err != nil {
+		return nil, err
+	}
+
+	root, err := ioutil.TempDir("", "smith-"+pkg.Type+"-")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		makeWritable(root)
+		if err := os.RemoveAll(root); err != nil {
+			logrus.Warnf("Failed to remove %v: %v", root, err)
+		}
+	}()
+	// the build root is the chroot, so it must be traversable
+	if err := os.Chmod(root, 0755); err != nil {
+		return nil, err
+	}
+
+	executor := chrootExecutor(root, defaultChrootPath)
+	tree := newTreeExtractor(root)
+	installed := []*pkgInfo{}
+	for _, p := range pkgs {
+		logrus.Infof("Installing %v", p.ID)
+		info, err := nt.install(p.Path, tree, executor, def.Scripts)
+		if err != nil {
+			return nil, err
+		}
+		installed = append(installed, info)
+	}
+	if err := tree.finish(); err != nil {
+		return nil, err
+	}
+
+	if err := SetSoPathsFromExecutor(executor, nil); err != nil {
+		return nil, err
+	}
+	if err := readablePathsFromExecutor(executor, pkg.Paths); err != nil {
+		logrus.Warnf("Could not make paths readable: %v", err)
+	}
+	err = CopyTree(root, outputDir, pkg.Paths, pkg.Excludes, pkg.Nss, true, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return ownerPackages(outputDir, installed)
+}
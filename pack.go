@@ -10,7 +10,6 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
-	"runtime"
 	"sort"
 	"strings"
 	"time"
@@ -27,6 +26,13 @@ const (
 	dockerLayerMT    = "application/vnd.docker.image.rootfs.diff.tar.gzip"
 	dockerConfigMT   = "application/vnd.docker.container.image.v1+json"
 	dockerManifestMT = "application/vnd.docker.distribution.manifest.v2+json"
+	dockerListMT     = "application/vnd.docker.distribution.manifest.list.v2+json"
+	sourceAnnotation = "com.oracle.smith.source"
+	buildAnnotation  = "com.oracle.smith.build"
+	whiteoutPrefix   = ".wh."
+	opaqueWhiteout   = ".wh..wh..opq"
+	specMT           = "application/vnd.smith.spec+json"
+	packagesMT       = "application/vnd.smith.packages"
 	layerMT          = v1.MediaTypeImageLayerGzip
 	configMT         = v1.MediaTypeImageConfig
 	manifestMT       = v1.MediaTypeImageManifest
@@ -34,6 +40,9 @@ const (
 	manifestVersion  = 2
 )
 
+// manifestAnnotation links an extra blob to the manifest of its image.
+const manifestAnnotation = "com.oracle.smith.manifest"
+
 func tarWriteFunc(baseDir string, tarOut *tar.Writer, uid int, gid int) filepath.WalkFunc {
 	return func(path string, info os.FileInfo, err error) error {
 		if err != nil {
@@ -135,10 +144,33 @@ func writeFileTar(tarOut *tar.Writer, path string, b []byte) error {
 	return nil
 }
 
-func configFromDef(def *ConfigDef) *v1.Image {
+func writeBlobTar(tarOut *tar.Writer, path string, b Blob) error {
+	// basic header
+	header := new(tar.Header)
+	header.ModTime = time.Time{}
+	header.Typeflag = tar.TypeReg
+	header.Mode = 0644 | c_ISREG
+	header.Size = b.Size()
+	header.Name = path
+	logrus.Debugf("Adding file %v to archive", path)
+	if err := tarOut.WriteHeader(header); err != nil {
+		return err
+	}
+	in, err := b.Open()
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if _, err := io.Copy(tarOut, in); err != nil {
+		return err
+	}
+	return nil
+}
+
+func configFromDef(def *ConfigDef, platform v1.Platform) *v1.Image {
 	config := v1.Image{}
-	config.Architecture = "amd64"
-	config.OS = "linux"
+	config.Architecture = platform.Architecture
+	config.OS = platform.OS
 	config.Config.Entrypoint = def.Entrypoint
 	config.Config.Cmd = def.Cmd
 	config.Config.Env = def.Env
@@ -207,6 +239,36 @@ func serializeManifest(conf v1.Descriptor, layers []*Layer, docker bool) ([]byte
 	return data, nil
 }
 
+type maybeDockerIndex struct {
+	v1.Index
+	MediaType string `json:"mediaType,omitempty"`
+}
+
+// serializeIndex creates an oci index or a docker manifest list referencing
+// the manifests in entries.
+func serializeIndex(entries []v1.Descriptor, docker bool) ([]byte, error) {
+	index := maybeDockerIndex{}
+	index.SchemaVersion = manifestVersion
+	if docker {
+		index.MediaType = dockerListMT
+	}
+	for _, entry := range entries {
+		if docker {
+			entry.MediaType = dockerManifestMT
+		} else {
+			entry.MediaType = manifestMT
+		}
+		// annotations are not supported by docker manifest lists
+		entry.Annotations = nil
+		index.Manifests = append(index.Manifests, entry)
+	}
+	data, err := json.Marshal(index)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
 func digest(b []byte) gdigest.Digest {
 	return gdigest.FromBytes(b)
 }
@@ -225,11 +287,19 @@ func imageIndex(entries []v1.Descriptor, annotations map[string]string) v1.Index
 	return rv
 }
 
-func layerFromPath(path string, uid int, gid int) (*Layer, error) {
-	b := bytes.Buffer{}
+// layerFromPath creates a gzipped layer from the files in path. The layer is
+// written to a temporary file in blobDir while its digests are computed.
+// Compression is pinned for reproducible builds.
+func layerFromPath(path, blobDir string, uid int, gid int, reproducible bool) (*Layer, error) {
+	out, err := ioutil.TempFile(blobDir, "layer-")
+	if err != nil {
+		return nil, err
+	}
+	defer out.Close()
 	gzipHash := sha256.New()
 	tarHash := sha256.New()
-	gzipOut, err := MaybeGzipWriter(io.MultiWriter(&b, gzipHash))
+	counter := &countingWriter{w: io.MultiWriter(out, gzipHash)}
+	gzipOut, err := MaybeGzipWriter(counter, reproducible)
 	if err != nil {
 		return nil, err
 	}
@@ -247,60 +317,97 @@ func layerFromPath(path string, uid int, gid int) (*Layer, error) {
 	diffSha := gdigest.NewDigest("sha256", tarHash)
 	logrus.Infof("DiffID of layer is %s", diffSha)
 	layerSha := gdigest.NewDigest("sha256", gzipHash)
-	layer := Layer{DiffID: diffSha, Data: b.Bytes()}
-	layer.Desc = desc(layerMT, layer.Data, layerSha)
+	layer := Layer{DiffID: diffSha, Blob: &fileBlob{out.Name(), counter.n}}
+	layer.Desc = v1.Descriptor{MediaType: layerMT, Digest: layerSha, Size: counter.n}
 	return &layer, nil
 }
 
-func extractFile(tarfile, filename string) ([]byte, error) {
-	in, err := os.OpenFile(tarfile, os.O_RDONLY, 0)
-	if err != nil {
-		logrus.Errorf("Failed to open %v: %v", tarfile, err)
-		return nil, err
-	}
-	defer in.Close()
-	gzipIn, err := MaybeGzipReader(in)
-	if err != nil {
-		logrus.Errorf("Failed to read gzip: %v", err)
-		return nil, err
-	}
-	defer gzipIn.Close()
-	tarIn := tar.NewReader(gzipIn)
-	for {
-		hdr, err := tarIn.Next()
-		if err == io.EOF {
-			// end of tar archive
-			break
+// countingWriter keeps track of the number of bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Extractor reads small objects like manifests and configs by digest.
+type Extractor func(digest gdigest.Digest) ([]byte, error)
+
+// BlobGetter returns the blob for a layer descriptor.
+type BlobGetter func(desc v1.Descriptor) (Blob, error)
+
+// manifestOrIndex contains the fields needed to distinguish an image manifest
+// from an image index or docker manifest list.
+type manifestOrIndex struct {
+	MediaType string          `json:"mediaType,omitempty"`
+	Config    *v1.Descriptor  `json:"config,omitempty"`
+	Manifests []v1.Descriptor `json:"manifests,omitempty"`
+}
+
+const maxIndexDepth = 4
+
+// resolveIndex follows image indexes and manifest lists in data, selecting
+// the entry for platform, until it finds an image manifest. It returns the
+// data of the manifest and the platform from the selected entry if any.
+func resolveIndex(extract Extractor, data []byte, platform *v1.Platform) ([]byte, *v1.Platform, error) {
+	var selected *v1.Platform
+	for i := 0; i < maxIndexDepth; i++ {
+		var m manifestOrIndex
+		if err := json.Unmarshal(data, &m); err != nil {
+			return nil, nil, fmt.Errorf("error unmarshaling image manifest")
+		}
+		isIndex := m.MediaType == indexMT || m.MediaType == dockerListMT
+		if m.MediaType == "" && m.Config == nil && len(m.Manifests) != 0 {
+			isIndex = true
+		}
+		if !isIndex {
+			return data, selected, nil
 		}
+		defn, err := selectPlatform(m.Manifests, platform)
 		if err != nil {
-			return nil, fmt.Errorf("Error reading tar entry: %v", err)
+			return nil, nil, err
 		}
-		clean := filepath.Clean(hdr.Name)
-		if clean == filename {
-			// found the reference we are supposed to use
-			return ioutil.ReadAll(tarIn)
+		if defn.Platform != nil {
+			p := *defn.Platform
+			selected = &p
+		}
+		logrus.Debugf("Selected manifest %s from index", defn.Digest)
+		data, err = extract(defn.Digest)
+		if err != nil {
+			return nil, nil, err
+		}
+		if digest(data) != defn.Digest {
+			return nil, nil, fmt.Errorf("manifest %s does not match its digest", defn.Digest)
 		}
 	}
-	return nil, fmt.Errorf("Could not find %s in %s", filename, tarfile)
-}
-
-func digestExtractor(tarfile string) Extractor {
-	return func(digest gdigest.Digest) ([]byte, error) {
-		parts := append([]string{"blobs"},
-			string(digest.Algorithm()),
-			digest.Hex())
-		filename := filepath.Join(parts...)
-		return extractFile(tarfile, filename)
-	}
+	return nil, nil, fmt.Errorf("image indexes are nested too deeply")
 }
 
-type Extractor func(digest gdigest.Digest) ([]byte, error)
-
-func imageFromDigest(extract Extractor, digest gdigest.Digest, annotations map[string]string) (*Image, error) {
+func imageFromDigest(extract Extractor, getBlob BlobGetter, digest gdigest.Digest, annotations map[string]string, platform *v1.Platform) (*Image, error) {
 	manb, err := extract(digest)
 	if err != nil {
 		return nil, err
 	}
+	manb, selected, err := resolveIndex(extract, manb, platform)
+	if err != nil {
+		return nil, err
+	}
+	image, err := imageFromManifest(extract, getBlob, manb, annotations)
+	if err != nil {
+		return nil, err
+	}
+	image.Platform = selected
+	if selected == nil {
+		warnPlatformMismatch(image, platform)
+	}
+	return image, nil
+}
+
+func imageFromManifest(extract Extractor, getBlob BlobGetter, manb []byte, annotations map[string]string) (*Image, error) {
 	var manifest v1.Manifest
 	if err := json.Unmarshal(manb, &manifest); err != nil {
 		return nil, fmt.Errorf("error unmarshaling image manifest")
@@ -339,19 +446,19 @@ func imageFromDigest(extract Extractor, digest gdigest.Digest, annotations map[s
 		if layer.Desc.Digest == "" {
 			return nil, fmt.Errorf("image config has an invalid layer reference")
 		}
-		layer.Data, err = extract(layer.Desc.Digest)
+		layer.Blob, err = getBlob(layer.Desc)
 		if err != nil {
 			return nil, err
 		}
 		layers = append(layers, &layer)
 	}
-	return &Image{Config: &config, Layers: layers}, nil
+	return &Image{Config: &config, Layers: layers, Digest: digest(manb)}, nil
 }
 
 type Layer struct {
 	Desc   v1.Descriptor
 	DiffID gdigest.Digest
-	Data   []byte
+	Blob   Blob
 }
 
 // ImageMetadata stores metadata such as build time
@@ -368,6 +475,60 @@ type Image struct {
 	Layers          []*Layer
 	AdditionalBlobs []OpaqueBlob
 	Metadata        *ImageMetadata
+	Platform        *v1.Platform
+	// Source is the registry and repository the image was pulled from. It is
+	// used to mount layers instead of uploading them.
+	Source string
+	// Tag is the name of the image in an oci layout. Images without a tag
+	// are named latest.
+	Tag string
+	// Digest is the digest of the manifest the image was loaded from. It is
+	// empty for images that haven't been written yet.
+	Digest gdigest.Digest
+	// layout holds the file the layers are read from for images loaded from
+	// an oci layout.
+	layout *ociLayout
+}
+
+// Close releases the layout the image was loaded from. The layers can't be
+// read afterwards.
+func (image *Image) Close() error {
+	if image.layout == nil {
+		return nil
+	}
+	err := image.layout.Close()
+	image.layout = nil
+	return err
+}
+
+// GetPlatform returns the platform of the image, falling back to the os and
+// architecture in the config if it wasn't explicitly set.
+func (image *Image) GetPlatform() v1.Platform {
+	if image.Platform != nil {
+		return *image.Platform
+	}
+	if image.Config != nil && image.Config.Architecture != "" {
+		return v1.Platform{Architecture: image.Config.Architecture, OS: image.Config.OS}
+	}
+	return hostPlatform()
+}
+
+// metadataFromAnnotations restores the metadata written to the annotations of
+// a manifest entry. It returns nil if the entry wasn't written by smith.
+func metadataFromAnnotations(annotations map[string]string) *ImageMetadata {
+	version, ok := annotations["com.oracle.smith.version"]
+	if !ok {
+		return nil
+	}
+	metadata := &ImageMetadata{
+		Buildno:  annotations[buildAnnotation],
+		SmithVer: version,
+		SmithSha: annotations["com.oracle.smith.sha"],
+	}
+	if created, err := time.Parse(time.RFC3339, annotations[v1.AnnotationCreated]); err == nil {
+		metadata.BuildTime = created
+	}
+	return metadata
 }
 
 // OpaqueBlob adds data other than image layers
@@ -376,34 +537,148 @@ type OpaqueBlob struct {
 	Content  []byte
 }
 
-func imageFromFile(path string) (*Image, error) {
-	tag := "latest"
-	parts := strings.Split(path, ":")
-	tarpath := parts[0]
-	if len(parts) > 1 {
-		tag = parts[1]
-	}
-	refb, err := extractFile(tarpath, "index.json")
+// descriptorsFromFile returns the layout of the tarfile and the manifest
+// descriptors that match the tag appended to path after a colon.
+func descriptorsFromFile(path string) (*ociLayout, []v1.Descriptor, error) {
+	tarpath, tag := splitRef(path)
+	layout, err := openLayout(tarpath)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	var ref v1.Index
-	if err := json.Unmarshal(refb, &ref); err != nil {
-		return nil, fmt.Errorf("error unmarshaling index.json from %s", tarpath)
+	ref, err := layout.Index()
+	if err != nil {
+		layout.Close()
+		return nil, nil, err
 	}
-	digest := gdigest.Digest("")
-	annotations := map[string]string{}
+	descs := []v1.Descriptor{}
 	for _, defn := range ref.Manifests {
-		if defn.Annotations[v1.AnnotationRefName] == tag {
-			digest = defn.Digest
-			annotations = defn.Annotations
+		if isImageEntry(defn) && defn.Annotations[v1.AnnotationRefName] == tag {
+			descs = append(descs, defn)
+		}
+	}
+	if len(descs) == 0 {
+		layout.Close()
+		return nil, nil, fmt.Errorf("unable to locate image named %s in index", tag)
+	}
+	return layout, descs, nil
+}
+
+// selectPlatform chooses the descriptor matching platform from descs. If
+// platform is nil the host platform is preferred and the first descriptor is
+// used with a warning if none matches. A single descriptor without a platform
+// is always returned because older layouts didn't record it.
+func selectPlatform(descs []v1.Descriptor, platform *v1.Platform) (v1.Descriptor, error) {
+	wanted := hostPlatform()
+	if platform != nil {
+		wanted = *platform
+	}
+	for _, defn := range descs {
+		if defn.Platform != nil && platformMatches(wanted, *defn.Platform) {
+			return defn, nil
 		}
 	}
-	if digest == "" {
-		return nil, fmt.Errorf("unable to locate image named %s in index", tag)
+	if len(descs) == 1 && descs[0].Platform == nil {
+		return descs[0], nil
+	}
+	if platform == nil && len(descs) > 0 {
+		using := "the first image"
+		if descs[0].Platform != nil {
+			using = "the image for " + platformString(*descs[0].Platform)
+		}
+		logrus.Warnf("No image for %s, using %s", platformString(wanted), using)
+		return descs[0], nil
+	}
+	return v1.Descriptor{}, fmt.Errorf("unable to locate image for platform %s", platformString(wanted))
+}
+
+// warnPlatformMismatch warns if the config of image is for a different
+// platform than the one wanted, which defaults to the host.
+func warnPlatformMismatch(image *Image, platform *v1.Platform) {
+	if image.Config == nil || image.Config.Architecture == "" {
+		return
+	}
+	wanted := hostPlatform()
+	if platform != nil {
+		wanted = *platform
+	}
+	actual := v1.Platform{OS: image.Config.OS, Architecture: image.Config.Architecture}
+	if !platformMatches(v1.Platform{OS: wanted.OS, Architecture: wanted.Architecture}, actual) {
+		logrus.Warnf("Image is for %s, not %s", platformString(actual), platformString(wanted))
+	}
+}
+
+func imageFromDescriptor(layout *ociLayout, defn v1.Descriptor, platform *v1.Platform) (*Image, error) {
+	getBlob := func(desc v1.Descriptor) (Blob, error) {
+		return layout.DigestBlob(desc.Digest)
+	}
+	image, err := imageFromDigest(layout.Extractor(), getBlob, defn.Digest, defn.Annotations, platform)
+	if err != nil {
+		return nil, err
+	}
+	if image.Platform == nil && defn.Platform != nil {
+		platform := *defn.Platform
+		image.Platform = &platform
+	}
+	image.Source = defn.Annotations[sourceAnnotation]
+	image.Tag = defn.Annotations[v1.AnnotationRefName]
+	image.Metadata = metadataFromAnnotations(defn.Annotations)
+	return image, nil
+}
+
+// imageFromFile loads the image for platform from the oci layout at path. If
+// platform is nil, the image matching the host is preferred. The image must
+// be closed to release the layout.
+func imageFromFile(path string, platform *v1.Platform) (*Image, error) {
+	layout, descs, err := descriptorsFromFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defn, err := selectPlatform(descs, platform)
+	if err != nil {
+		layout.Close()
+		return nil, err
+	}
+	logrus.Debugf("%s is id %s", path, defn.Digest)
+	image, err := imageFromDescriptor(layout, defn, platform)
+	if err != nil {
+		layout.Close()
+		return nil, err
 	}
-	logrus.Debugf("%s in %s is id %s", tag, path, digest)
-	return imageFromDigest(digestExtractor(tarpath), digest, annotations)
+	image.layout = layout
+	if platform != nil && !platformMatches(*platform, image.GetPlatform()) {
+		logrus.Warnf("Image %s is for %s instead of %s", path,
+			platformString(image.GetPlatform()), platformString(*platform))
+	}
+	return image, nil
+}
+
+// imagesFromFile loads the images for all platforms from the oci layout at
+// path. The returned layout must be closed once the images aren't needed.
+func imagesFromFile(path string) (*ociLayout, []*Image, error) {
+	layout, descs, err := descriptorsFromFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	images, err := imagesFromDescriptors(layout, descs)
+	if err != nil {
+		layout.Close()
+		return nil, nil, err
+	}
+	return layout, images, nil
+}
+
+// imagesFromDescriptors loads the image for each of descs from layout.
+func imagesFromDescriptors(layout *ociLayout, descs []v1.Descriptor) ([]*Image, error) {
+	images := []*Image{}
+	for _, defn := range descs {
+		logrus.Debugf("%s contains id %s", layout.path, defn.Digest)
+		image, err := imageFromDescriptor(layout, defn, defn.Platform)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, image)
+	}
+	return images, nil
 }
 
 func setDefaultsFromImage(def *ConfigDef, image *Image) {
@@ -427,62 +702,61 @@ func setDefaultsFromImage(def *ConfigDef, image *Image) {
 	}
 }
 
-func imageFromBuild(def *ConfigDef, baseDir string) (*Image, error) {
+// imageFromBuild creates the image for platform from the layers in baseDir
+// on top of the parent of def. The image must be closed to release the
+// layout of the parent.
+func imageFromBuild(def *ConfigDef, baseDir string, platform v1.Platform, reproducible bool) (*Image, error) {
 	// get parent layers
 	image := &Image{}
 	if def.Parent != "" {
 		var err error
-		image, err = imageFromFile(filepath.Join(baseDir, def.Parent))
+		image, err = imageFromFile(filepath.Join(baseDir, def.Parent), &platform)
 		if err != nil {
 			return nil, err
 		}
 		setDefaultsFromImage(def, image)
+		// the new image doesn't inherit the name of its parent
+		image.Tag = ""
+		image.Metadata = nil
+		image.Digest = ""
 	}
-	image.Config = configFromDef(def)
+	image.Config = configFromDef(def, platform)
+	image.Platform = &platform
 	uid, gid, _, _, _ := ParseUser(def.User)
-	layer, err := layerFromPath(filepath.Join(baseDir, rootfs), uid, gid)
-	if err != nil {
-		return nil, err
-	}
-	found := false
-	for _, l := range image.Layers {
-		if l.DiffID == layer.DiffID {
-			found = true
-			logrus.Infof("Layer with DiffID %s already exists in parent", l.DiffID)
+	parentLayers := image.Layers
+	for _, path := range layerPaths(def, baseDir) {
+		layer, err := layerFromPath(path, baseDir, uid, gid, reproducible)
+		if err != nil {
+			image.Close()
+			return nil, err
+		}
+		found := false
+		for _, l := range parentLayers {
+			if l.DiffID == layer.DiffID {
+				found = true
+				logrus.Infof("Layer with DiffID %s already exists in parent", l.DiffID)
+			}
+		}
+		if !found {
+			image.Layers = append(image.Layers, layer)
 		}
-	}
-	if !found {
-		image.Layers = append(image.Layers, layer)
 	}
 	return image, nil
 }
 
-func WriteOciFromBuild(def *ConfigDef, buildDir, outName string, metadata *ImageMetadata, blobs []OpaqueBlob) error {
-	image, err := imageFromBuild(def, buildDir)
-	if err != nil {
-		return err
-	}
-	image.AdditionalBlobs = blobs
-	if metadata != nil {
-		image.Metadata = metadata
-	}
-	if err := WriteOciTarGz(image, outName); err != nil {
-		return err
-	}
-	return nil
-}
-
-func WriteOciTarGz(image *Image, outName string) error {
+// WriteOciTarGz writes images to a gzipped oci layout at outName. Compression
+// is pinned for reproducible builds.
+func WriteOciTarGz(images []*Image, outName string, reproducible bool) error {
 	out, err := os.OpenFile(outName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
 		return err
 	}
 	defer out.Close()
-	gzipOut, err := MaybeGzipWriter(out)
+	gzipOut, err := MaybeGzipWriter(out, reproducible)
 	if err != nil {
 		return err
 	}
-	if err := WriteOciTar(image, gzipOut); err != nil {
+	if err := WriteOciTar(images, gzipOut); err != nil {
 		logrus.Errorf("Error writing oci tar.gz: %v", err)
 		gzipOut.Close()
 		return err
@@ -492,43 +766,106 @@ func WriteOciTarGz(image *Image, outName string) error {
 	return nil
 }
 
-// WriteOciTar makes a tar file from in-memory structures
-func WriteOciTar(image *Image, out io.Writer) error {
+// WriteOciTar makes a tar file from in-memory structures. Each image is
+// written as a separate manifest in the index with its platform recorded.
+func WriteOciTar(images []*Image, out io.Writer) error {
 	tarOut := tar.NewWriter(out)
 	defer tarOut.Close()
 
-	fileData := map[string][]byte{}
+	fileData := map[string]Blob{}
+	shaBase := filepath.Join("blobs", "sha256")
+	blobEntries := []v1.Descriptor{}
+	manifestEntries := []v1.Descriptor{}
+	seen := map[string]struct{}{}
 
-	// add layers
-	for _, l := range image.Layers {
-		digest := l.Desc.Digest
-		parts := append([]string{"blobs"}, string(digest.Algorithm()), digest.Hex())
-		logrus.Infof("Adding layer %s to image", l.Desc.Digest)
-		fileData[filepath.Join(parts...)] = l.Data
-	}
+	for _, image := range images {
+		// add layers
+		for _, l := range image.Layers {
+			digest := l.Desc.Digest
+			parts := append([]string{"blobs"}, string(digest.Algorithm()), digest.Hex())
+			logrus.Infof("Adding layer %s to image", l.Desc.Digest)
+			fileData[filepath.Join(parts...)] = l.Blob
+		}
 
-	// add config
-	shaBase := filepath.Join("blobs", "sha256")
-	configData, err := serializeConfig(image)
-	if err != nil {
-		return err
-	}
-	configSha := digest(configData)
-	fileData[filepath.Join(shaBase, configSha.Hex())] = configData
-	configDesc := desc(configMT, configData, configSha)
+		// add config
+		configData, err := serializeConfig(image)
+		if err != nil {
+			return err
+		}
+		configSha := digest(configData)
+		fileData[filepath.Join(shaBase, configSha.Hex())] = bytesBlob(configData)
+		configDesc := desc(configMT, configData, configSha)
 
-	// add manifest
-	manifestData, err := serializeManifest(configDesc, image.Layers, false)
-	manifestSha := digest(manifestData)
-	fileData[filepath.Join(shaBase, manifestSha.Hex())] = manifestData
+		// add manifest
+		manifestData, err := serializeManifest(configDesc, image.Layers, false)
+		if err != nil {
+			return err
+		}
+		manifestSha := digest(manifestData)
+		fileData[filepath.Join(shaBase, manifestSha.Hex())] = bytesBlob(manifestData)
 
-	// add extra blobs
-	for _, b := range image.AdditionalBlobs {
-		d := digest(b.Content)
-		fileData[filepath.Join(shaBase, d.Hex())] = b.Content
+		// build entries for the extra blobs linked to the manifest
+		for _, b := range image.AdditionalBlobs {
+			d := digest(b.Content)
+			fileData[filepath.Join(shaBase, d.Hex())] = bytesBlob(b.Content)
+			entry := desc(b.Filetype, b.Content, d)
+			entry.Annotations = map[string]string{manifestAnnotation: string(manifestSha)}
+			if b.Filetype == packagesMT {
+				// packages are installed per platform
+				platform := image.GetPlatform()
+				entry.Platform = &platform
+			}
+			key := extraBlobKey(entry)
+			if _, ok := seen[key]; ok {
+				continue
+			}
+			seen[key] = struct{}{}
+			blobEntries = append(blobEntries, entry)
+		}
+
+		// build manifest entry for the image manifest
+		latest := desc(manifestMT, manifestData, manifestSha)
+		if image.Tag != "" {
+			latest.Annotations = map[string]string{}
+			latest.Annotations[v1.AnnotationRefName] = image.Tag
+		}
+		if image.Metadata != nil {
+			if latest.Annotations == nil {
+				latest.Annotations = map[string]string{}
+				latest.Annotations[v1.AnnotationRefName] = "latest"
+			}
+			created := image.Metadata.BuildTime.Format(time.RFC3339)
+			latest.Annotations[v1.AnnotationCreated] = created
+			latest.Annotations["com.oracle.smith.version"] = image.Metadata.SmithVer
+			latest.Annotations["com.oracle.smith.sha"] = image.Metadata.SmithSha
+			if image.Metadata.Buildno != "" {
+				latest.Annotations[buildAnnotation] = image.Metadata.Buildno
+			}
+		}
+		if image.Source != "" {
+			if latest.Annotations == nil {
+				latest.Annotations = map[string]string{}
+			}
+			latest.Annotations[sourceAnnotation] = image.Source
+		}
+		platform := image.GetPlatform()
+		latest.Platform = &platform
+		manifestEntries = append(manifestEntries, latest)
 	}
 
-	// write file blobs in sorted order
+	index := imageIndex(append(blobEntries, manifestEntries...), nil)
+	return writeLayoutTar(tarOut, fileData, index)
+}
+
+// extraBlobKey identifies the entry of an extra blob by its digest and the
+// manifest it belongs to.
+func extraBlobKey(defn v1.Descriptor) string {
+	return string(defn.Digest) + "@" + defn.Annotations[manifestAnnotation]
+}
+
+// writeLayoutTar writes the blobs in fileData in sorted order followed by
+// the oci-layout file and the index.
+func writeLayoutTar(tarOut *tar.Writer, fileData map[string]Blob, index v1.Index) error {
 	filenames := make([]string, len(fileData))
 	i := 0
 	for k := range fileData {
@@ -544,7 +881,9 @@ func WriteOciTar(image *Image, out io.Writer) error {
 			writeDirTar(tarOut, dir)
 			dirs[dir] = struct{}{}
 		}
-		writeFileTar(tarOut, filename, fileData[filename])
+		if err := writeBlobTar(tarOut, filename, fileData[filename]); err != nil {
+			return err
+		}
 	}
 
 	layout := v1.ImageLayout{Version: "1.0.0"}
@@ -554,36 +893,6 @@ func WriteOciTar(image *Image, out io.Writer) error {
 	}
 	writeFileTar(tarOut, "oci-layout", layoutData)
 
-	// build manifest entry for "latest" image manifest
-	latest := desc(manifestMT, manifestData, manifestSha)
-	if image.Metadata != nil {
-		latest.Annotations = map[string]string{}
-		latest.Annotations[v1.AnnotationRefName] = "latest"
-		created := image.Metadata.BuildTime.Format(time.RFC3339)
-		latest.Annotations[v1.AnnotationCreated] = created
-		latest.Annotations["com.oracle.smith.version"] = image.Metadata.SmithVer
-		latest.Annotations["com.oracle.smith.sha"] = image.Metadata.SmithSha
-		if image.Metadata.Buildno != "" {
-			latest.Annotations["com.oracle.smith.build"] = image.Metadata.Buildno
-		}
-	}
-	platform := v1.Platform{Architecture: runtime.GOARCH, OS: runtime.GOOS}
-	latest.Platform = &platform
-	allBlobs := make([]v1.Descriptor, len(image.AdditionalBlobs)+1)
-
-	// build entries for the rest of the blobs
-	annotations := map[string]string{}
-	if image.Metadata != nil && image.Metadata.Buildno != "" {
-		annotations["com.oracle.smith.build"] = image.Metadata.Buildno
-	}
-	for i, b := range image.AdditionalBlobs {
-		d := digest(b.Content)
-		entry := desc(b.Filetype, b.Content, d)
-		entry.Annotations = annotations
-		allBlobs[i] = entry
-	}
-	allBlobs[len(image.AdditionalBlobs)] = latest
-	index := imageIndex(allBlobs, nil)
 	indexData, err := json.Marshal(index)
 	if err != nil {
 		return err
@@ -607,8 +916,16 @@ func writeFile(path string, in io.Reader, perm os.FileMode) error {
 	return nil
 }
 
-func extractLayer(layer *Layer, outDir string) error {
-	gzipIn, err := MaybeGzipReader(NopCloser(bytes.NewReader(layer.Data)))
+// walkLayer calls fn for each entry in the tar of layer. The reader passed
+// to fn returns the content of the entry.
+func walkLayer(layer *Layer, fn func(*tar.Header, io.Reader) error) error {
+	in, err := layer.Blob.Open()
+	if err != nil {
+		logrus.Errorf("Failed to open layer %s: %v", layer.Desc.Digest, err)
+		return err
+	}
+	defer in.Close()
+	gzipIn, err := gzipReaderFromStream(in)
 	if err != nil {
 		logrus.Errorf("Failed to read gzip: %v", err)
 		return err
@@ -624,50 +941,108 @@ func extractLayer(layer *Layer, outDir string) error {
 		if err != nil {
 			return fmt.Errorf("Error reading tar entry: %v", err)
 		}
+		if err := fn(hdr, tarIn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// opaqueDirs returns the directories that layer marks as opaque.
+func opaqueDirs(layer *Layer) ([]string, error) {
+	dirs := []string{}
+	err := walkLayer(layer, func(hdr *tar.Header, in io.Reader) error {
+		clean := filepath.Clean(hdr.Name)
+		if filepath.Base(clean) == opaqueWhiteout {
+			dirs = append(dirs, filepath.Dir(clean))
+		}
+		return nil
+	})
+	return dirs, err
+}
+
+// extractLayer applies layer to the tree in outDir. Symlinks in the tree are
+// resolved inside of outDir so entries can't be written outside of it.
+func extractLayer(layer *Layer, outDir string) error {
+	// remove the contents of opaque directories from lower layers before
+	// this layer adds to them, wherever the marker is in the tar
+	dirs, err := opaqueDirs(layer)
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		dir, err := resolveInRoot(outDir, dir, true)
+		if err != nil {
+			return err
+		}
+		children, _ := ioutil.ReadDir(dir)
+		for _, child := range children {
+			if err := os.RemoveAll(filepath.Join(dir, child.Name())); err != nil {
+				logrus.Warnf("Failed to remove whiteout %s", child.Name())
+			}
+		}
+	}
+	return walkLayer(layer, func(hdr *tar.Header, in io.Reader) error {
 		// extract tar file
 		clean := filepath.Clean(hdr.Name)
 		base := filepath.Base(clean)
-		if strings.HasPrefix(base, ".wh.") {
-			filename := filepath.Join(filepath.Dir(clean), base[4:])
-			if err := os.RemoveAll(filepath.Join(outDir, filename)); err != nil {
+		if base == opaqueWhiteout {
+			return nil
+		}
+		if strings.HasPrefix(base, whiteoutPrefix) {
+			filename := filepath.Join(filepath.Dir(clean), base[len(whiteoutPrefix):])
+			path, err := resolveInRoot(outDir, filename, false)
+			if err != nil {
+				return err
+			}
+			if err := os.RemoveAll(path); err != nil {
 				logrus.Warnf("Failed to remove whiteout %s", filename)
 			}
-			continue
+			return nil
+		}
+		path, err := resolveInRoot(outDir, clean, false)
+		if err != nil {
+			return err
 		}
+		linkPath, err := resolveInRoot(outDir, hdr.Linkname, false)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		return extractEntry(hdr, in, path, linkPath)
+	})
+}
 
-		path := filepath.Join(outDir, clean)
-		info, err := os.Lstat(path)
-		// remove any existing file at the location unless both locations are a dir
-		if err == nil && !(hdr.Typeflag == tar.TypeDir && info.IsDir()) {
-			if err := os.RemoveAll(path); err != nil {
-				logrus.Warnf("Failed to remove %s", path)
-			}
+func extractEntry(hdr *tar.Header, in io.Reader, path, linkPath string) error {
+	info, err := os.Lstat(path)
+	// remove any existing file at the location unless both locations are a dir
+	if err == nil && !(hdr.Typeflag == tar.TypeDir && info.IsDir()) {
+		if err := os.RemoveAll(path); err != nil {
+			logrus.Warnf("Failed to remove %s", path)
 		}
-		switch hdr.Typeflag {
-		case tar.TypeDir:
-			os.MkdirAll(path, 0755)
-		case tar.TypeSymlink:
-			os.Symlink(hdr.Linkname, path)
-		case tar.TypeLink:
-			target := hdr.Linkname
-			if filepath.IsAbs(target) {
-				target = filepath.Join(outDir, target)
-			}
-			os.Link(target, path)
-		case tar.TypeReg:
-			// normalize permissions
-			perm := int64(0644)
-			if hdr.FileInfo().Mode().Perm()&0100 != 0 {
-				perm = int64(0755)
-			}
-			hdr.Mode = perm | c_ISREG
-			fPerm := hdr.FileInfo().Mode().Perm()
-			if err := writeFile(path, tarIn, fPerm); err != nil {
-				return err
-			}
-		default:
-			logrus.Infof("Skipping unknown file type %v for %s", hdr.Typeflag, clean)
+	}
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		os.MkdirAll(path, 0755)
+	case tar.TypeSymlink:
+		os.Symlink(hdr.Linkname, path)
+	case tar.TypeLink:
+		os.Link(linkPath, path)
+	case tar.TypeReg, tar.TypeRegA:
+		// normalize permissions
+		perm := int64(0644)
+		if hdr.FileInfo().Mode().Perm()&0100 != 0 {
+			perm = int64(0755)
+		}
+		hdr.Mode = perm | c_ISREG
+		fPerm := hdr.FileInfo().Mode().Perm()
+		if err := writeFile(path, in, fPerm); err != nil {
+			return err
 		}
+	default:
+		logrus.Infof("Skipping unknown file type %v for %s", hdr.Typeflag, hdr.Name)
 	}
 	return nil
 }
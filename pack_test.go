@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOciRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smith-test-")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.MkdirAll(filepath.Join(dir, rootfs, "read"), 0755); err != nil {
+		t.Fatalf("%v", err)
+	}
+	data := []byte("Hello World!\n")
+	if err := ioutil.WriteFile(filepath.Join(dir, rootfs, "read", "data"), data, 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	def := &ConfigDef{Cmd: []string{"/usr/bin/cat", "/read/data"}}
+	image, err := imageFromBuild(def, dir, hostPlatform(), false)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	image.Metadata = getMetadata()
+	outpath := filepath.Join(dir, "image.tar.gz")
+	if err := WriteOciTarGz([]*Image{image}, outpath, false); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	loaded, err := imageFromFile(outpath, nil)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer loaded.Close()
+	if len(loaded.Layers) != 1 {
+		t.Fatalf("Wrong number of layers: %d", len(loaded.Layers))
+	}
+	if loaded.Layers[0].Desc.Digest != image.Layers[0].Desc.Digest {
+		t.Fatalf("Layer digests don't match")
+	}
+	if loaded.Config.Config.Cmd[1] != "/read/data" {
+		t.Fatalf("Config was not preserved: %v", loaded.Config.Config.Cmd)
+	}
+
+	outDir := filepath.Join(dir, "out")
+	if err := ExtractOci(loaded, outDir); err != nil {
+		t.Fatalf("%v", err)
+	}
+	result, err := ioutil.ReadFile(filepath.Join(outDir, "read", "data"))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if string(result) != string(data) {
+		t.Fatalf("Extracted data doesn't match: %s", result)
+	}
+}
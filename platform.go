@@ -0,0 +1,95 @@
+package main
+
+import (
+	"debug/elf"
+	"fmt"
+	"runtime"
+	"strings"
+
+	"github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// hostPlatform returns the platform smith is currently running on.
+func hostPlatform() v1.Platform {
+	return v1.Platform{Architecture: runtime.GOARCH, OS: runtime.GOOS}
+}
+
+// parsePlatform parses a platform string in the form os/arch[/variant] as
+// used by docker and other container tools.
+func parsePlatform(s string) (v1.Platform, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return v1.Platform{}, fmt.Errorf("invalid platform '%s', expected os/arch[/variant]", s)
+	}
+	p := v1.Platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+	return p, nil
+}
+
+// parsePlatforms parses a list of platform strings. If the list is empty it
+// returns the host platform.
+func parsePlatforms(strs []string) ([]v1.Platform, error) {
+	if len(strs) == 0 {
+		return []v1.Platform{hostPlatform()}, nil
+	}
+	platforms := []v1.Platform{}
+	seen := map[string]struct{}{}
+	for _, s := range strs {
+		p, err := parsePlatform(s)
+		if err != nil {
+			return nil, err
+		}
+		key := platformString(p)
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		platforms = append(platforms, p)
+	}
+	return platforms, nil
+}
+
+// platformString formats a platform as os/arch[/variant].
+func platformString(p v1.Platform) string {
+	s := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		s += "/" + p.Variant
+	}
+	return s
+}
+
+// platformMatches returns true if the candidate platform satisfies the
+// wanted platform. An empty variant in wanted matches any variant.
+func platformMatches(wanted, candidate v1.Platform) bool {
+	if wanted.OS != candidate.OS || wanted.Architecture != candidate.Architecture {
+		return false
+	}
+	return wanted.Variant == "" || wanted.Variant == candidate.Variant
+}
+
+// archMachines maps GOARCH style architecture names to elf machine types.
+var archMachines = map[string]elf.Machine{
+	"386":      elf.EM_386,
+	"amd64":    elf.EM_X86_64,
+	"arm":      elf.EM_ARM,
+	"arm64":    elf.EM_AARCH64,
+	"mips":     elf.EM_MIPS,
+	"mipsle":   elf.EM_MIPS,
+	"mips64":   elf.EM_MIPS,
+	"mips64le": elf.EM_MIPS,
+	"ppc64":    elf.EM_PPC64,
+	"ppc64le":  elf.EM_PPC64,
+	"riscv64":  elf.EM_RISCV,
+	"s390x":    elf.EM_S390,
+}
+
+// platformMachine returns the elf machine type for the architecture of the
+// platform or EM_NONE if it is unknown.
+func platformMachine(p v1.Platform) elf.Machine {
+	if m, ok := archMachines[p.Architecture]; ok {
+		return m
+	}
+	return elf.EM_NONE
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	gdigest "github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+type platformCase struct {
+	Platform string
+	OS       string
+	Arch     string
+	Variant  string
+	Valid    bool
+}
+
+func TestParsePlatform(t *testing.T) {
+	for _, c := range []platformCase{
+		{"linux/amd64", "linux", "amd64", "", true},
+		{"linux/arm64/v8", "linux", "arm64", "v8", true},
+		{"linux", "", "", "", false},
+		{"linux/", "", "", "", false},
+		{"linux/arm/v7/extra", "", "", "", false},
+	} {
+		p, err := parsePlatform(c.Platform)
+		if (err == nil) != c.Valid {
+			t.Fatalf("Fail %v, validity doesn't match: %v", c, err)
+		}
+		if !c.Valid {
+			continue
+		}
+		if p.OS != c.OS || p.Architecture != c.Arch || p.Variant != c.Variant {
+			t.Fatalf("Fail %v, platforms don't match: %v", c, p)
+		}
+		if platformString(p) != c.Platform {
+			t.Fatalf("Fail %v, strings don't match: %s", c, platformString(p))
+		}
+	}
+}
+
+func TestSelectPlatform(t *testing.T) {
+	descs := []v1.Descriptor{
+		{Digest: "sha256:a", Platform: &v1.Platform{OS: "linux", Architecture: "amd64"}},
+		{Digest: "sha256:b", Platform: &v1.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}},
+	}
+	arm := v1.Platform{OS: "linux", Architecture: "arm64"}
+	d, err := selectPlatform(descs, &arm)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if d.Digest != "sha256:b" {
+		t.Fatalf("Selected wrong platform: %v", d.Digest)
+	}
+	ppc := v1.Platform{OS: "linux", Architecture: "ppc64le"}
+	if _, err := selectPlatform(descs, &ppc); err == nil {
+		t.Fatalf("Missing platform was selected")
+	}
+	// a single descriptor is only selected for another platform if it
+	// doesn't record one
+	if _, err := selectPlatform(descs[:1], &arm); err == nil {
+		t.Fatalf("Descriptor for another platform was selected")
+	}
+	d, err = selectPlatform([]v1.Descriptor{{Digest: "sha256:c"}}, &arm)
+	if err != nil || d.Digest != "sha256:c" {
+		t.Fatalf("Single descriptor without a platform was not selected: %v", err)
+	}
+}
+
+func TestResolveIndex(t *testing.T) {
+	amd := []byte(`{"schemaVersion":2,"config":{"digest":"sha256:c1","size":1}}`)
+	arm := []byte(`{"schemaVersion":2,"config":{"digest":"sha256:c2","size":1}}`)
+	blobs := map[gdigest.Digest][]byte{digest(amd): amd, digest(arm): arm}
+	extract := func(d gdigest.Digest) ([]byte, error) {
+		return blobs[d], nil
+	}
+	index := maybeDockerIndex{MediaType: dockerListMT}
+	index.Manifests = []v1.Descriptor{
+		{Digest: digest(amd), Platform: &v1.Platform{OS: "linux", Architecture: "amd64"}},
+		{Digest: digest(arm), Platform: &v1.Platform{OS: "linux", Architecture: "arm64"}},
+	}
+	data, _ := json.Marshal(index)
+	platform := v1.Platform{OS: "linux", Architecture: "arm64"}
+	manb, selected, err := resolveIndex(extract, data, &platform)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if string(manb) != string(arm) {
+		t.Fatalf("Resolved wrong manifest: %s", manb)
+	}
+	if selected == nil || selected.Architecture != "arm64" {
+		t.Fatalf("Selected platform is wrong: %v", selected)
+	}
+	// manifests are returned unchanged
+	manb, selected, err = resolveIndex(extract, amd, &platform)
+	if err != nil || string(manb) != string(amd) || selected != nil {
+		t.Fatalf("Manifest was not returned unchanged: %v", err)
+	}
+}
+
+func TestMockConfig(t *testing.T) {
+	host := hostPlatform()
+	other := v1.Platform{OS: "linux", Architecture: "s390x"}
+	if host.Architecture == other.Architecture {
+		other.Architecture = "amd64"
+	}
+	pkg := &ConfigDef{Mock: MockDef{Config: "/etc/mock/default.cfg"}}
+	if config, err := mockConfig(pkg, host); err != nil || config != "/etc/mock/default.cfg" {
+		t.Fatalf("Host platform got config %q: %v", config, err)
+	}
+	// the default config would build for the host instead
+	if _, err := mockConfig(pkg, other); err == nil {
+		t.Fatalf("Platform %s without a config didn't fail", platformString(other))
+	}
+	pkg.Mock.Configs = map[string]string{platformString(other): "/etc/mock/other.cfg"}
+	if config, err := mockConfig(pkg, other); err != nil || config != "/etc/mock/other.cfg" {
+		t.Fatalf("Platform %s got config %q: %v", platformString(other), config, err)
+	}
+}
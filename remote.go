@@ -3,23 +3,28 @@ package main
 import (
 	"bytes"
 	"crypto/tls"
-	"encoding/base64"
-	"encoding/json"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"net/url"
 	"path"
+	"regexp"
 	"strings"
+	"text/template"
 	"time"
 
 	"github.com/Sirupsen/logrus"
 	gdigest "github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go/v1"
 )
 
 // RegistryClient is a type for container image registry clients.
 type RegistryClient struct {
 	http.Client
+	// ChunkSize is the size of the chunks used for blob uploads. If it is
+	// zero, blobs are uploaded with a single PUT.
+	ChunkSize int64
 }
 
 // RepoInfo is a type for container image repositories.
@@ -34,6 +39,23 @@ type RepoInfo struct {
 	Tag      string
 	Token    string
 	Docker   bool
+	// Basic is set if the registry uses basic auth instead of tokens.
+	Basic bool
+	// Scope is an extra scope requested by the registry in its challenge.
+	Scope string
+	// Expiry is when Token should be refreshed.
+	Expiry time.Time
+	// Issued is when Token was received.
+	Issued time.Time
+	// RefreshToken is an oauth2 refresh token used to get new tokens.
+	RefreshToken string
+	// actions are the actions Token was requested for.
+	actions []string
+	// MountFrom lists repositories in the same registry that blobs may be
+	// mounted from instead of uploaded.
+	MountFrom []string
+	// credentialsSet is set once stored credentials have been looked up.
+	credentialsSet bool
 }
 
 func (s RepoInfo) String() string {
@@ -87,33 +109,224 @@ func NewRegistryClient(insecure bool) *RegistryClient {
 		TLSHandshakeTimeout: 10 * time.Second,
 		TLSClientConfig:     &tls.Config{InsecureSkipVerify: insecure},
 	}
-	return &RegistryClient{http.Client{Transport: tr}}
+	return &RegistryClient{Client: http.Client{Transport: tr}}
 }
 
-func uploadContainer(inName, remote string, insecure bool, docker bool) bool {
-	r := NewRegistryClient(insecure)
-	info, err := parseRepoInfo(remote, docker)
+type uploadOptions struct {
+	insecure  bool
+	docker    bool
+	chunkSize int64
+	mountFrom []string
+	tags      []string
+	all       bool
+}
+
+// tagPattern matches the tag names allowed by the distribution spec.
+var tagPattern = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+
+// tagData is the data available to tag templates.
+type tagData struct {
+	Buildno string
+	Labels  map[string]string
+}
+
+// remoteTags returns the tags for an operation on remote. The tag in the
+// remote url is used if it was given explicitly or if there are no other
+// tags.
+func remoteTags(remote string, info *RepoInfo, tags []string) []string {
+	all := []string{}
+	data, err := url.Parse(remote)
+	if err != nil || len(tags) == 0 || strings.Contains(path.Base(data.Path), ":") {
+		all = append(all, info.Tag)
+	}
+	all = append(all, tags...)
+	result := []string{}
+	seen := map[string]struct{}{}
+	for _, tag := range all {
+		if _, ok := seen[tag]; ok {
+			continue
+		}
+		seen[tag] = struct{}{}
+		result = append(result, tag)
+	}
+	return result
+}
+
+// expandTags executes each tag as a template using the build number and
+// labels of image and checks that the results are valid tag names.
+func expandTags(tags []string, image *Image) ([]string, error) {
+	data := tagData{Labels: map[string]string{}}
+	if image.Metadata != nil {
+		data.Buildno = image.Metadata.Buildno
+	}
+	if image.Config != nil && image.Config.Config.Labels != nil {
+		data.Labels = image.Config.Config.Labels
+	}
+	result := []string{}
+	seen := map[string]struct{}{}
+	for _, tag := range tags {
+		tmpl, err := template.New("tag").Option("missingkey=error").Parse(tag)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tag template '%s': %v", tag, err)
+		}
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, data); err != nil {
+			return nil, fmt.Errorf("failed to expand tag '%s': %v", tag, err)
+		}
+		expanded := buf.String()
+		if !tagPattern.MatchString(expanded) {
+			return nil, fmt.Errorf("tag '%s' expanded to invalid tag '%s'", tag, expanded)
+		}
+		if _, ok := seen[expanded]; ok {
+			continue
+		}
+		seen[expanded] = struct{}{}
+		result = append(result, expanded)
+	}
+	return result, nil
+}
+
+func uploadContainer(inName, remote string, uploadOpts *uploadOptions) bool {
+	r := NewRegistryClient(uploadOpts.insecure)
+	r.ChunkSize = uploadOpts.chunkSize
+	info, err := parseRepoInfo(remote, uploadOpts.docker)
 	if err != nil {
 		logrus.Errorf("Failed to parse repository info for image: %v", err)
 		return false
 	}
-	image, err := imageFromFile(inName)
+	for _, repo := range uploadOpts.mountFrom {
+		addMountSource(info, repo)
+	}
+	if uploadOpts.all {
+		return uploadLayout(r, inName, info, uploadOpts)
+	}
+	layout, images, err := imagesFromFile(inName)
 	if err != nil {
 		logrus.Errorf("Failed to get image from %s: %v", inName, err)
 		return false
 	}
+	defer layout.Close()
+	tags, err := expandTags(remoteTags(remote, info, uploadOpts.tags), images[0])
+	if err != nil {
+		logrus.Errorf("Failed to determine tags: %v", err)
+		return false
+	}
 
-	if err := r.ImageToRepo(info, image); err != nil {
+	if len(images) == 1 {
+		err = r.ImageToRepo(info, images[0], tags)
+	} else {
+		err = r.ImagesToRepo(info, images, tags)
+	}
+	if err != nil {
 		logrus.Errorf("Failed to upload image to %s: %v", info, err)
 		return false
 	}
-	logrus.Infof("Successfully uploaded %s to %s", inName, info)
+	logrus.Infof("Successfully uploaded %s to %s with tags %s",
+		inName, info, strings.Join(tags, ", "))
+	return true
+}
+
+// uploadLayout uploads every named image in the layout at inName to the tag
+// with the same name.
+func uploadLayout(r *RegistryClient, inName string, info *RepoInfo, uploadOpts *uploadOptions) bool {
+	if len(uploadOpts.tags) != 0 {
+		logrus.Errorf("Tags can't be specified when uploading all images")
+		return false
+	}
+	e, err := openLayoutEditor(inName)
+	if err != nil {
+		logrus.Errorf("Failed to open %s: %v", inName, err)
+		return false
+	}
+	defer e.Close()
+	for _, name := range e.names() {
+		if !tagPattern.MatchString(name) {
+			logrus.Errorf("Image name '%s' is not a valid tag", name)
+			return false
+		}
+		images, err := imagesFromDescriptors(e.layout, e.refs(name))
+		if err != nil {
+			logrus.Errorf("Failed to get image %s from %s: %v", name, inName, err)
+			return false
+		}
+		if len(images) == 1 {
+			err = r.ImageToRepo(info, images[0], []string{name})
+		} else {
+			err = r.ImagesToRepo(info, images, []string{name})
+		}
+		if err != nil {
+			logrus.Errorf("Failed to upload image %s to %s: %v", name, info, err)
+			return false
+		}
+		logrus.Infof("Successfully uploaded %s:%s to %s:%s", inName, name, info.Host+"/"+info.Reponame, name)
+	}
 	return true
 }
 
 // ImageToRepo puts an Image to a repository. It does this by uploading
 // the image layers first the config data second and then the manifest third.
-func (r *RegistryClient) ImageToRepo(info *RepoInfo, image *Image) error {
+// The manifest is put to each of tags, or to info.Tag if tags is empty.
+func (r *RegistryClient) ImageToRepo(info *RepoInfo, image *Image, tags []string) error {
+	addImageMountSource(info, image)
+	mMT, manifestData, err := r.putImageBlobs(info, image)
+	if err != nil {
+		return err
+	}
+	return r.putManifestTags(info, mMT, manifestData, tags)
+}
+
+// putManifestTags puts a manifest to each of tags. The blobs it references
+// have already been uploaded, so this is cheap for additional tags.
+func (r *RegistryClient) putManifestTags(info *RepoInfo, mt string, data []byte, tags []string) error {
+	if len(tags) == 0 {
+		tags = []string{info.Tag}
+	}
+	for _, tag := range tags {
+		p := path.Join("manifests", tag)
+		if err := r.PutObject(info, p, mt, bytesBlob(data)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ImagesToRepo puts images for multiple platforms to a repository. Each
+// image manifest is uploaded by digest and then an index (or a manifest list
+// for docker) referencing them is uploaded to the tag.
+func (r *RegistryClient) ImagesToRepo(info *RepoInfo, images []*Image, tags []string) error {
+	for _, image := range images {
+		addImageMountSource(info, image)
+	}
+	entries := []v1.Descriptor{}
+	for _, image := range images {
+		mMT, manifestData, err := r.putImageBlobs(info, image)
+		if err != nil {
+			return err
+		}
+		manifestSha := digest(manifestData)
+		p := path.Join("manifests", string(manifestSha))
+		if err := r.PutObject(info, p, mMT, bytesBlob(manifestData)); err != nil {
+			return err
+		}
+		entry := desc(mMT, manifestData, manifestSha)
+		platform := image.GetPlatform()
+		entry.Platform = &platform
+		entries = append(entries, entry)
+	}
+	iMT := indexMT
+	if info.Docker {
+		iMT = dockerListMT
+	}
+	indexData, err := serializeIndex(entries, info.Docker)
+	if err != nil {
+		return err
+	}
+	return r.putManifestTags(info, iMT, indexData, tags)
+}
+
+// putImageBlobs uploads the layers and config of an image and returns the
+// media type and data of the manifest that references them.
+func (r *RegistryClient) putImageBlobs(info *RepoInfo, image *Image) (string, []byte, error) {
 	lMT := layerMT
 	cMT := configMT
 	mMT := manifestMT
@@ -125,56 +338,132 @@ func (r *RegistryClient) ImageToRepo(info *RepoInfo, image *Image) error {
 	for _, l := range image.Layers {
 		p := path.Join("blobs", string(l.Desc.Digest))
 		// media type of blob seems to be ignored, but set it just in case
-		if err := r.PutObject(info, p, lMT, l.Data); err != nil {
-			return err
+		if err := r.PutObject(info, p, lMT, l.Blob); err != nil {
+			return "", nil, err
 		}
 	}
 	configData, err := serializeConfig(image)
 	if err != nil {
-		return err
+		return "", nil, err
 	}
 
 	configSha := digest(configData)
 	p := path.Join("blobs", string(configSha))
-	if err := r.PutObject(info, p, cMT, configData); err != nil {
-		return err
+	if err := r.PutObject(info, p, cMT, bytesBlob(configData)); err != nil {
+		return "", nil, err
 	}
 
 	configDesc := desc(cMT, configData, configSha)
 	manifestData, err := serializeManifest(configDesc, image.Layers, info.Docker)
-	p = path.Join("manifests", info.Tag)
-	if err := r.PutObject(info, p, mMT, manifestData); err != nil {
-		return err
+	if err != nil {
+		return "", nil, err
 	}
-	return nil
+	return mMT, manifestData, nil
 }
 
-func downloadContainer(outName, remote string, insecure bool) bool {
+func downloadContainer(outName, remote string, insecure bool, platformName string, tags []string) bool {
 	info, err := parseRepoInfo(remote, false)
 	if err != nil {
 		logrus.Errorf("Failed to parse repo info: %v", err)
 		return false
 	}
 
-	image, err := NewRegistryClient(insecure).ImageFromRepo(info)
-	if err != nil {
-		logrus.Errorf("Failed to get image from %s: %v", info, err)
-		return false
+	var platform *v1.Platform
+	if platformName != "" {
+		p, err := parsePlatform(platformName)
+		if err != nil {
+			logrus.Errorf("Failed to parse platform: %v", err)
+			return false
+		}
+		platform = &p
 	}
 
-	// add some metadata
-	image.Metadata = getMetadata()
-	if err := WriteOciTarGz(image, outName); err != nil {
+	tags = remoteTags(remote, info, tags)
+	for _, tag := range tags {
+		if !tagPattern.MatchString(tag) {
+			logrus.Errorf("Invalid tag '%s'", tag)
+			return false
+		}
+	}
+	r := NewRegistryClient(insecure)
+	images := []*Image{}
+	metadata := getMetadata()
+	for _, tag := range tags {
+		info.Tag = tag
+		image, err := r.ImageFromRepo(info, platform)
+		if err != nil {
+			logrus.Errorf("Failed to get image from %s: %v", info, err)
+			return false
+		}
+		// add some metadata
+		image.Metadata = metadata
+		if len(tags) > 1 {
+			image.Tag = tag
+		}
+		images = append(images, image)
+	}
+	if err := WriteOciTarGz(images, outName, false); err != nil {
 		logrus.Errorf("Failed to write image to %s: %v", outName, err)
 		return false
 	}
-	logrus.Infof("Successfully downloaded %s to %s", info, outName)
+	logrus.Infof("Successfully downloaded %s to %s", strings.Join(tags, ", "), outName)
 	return true
 }
 
-// ImageFromRepo gets an image from a repository.
-func (r *RegistryClient) ImageFromRepo(info *RepoInfo) (*Image, error) {
-	return imageFromDigest(r.ImageGetter(info), "manifest", nil)
+// ImageFromRepo gets an image from a repository. If the tag refers to an
+// image index or manifest list, the image for platform is selected. A nil
+// platform selects the image for the host.
+func (r *RegistryClient) ImageFromRepo(info *RepoInfo, platform *v1.Platform) (*Image, error) {
+	manb, err := r.GetObject(info, path.Join("manifests", info.Tag))
+	if err != nil {
+		return nil, err
+	}
+	manb, selected, err := resolveIndex(r.ManifestGetter(info), manb, platform)
+	if err != nil {
+		return nil, err
+	}
+	image, err := imageFromManifest(r.ImageGetter(info), r.BlobGetter(info), manb, nil)
+	if err != nil {
+		return nil, err
+	}
+	image.Platform = selected
+	if selected == nil {
+		warnPlatformMismatch(image, platform)
+	}
+	image.Source = info.Host + "/" + info.Reponame
+	return image, nil
+}
+
+// addMountSource adds repo to the repositories that blobs may be mounted from
+// unless it is the destination repository or already present.
+func addMountSource(info *RepoInfo, repo string) {
+	repo = strings.Trim(repo, "/")
+	if repo == "" || repo == info.Reponame {
+		return
+	}
+	for _, existing := range info.MountFrom {
+		if existing == repo {
+			return
+		}
+	}
+	info.MountFrom = append(info.MountFrom, repo)
+}
+
+// addImageMountSource adds the repository an image was pulled from as a
+// mount source if it is in the same registry as info.
+func addImageMountSource(info *RepoInfo, image *Image) {
+	parts := strings.SplitN(image.Source, "/", 2)
+	if len(parts) == 2 && parts[0] == info.Host {
+		addMountSource(info, parts[1])
+	}
+}
+
+// ManifestGetter returns a function which gets a manifest by digest from the
+// registry in the registry client it is called on.
+func (r *RegistryClient) ManifestGetter(info *RepoInfo) Extractor {
+	return func(digest gdigest.Digest) ([]byte, error) {
+		return r.GetObject(info, path.Join("manifests", string(digest)))
+	}
 }
 
 // ImageGetter returns a function which gets an object from the
@@ -189,45 +478,37 @@ func (r *RegistryClient) ImageGetter(info *RepoInfo) Extractor {
 	}
 }
 
-func extractAuth(resp *http.Response, info *RepoInfo) error {
-	val := resp.Header.Get("WWW-Authenticate")
-	parts := strings.Fields(val)
-	if len(parts) != 2 || parts[0] != "Bearer" {
-		return fmt.Errorf("invalid WWW-Authenticate header: '%s'", val)
+// BlobGetter returns a function which returns blobs that stream their
+// content from the registry in the registry client it is called on.
+func (r *RegistryClient) BlobGetter(info *RepoInfo) BlobGetter {
+	return func(desc v1.Descriptor) (Blob, error) {
+		return &remoteBlob{r, info, desc}, nil
 	}
-	keyvals := strings.Split(parts[1], ",")
-	items := map[string]string{}
-	for _, keyval := range keyvals {
-		pieces := strings.Split(keyval, "=")
-		if len(pieces) != 2 {
-			return fmt.Errorf("invalid value in WWW-Authenticate header: '%s'", val)
-		}
-		// strip quotes
-		if pieces[1][0] == '"' || pieces[1][0] == '\'' {
-			pieces[1] = pieces[1][1 : len(pieces[1])-1]
-		}
+}
 
-		items[pieces[0]] = pieces[1]
-	}
-	info.Auth = items["realm"]
-	if info.Auth == "" {
-		return fmt.Errorf("realm not found in WWW-Authenticate header: '%s'", val)
-	}
-	info.Service = items["service"]
-	if info.Auth == "" {
-		return fmt.Errorf("service not found in WWW-Authenticate header: '%s'", val)
+// remoteBlob is a blob that is downloaded from a registry each time it is
+// opened. The content is verified against the digest as it is read.
+type remoteBlob struct {
+	r    *RegistryClient
+	info *RepoInfo
+	desc v1.Descriptor
+}
+
+func (b *remoteBlob) Open() (io.ReadCloser, error) {
+	in, err := b.r.GetObjectReader(b.info, path.Join("blobs", string(b.desc.Digest)))
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	return newVerifyingReader(in, b.desc.Digest), nil
 }
 
-// GetTokenResponse is a type that provides the json structure of token
-// response.
-type GetTokenResponse struct {
-	Token string `json:"token,omitempty"`
+func (b *remoteBlob) Size() int64 {
+	return b.desc.Size
 }
 
 // PrepPutObject attempts to auth to the repo and perform a POST. It returns the uploadURL
-// that is returned in the headers from a successful auth and post.
+// that is returned in the headers from a successful auth and post. The digest
+// must be added to the uploadURL to complete the upload.
 func (r *RegistryClient) PrepPutObject(info *RepoInfo, path string) (string, error) {
 	// if Auth is not set, we will get a 401 and retry below
 	if info.Token == "" && info.Auth != "" {
@@ -236,15 +517,14 @@ func (r *RegistryClient) PrepPutObject(info *RepoInfo, path string) (string, err
 			return "", err
 		}
 	}
-	digest := path[len("blobs/"):]
 	postURL := fmt.Sprintf("%s://%s/v2/%s/blobs/uploads/",
 		info.Scheme, info.Host, info.Reponame)
 	req, err := http.NewRequest("POST", postURL, nil)
 	if err != nil {
 		return "", err
 	}
-	if info.Token != "" {
-		req.Header.Set("Authorization", "Bearer "+info.Token)
+	if err := r.authorize(req, info); err != nil {
+		return "", err
 	}
 	logrus.Debugf("Prepping put to %s", postURL)
 	resp, err := r.Client.Do(req)
@@ -253,11 +533,7 @@ func (r *RegistryClient) PrepPutObject(info *RepoInfo, path string) (string, err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode == 401 {
-		if info.Token != "" {
-			return "", fmt.Errorf("Token is invalid for %s", info.Reponame)
-		}
-		// we don't have a token so extract auth data
-		if err := extractAuth(resp, info); err != nil {
+		if err := r.reauthorize(resp, info); err != nil {
 			return "", err
 		}
 		// try again
@@ -275,20 +551,31 @@ func (r *RegistryClient) PrepPutObject(info *RepoInfo, path string) (string, err
 	if uploadURL == "" {
 		return "", fmt.Errorf("Repository did not return an upload url")
 	}
-	if strings.HasPrefix(uploadURL, "/") {
-		uploadURL = fmt.Sprintf("%s://%s%s", info.Scheme, info.Host, uploadURL)
-	}
-	if strings.Contains(uploadURL, "?") {
-		uploadURL += "&digest=" + digest
-	} else {
-		uploadURL += "?digest=" + digest
-	}
+	uploadURL = absoluteURL(info, uploadURL)
 	logrus.Debugf("Got %s for %s", uploadURL, path)
 	return uploadURL, nil
 }
 
-// PutObject puts an object to the repo in "info" at the path in "path".
-func (r *RegistryClient) PutObject(info *RepoInfo, path, ct string, data []byte) error {
+// absoluteURL adds the scheme and host from info to a url returned by the
+// registry in a Location header if necessary.
+func absoluteURL(info *RepoInfo, u string) string {
+	if strings.HasPrefix(u, "/") {
+		return fmt.Sprintf("%s://%s%s", info.Scheme, info.Host, u)
+	}
+	return u
+}
+
+// addQuery appends a query parameter to a url that may already have a query.
+func addQuery(u, key, value string) string {
+	if strings.Contains(u, "?") {
+		return u + "&" + key + "=" + url.QueryEscape(value)
+	}
+	return u + "?" + key + "=" + url.QueryEscape(value)
+}
+
+// PutObject puts an object to the repo in "info" at the path in "path". The
+// content of the blob is streamed to the registry.
+func (r *RegistryClient) PutObject(info *RepoInfo, path, ct string, blob Blob) error {
 	if info.Host == "" {
 		return fmt.Errorf("Host must be specified")
 	}
@@ -312,8 +599,8 @@ func (r *RegistryClient) PutObject(info *RepoInfo, path, ct string, data []byte)
 		if err != nil {
 			return err
 		}
-		if info.Token != "" {
-			req.Header.Set("Authorization", "Bearer "+info.Token)
+		if err := r.authorize(req, info); err != nil {
+			return err
 		}
 		resp, err := r.Client.Do(req)
 		if err != nil {
@@ -323,26 +610,36 @@ func (r *RegistryClient) PutObject(info *RepoInfo, path, ct string, data []byte)
 		// we should have a token by this point, but handle 401
 		// here as well just in case
 		if resp.StatusCode == 401 {
-			if info.Token != "" {
-				return fmt.Errorf("Token is invalid for %s", info.Reponame)
-			}
-			// we don't have a token so extract auth data
-			if err := extractAuth(resp, info); err != nil {
+			if err := r.reauthorize(resp, info); err != nil {
 				return err
 			}
 			logrus.Debugf("Retrying %s with a token", path)
-			return r.PutObject(info, path, ct, data)
+			return r.PutObject(info, path, ct, blob)
 		} else if resp.StatusCode == 200 {
 			// object exists so bail
 			logrus.Infof("Object at %s already exists", path)
 			return nil
 		} else if resp.StatusCode == 404 {
-			// object is not found so prep to put it
-			var err error
-			u, err = r.PrepPutObject(info, path)
+			// object is not found so try to mount it from another
+			// repository before prepping to put it
+			mounted, session, err := r.MountObject(info, path)
 			if err != nil {
 				return err
 			}
+			if mounted {
+				return nil
+			}
+			u = session
+			if u == "" {
+				u, err = r.PrepPutObject(info, path)
+				if err != nil {
+					return err
+				}
+			}
+			if r.ChunkSize > 0 {
+				return r.PutChunked(info, path, u, blob)
+			}
+			u = addQuery(u, "digest", path[len("blobs/"):])
 		} else {
 			// something went wrong
 			var buf bytes.Buffer
@@ -353,12 +650,19 @@ func (r *RegistryClient) PutObject(info *RepoInfo, path, ct string, data []byte)
 				resp.StatusCode, string(buf.Bytes()))
 		}
 	}
-	req, err := http.NewRequest("PUT", u, bytes.NewReader(data))
+	in, err := blob.Open()
 	if err != nil {
 		return err
 	}
-	if info.Token != "" {
-		req.Header.Set("Authorization", "Bearer "+info.Token)
+	req, err := http.NewRequest("PUT", u, in)
+	if err != nil {
+		in.Close()
+		return err
+	}
+	req.ContentLength = blob.Size()
+	if err := r.authorize(req, info); err != nil {
+		in.Close()
+		return err
 	}
 	req.Header.Set("Content-Type", ct)
 	logrus.Debugf("Uploading %s", path)
@@ -368,15 +672,11 @@ func (r *RegistryClient) PutObject(info *RepoInfo, path, ct string, data []byte)
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode == 401 {
-		if info.Token != "" {
-			return fmt.Errorf("Token is invalid for %s", info.Reponame)
-		}
-		// we don't have a token so extract auth data
-		if err := extractAuth(resp, info); err != nil {
+		if err := r.reauthorize(resp, info); err != nil {
 			return err
 		}
 		logrus.Debugf("Retrying %s with a token", path)
-		return r.PutObject(info, path, ct, data)
+		return r.PutObject(info, path, ct, blob)
 	} else if resp.StatusCode != 201 {
 		var buf bytes.Buffer
 		if _, err = buf.ReadFrom(resp.Body); err != nil {
@@ -392,6 +692,22 @@ func (r *RegistryClient) PutObject(info *RepoInfo, path, ct string, data []byte)
 // GetObject gets an object at the path specified in "path" from the repo in
 // "info".
 func (r *RegistryClient) GetObject(info *RepoInfo, path string) ([]byte, error) {
+	in, err := r.GetObjectReader(info, path)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	var buf bytes.Buffer
+	if _, err = buf.ReadFrom(in); err != nil {
+		return nil, err
+	}
+	logrus.Infof("Downloaded %s", path)
+	return buf.Bytes(), nil
+}
+
+// GetObjectReader returns a reader that streams the object at the path
+// specified in "path" from the repo in "info". The caller must close it.
+func (r *RegistryClient) GetObjectReader(info *RepoInfo, path string) (io.ReadCloser, error) {
 	if info.Host == "" {
 		return nil, fmt.Errorf("Host must be specified")
 	}
@@ -412,30 +728,28 @@ func (r *RegistryClient) GetObject(info *RepoInfo, path string) ([]byte, error)
 	if err != nil {
 		return nil, err
 	}
-	if info.Token != "" {
-		req.Header.Set("Authorization", "Bearer "+info.Token)
+	if err := r.authorize(req, info); err != nil {
+		return nil, err
 	}
 	if strings.HasPrefix(path, "manifests/") {
-		// accept oci or dockerv2 type for manifest
-		req.Header.Set("Accept", manifestMT+","+dockerManifestMT)
+		// accept oci or dockerv2 type for manifest or index
+		accept := []string{manifestMT, dockerManifestMT, indexMT, dockerListMT}
+		req.Header.Set("Accept", strings.Join(accept, ","))
 	}
 	logrus.Debugf("Downloading %s", path)
 	resp, err := r.Client.Do(req)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
 	if resp.StatusCode == 401 {
-		if info.Token != "" {
-			return nil, fmt.Errorf("Token is invalid for %s", info.Reponame)
-		}
-		// we don't have a token so extract auth data
-		if err := extractAuth(resp, info); err != nil {
+		defer resp.Body.Close()
+		if err := r.reauthorize(resp, info); err != nil {
 			return nil, err
 		}
 		logrus.Debugf("Retrying %s with a token", path)
-		return r.GetObject(info, path)
+		return r.GetObjectReader(info, path)
 	} else if resp.StatusCode != 200 {
+		defer resp.Body.Close()
 		var buf bytes.Buffer
 		if _, err = buf.ReadFrom(resp.Body); err != nil {
 			logrus.Warnf("Failed to read response body: %v", err)
@@ -443,53 +757,5 @@ func (r *RegistryClient) GetObject(info *RepoInfo, path string) ([]byte, error)
 		return nil, fmt.Errorf("Get request returned invalid response %d:\n%s",
 			resp.StatusCode, string(buf.Bytes()))
 	}
-	var buf bytes.Buffer
-	if _, err = buf.ReadFrom(resp.Body); err != nil {
-		return nil, err
-	}
-	logrus.Infof("Downloaded %s", path)
-	return buf.Bytes(), nil
-}
-
-// GetToken gets an authentication token that will be used for authentication
-// of calls made on the reciever RegistryClient.
-func (r *RegistryClient) GetToken(info *RepoInfo, actions []string) error {
-	if info.Host == "" {
-		return fmt.Errorf("Host must be specified")
-	}
-	if info.Reponame == "" {
-		return fmt.Errorf("Reponame must be specified")
-	}
-	act := strings.Join(actions, ",")
-	u := fmt.Sprintf("%s?service=%s&scope=repository:%s:%s",
-		info.Auth, info.Service, info.Reponame, act)
-
-	req, err := http.NewRequest("GET", u, nil)
-
-	if info.Username != "" {
-		userPass := fmt.Sprintf("%s:%s", info.Username, info.Password)
-		cred := base64.StdEncoding.EncodeToString([]byte(userPass))
-		req.Header.Set("Authorization", "Basic "+cred)
-	}
-	logrus.Debugf("Making auth request to %s", u)
-	resp, err := r.Client.Do(req)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != 200 {
-		var buf bytes.Buffer
-		if _, err = buf.ReadFrom(resp.Body); err != nil {
-			logrus.Warnf("Failed to read response body: %v", err)
-		}
-		return fmt.Errorf("Auth server returned invalid response %d:\n%s",
-			resp.StatusCode, string(buf.Bytes()))
-	}
-	tokenResponse := GetTokenResponse{}
-	decoder := json.NewDecoder(resp.Body)
-	if err := decoder.Decode(&tokenResponse); err != nil {
-		return err
-	}
-	info.Token = tokenResponse.Token
-	return nil
+	return resp.Body, nil
 }
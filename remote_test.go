@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeRegistry implements enough of the distribution api to test uploads
+// and downloads. Blobs are stored per repository as repo@digest. If failPatch
+// is set, that PATCH request will only store half of its data before failing
+// to simulate an interrupted upload, and the first failStatus requests for
+// the status of an upload fail.
+type fakeRegistry struct {
+	sync.Mutex
+	blobs      map[string][]byte
+	mounts     int
+	manifests  map[string][]byte
+	uploads    map[string][]byte
+	failPatch  int
+	failStatus int
+	patches    int
+	nextID     int
+}
+
+func newFakeRegistry() *fakeRegistry {
+	return &fakeRegistry{
+		blobs:     map[string][]byte{},
+		manifests: map[string][]byte{},
+		uploads:   map[string][]byte{},
+	}
+}
+
+func (f *fakeRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	p := strings.TrimPrefix(req.URL.Path, "/v2/")
+	switch {
+	case p == "":
+		// api version check
+		w.WriteHeader(200)
+	case strings.Contains(p, "/blobs/uploads/"):
+		f.serveUpload(w, req, p)
+	case strings.Contains(p, "/blobs/"):
+		i := strings.Index(p, "/blobs/")
+		data, ok := f.blobs[p[:i]+"@"+p[i+len("/blobs/"):]]
+		if !ok {
+			w.WriteHeader(404)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.WriteHeader(200)
+		if req.Method == "GET" {
+			w.Write(data)
+		}
+	case strings.Contains(p, "/manifests/"):
+		ref := p[strings.LastIndex(p, "/")+1:]
+		if req.Method == "PUT" {
+			data, _ := ioutil.ReadAll(req.Body)
+			f.manifests[ref] = data
+			f.manifests[string(digest(data))] = data
+			w.WriteHeader(201)
+			return
+		}
+		data, ok := f.manifests[ref]
+		if !ok {
+			w.WriteHeader(404)
+			return
+		}
+		w.WriteHeader(200)
+		w.Write(data)
+	default:
+		w.WriteHeader(404)
+	}
+}
+
+func (f *fakeRegistry) serveUpload(w http.ResponseWriter, req *http.Request, p string) {
+	repo := p[:strings.Index(p, "/blobs/uploads/")]
+	base := repo + "/blobs/uploads/"
+	id := p[len(base):]
+	if req.Method == "POST" && req.URL.Query().Get("mount") != "" {
+		from := req.URL.Query().Get("from")
+		d := req.URL.Query().Get("mount")
+		if data, ok := f.blobs[from+"@"+d]; ok {
+			f.blobs[repo+"@"+d] = data
+			f.mounts++
+			w.WriteHeader(201)
+			return
+		}
+	}
+	if req.Method == "POST" {
+		f.nextID++
+		id = strconv.Itoa(f.nextID)
+		f.uploads[id] = []byte{}
+		w.Header().Set("Location", "/v2/"+base+id)
+		w.WriteHeader(202)
+		return
+	}
+	data, ok := f.uploads[id]
+	if !ok {
+		w.WriteHeader(404)
+		return
+	}
+	switch req.Method {
+	case "GET":
+		if f.failStatus > 0 {
+			f.failStatus--
+			w.WriteHeader(500)
+			return
+		}
+	case "PATCH":
+		f.patches++
+		start := 0
+		fmt.Sscanf(req.Header.Get("Content-Range"), "%d-", &start)
+		if start != len(data) {
+			w.WriteHeader(416)
+			return
+		}
+		body, _ := ioutil.ReadAll(req.Body)
+		if f.patches == f.failPatch {
+			f.uploads[id] = append(data, body[:len(body)/2]...)
+			w.WriteHeader(500)
+			return
+		}
+		f.uploads[id] = append(data, body...)
+	case "PUT":
+		body, _ := ioutil.ReadAll(req.Body)
+		data = append(data, body...)
+		d := req.URL.Query().Get("digest")
+		if string(digest(data)) != d {
+			w.WriteHeader(400)
+			return
+		}
+		f.blobs[repo+"@"+d] = data
+		delete(f.uploads, id)
+		w.WriteHeader(201)
+		return
+	}
+	w.Header().Set("Location", "/v2/"+base+id)
+	// like docker distribution, an empty session is reported as 0-0
+	end := len(f.uploads[id]) - 1
+	if end < 0 {
+		end = 0
+	}
+	w.Header().Set("Range", fmt.Sprintf("0-%d", end))
+	if req.Method == "GET" {
+		w.WriteHeader(204)
+	} else {
+		w.WriteHeader(202)
+	}
+}
+
+func TestChunkedUploadResume(t *testing.T) {
+	registry := newFakeRegistry()
+	registry.failPatch = 2
+	server := httptest.NewServer(registry)
+	defer server.Close()
+
+	info, err := parseRepoInfo(server.URL+"/test/repo", false)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	data := make([]byte, 5000)
+	rand.Read(data)
+	d := digest(data)
+
+	r := NewRegistryClient(false)
+	r.ChunkSize = 1024
+	if err := r.PutObject(info, "blobs/"+string(d), layerMT, bytesBlob(data)); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !bytes.Equal(registry.blobs["test/repo@"+string(d)], data) {
+		t.Fatalf("Uploaded blob doesn't match")
+	}
+	if registry.patches <= 5 {
+		t.Fatalf("Upload was not resumed, only %d patches", registry.patches)
+	}
+}
+
+func TestChunkedUploadStatus(t *testing.T) {
+	// the first patch stores no data or a single byte, both reported as 0-0
+	for _, chunkSize := range []int64{1, 2} {
+		registry := newFakeRegistry()
+		registry.failPatch = 1
+		registry.failStatus = 2
+		server := httptest.NewServer(registry)
+		defer server.Close()
+
+		info, err := parseRepoInfo(server.URL+"/test/repo", false)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		data := []byte("0123456789")
+		d := digest(data)
+
+		r := NewRegistryClient(false)
+		r.ChunkSize = chunkSize
+		if err := r.PutObject(info, "blobs/"+string(d), layerMT, bytesBlob(data)); err != nil {
+			t.Fatalf("Chunk size %d: %v", chunkSize, err)
+		}
+		if !bytes.Equal(registry.blobs["test/repo@"+string(d)], data) {
+			t.Fatalf("Uploaded blob %q doesn't match", registry.blobs["test/repo@"+string(d)])
+		}
+	}
+}
+
+func TestMonolithicUpload(t *testing.T) {
+	registry := newFakeRegistry()
+	server := httptest.NewServer(registry)
+	defer server.Close()
+
+	info, err := parseRepoInfo(server.URL+"/test/repo", false)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	data := []byte("monolithic")
+	d := digest(data)
+
+	r := NewRegistryClient(false)
+	r.ChunkSize = 0
+	if err := r.PutObject(info, "blobs/"+string(d), layerMT, bytesBlob(data)); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !bytes.Equal(registry.blobs["test/repo@"+string(d)], data) {
+		t.Fatalf("Uploaded blob doesn't match")
+	}
+	if registry.patches != 0 {
+		t.Fatalf("Monolithic upload used %d patches", registry.patches)
+	}
+}
+
+func TestMountUpload(t *testing.T) {
+	registry := newFakeRegistry()
+	server := httptest.NewServer(registry)
+	defer server.Close()
+
+	data := []byte("mounted")
+	d := digest(data)
+	registry.blobs["test/source@"+string(d)] = data
+
+	info, err := parseRepoInfo(server.URL+"/test/repo", false)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	image := &Image{Source: info.Host + "/test/source"}
+	addImageMountSource(info, image)
+	addMountSource(info, "test/missing")
+
+	r := NewRegistryClient(false)
+	if err := r.PutObject(info, "blobs/"+string(d), layerMT, bytesBlob(data)); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if registry.mounts != 1 {
+		t.Fatalf("Blob was not mounted")
+	}
+	if !bytes.Equal(registry.blobs["test/repo@"+string(d)], data) {
+		t.Fatalf("Mounted blob doesn't match")
+	}
+
+	// blobs missing from all sources fall back to a normal upload
+	other := []byte("uploaded")
+	d = digest(other)
+	if err := r.PutObject(info, "blobs/"+string(d), layerMT, bytesBlob(other)); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !bytes.Equal(registry.blobs["test/repo@"+string(d)], other) {
+		t.Fatalf("Uploaded blob doesn't match")
+	}
+}
+
+func TestExpandTags(t *testing.T) {
+	image := &Image{
+		Config:   configFromDef(&ConfigDef{Labels: map[string]string{"version": "1.2.3"}}, hostPlatform()),
+		Metadata: &ImageMetadata{Buildno: "42"},
+	}
+	tags, err := expandTags([]string{"{{.Labels.version}}", "{{.Labels.version}}-{{.Buildno}}", "latest", "1.2.3"}, image)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	expected := []string{"1.2.3", "1.2.3-42", "latest"}
+	if strings.Join(tags, " ") != strings.Join(expected, " ") {
+		t.Fatalf("expandTags returned %v, expected %v", tags, expected)
+	}
+	for _, tag := range []string{"{{.Labels.missing}}", "bad/tag", "{{.Nope}}", ""} {
+		if _, err := expandTags([]string{tag}, image); err == nil {
+			t.Errorf("expandTags(%q) succeeded, expected error", tag)
+		}
+	}
+}
+
+func TestRemoteTags(t *testing.T) {
+	tests := []struct {
+		remote   string
+		tags     []string
+		expected []string
+	}{
+		{"https://reg/repo", nil, []string{"latest"}},
+		{"https://reg/repo", []string{"1.2", "1.2.3"}, []string{"1.2", "1.2.3"}},
+		{"https://reg/repo:1.2", []string{"latest", "1.2"}, []string{"1.2", "latest"}},
+	}
+	for _, test := range tests {
+		info, err := parseRepoInfo(test.remote, false)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		tags := remoteTags(test.remote, info, test.tags)
+		if strings.Join(tags, " ") != strings.Join(test.expected, " ") {
+			t.Errorf("remoteTags(%q, %v) = %v, expected %v", test.remote, test.tags, tags, test.expected)
+		}
+	}
+}
+
+func TestMultipleTags(t *testing.T) {
+	registry := newFakeRegistry()
+	server := httptest.NewServer(registry)
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "smith-test-")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.MkdirAll(filepath.Join(dir, rootfs), 0755); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, rootfs, "data"), []byte("data"), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+	image, err := imageFromBuild(&ConfigDef{}, dir, hostPlatform(), false)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	info, err := parseRepoInfo(server.URL+"/test/repo", false)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	r := NewRegistryClient(false)
+	if err := r.ImageToRepo(info, image, []string{"1.2.3", "1.2", "latest"}); err != nil {
+		t.Fatalf("%v", err)
+	}
+	for _, tag := range []string{"1.2", "latest"} {
+		if !bytes.Equal(registry.manifests[tag], registry.manifests["1.2.3"]) {
+			t.Fatalf("Manifest for %s doesn't match", tag)
+		}
+	}
+
+	outpath := filepath.Join(dir, "image.tar.gz")
+	if !downloadContainer(outpath, server.URL+"/test/repo:1.2.3", false, "", []string{"latest"}) {
+		t.Fatalf("Download failed")
+	}
+	for _, tag := range []string{"1.2.3", "latest"} {
+		loaded, err := imageFromFile(outpath+":"+tag, nil)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		defer loaded.Close()
+		if loaded.Tag != tag || loaded.Layers[0].Desc.Digest != image.Layers[0].Desc.Digest {
+			t.Fatalf("Image for tag %s doesn't match", tag)
+		}
+	}
+}
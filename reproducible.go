@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const sourceDateEpochEnv = "SOURCE_DATE_EPOCH"
+
+// buildTime returns the time to record for a build. Reproducible builds use
+// SOURCE_DATE_EPOCH if it is set and the unix epoch otherwise.
+func buildTime(reproducible bool) time.Time {
+	if !reproducible {
+		return time.Now().UTC()
+	}
+	if val := os.Getenv(sourceDateEpochEnv); val != "" {
+		epoch, err := strconv.ParseInt(val, 10, 64)
+		if err == nil {
+			return time.Unix(epoch, 0).UTC()
+		}
+		logrus.Warnf("Ignoring invalid %s %q", sourceDateEpochEnv, val)
+	}
+	return time.Unix(0, 0).UTC()
+}
+
+// diffBuilds writes the differences between the images in the oci layouts
+// at a and b to w, from the manifests down to individual files. It returns
+// true if they differ.
+func diffBuilds(w io.Writer, a, b string) (bool, error) {
+	outA, err := inspectFile(a)
+	if err != nil {
+		return false, err
+	}
+	outB, err := inspectFile(b)
+	if err != nil {
+		return false, err
+	}
+	if len(outA.Images) != len(outB.Images) {
+		fmt.Fprintf(w, "Number of images: %d -> %d\n", len(outA.Images), len(outB.Images))
+		return true, nil
+	}
+	differ := false
+	for i := range outA.Images {
+		imageA, imageB := &outA.Images[i], &outB.Images[i]
+		if imageA.Digest == imageB.Digest {
+			continue
+		}
+		differ = true
+		name := "image"
+		if imageA.Platform != nil {
+			name = platformString(*imageA.Platform)
+		}
+		fmt.Fprintf(w, "%s:\n", name)
+		fmt.Fprintf(w, "  manifest: %s -> %s\n", imageA.Digest, imageB.Digest)
+		for _, change := range diffAnnotations(imageA.Annotations, imageB.Annotations) {
+			fmt.Fprintf(w, "  annotation %s\n", change)
+		}
+		if imageA.Manifest.Config.Digest != imageB.Manifest.Config.Digest {
+			fmt.Fprintf(w, "  config: %s -> %s\n", imageA.Manifest.Config.Digest, imageB.Manifest.Config.Digest)
+		}
+		layersA, layersB := imageA.Manifest.Layers, imageB.Manifest.Layers
+		if len(layersA) != len(layersB) {
+			fmt.Fprintf(w, "  number of layers: %d -> %d\n", len(layersA), len(layersB))
+		}
+		layersDiffer := false
+		for j := 0; j < len(layersA) && j < len(layersB); j++ {
+			if layersA[j].Digest != layersB[j].Digest {
+				layersDiffer = true
+				fmt.Fprintf(w, "  layer %d: %s -> %s\n", j, layersA[j].Digest, layersB[j].Digest)
+			}
+		}
+		if !bytes.Equal(imageA.Spec, imageB.Spec) {
+			fmt.Fprintf(w, "  smith spec differs\n")
+		}
+
+		output, err := diffPlatform(a, b, imageA, imageB)
+		if err != nil {
+			return true, err
+		}
+		if !output.Empty() {
+			printDiff(w, output)
+		} else if layersDiffer {
+			fmt.Fprintf(w, "  file contents match, layers differ in tar metadata or compression\n")
+		}
+	}
+	return differ, nil
+}
+
+// diffAnnotations lists the annotations that differ between a and b.
+func diffAnnotations(a, b map[string]string) []string {
+	changes := []string{}
+	for _, key := range sortedKeys(a) {
+		if val, ok := b[key]; !ok {
+			changes = append(changes, fmt.Sprintf("%s: %s -> (none)", key, a[key]))
+		} else if val != a[key] {
+			changes = append(changes, fmt.Sprintf("%s: %s -> %s", key, a[key], val))
+		}
+	}
+	for _, key := range sortedKeys(b) {
+		if _, ok := a[key]; !ok {
+			changes = append(changes, fmt.Sprintf("%s: (none) -> %s", key, b[key]))
+		}
+	}
+	return changes
+}
+
+// diffPlatform diffs the config, packages and files of the images for one
+// platform in the layouts at a and b.
+func diffPlatform(a, b string, inspectA, inspectB *inspectImage) (*diffOutput, error) {
+	imageA, err := imageFromFile(a, inspectA.Platform)
+	if err != nil {
+		return nil, err
+	}
+	defer imageA.Close()
+	imageB, err := imageFromFile(b, inspectB.Platform)
+	if err != nil {
+		return nil, err
+	}
+	defer imageB.Close()
+	filesA, err := mergedFiles(imageA, true)
+	if err != nil {
+		return nil, err
+	}
+	filesB, err := mergedFiles(imageB, true)
+	if err != nil {
+		return nil, err
+	}
+	output := &diffOutput{Old: a, New: b}
+	output.Config = diffConfigs(&imageA.Config.Config, &imageB.Config.Config)
+	output.Packages.Added, output.Packages.Removed = setDiff(inspectA.Packages, inspectB.Packages)
+	output.Files = diffFiles(filesA, filesB)
+	return output, nil
+}
+
+// verifyReproducible builds the image twice in reproducible mode and reports
+// any differences between the two results.
+func verifyReproducible(buildOpts *buildOptions) bool {
+	opts := *buildOpts
+	opts.reproducible = true
+	opts.fast = false
+	// the second build would just restore the first from the cache
+	opts.noCache = true
+
+	outDir, err := ioutil.TempDir("", "smith-verify-")
+	if err != nil {
+		logrus.Errorf("Unable to get temp dir: %v", err)
+		return false
+	}
+	defer os.RemoveAll(outDir)
+
+	// each build writes to its own dir since configs with images have
+	// several outputs
+	buildDirs := []string{}
+	for i := 1; i <= 2; i++ {
+		buildDir := filepath.Join(outDir, fmt.Sprintf("build%d", i))
+		logrus.Infof("Starting build %d of 2", i)
+		if !buildContainer(filepath.Join(buildDir, "image.tar.gz"), &opts) {
+			return false
+		}
+		buildDirs = append(buildDirs, buildDir)
+	}
+
+	names := []string{}
+	err = filepath.Walk(buildDirs[0], func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		name, err := filepath.Rel(buildDirs[0], path)
+		names = append(names, name)
+		return err
+	})
+	if err != nil {
+		logrus.Errorf("Failed to list %v: %v", buildDirs[0], err)
+		return false
+	}
+	reproducible := true
+	for _, name := range names {
+		outputs := []string{}
+		digests := []string{}
+		for _, buildDir := range buildDirs {
+			outpath := filepath.Join(buildDir, name)
+			data, err := ioutil.ReadFile(outpath)
+			if err != nil {
+				logrus.Errorf("Failed to read %v: %v", outpath, err)
+				return false
+			}
+			outputs = append(outputs, outpath)
+			digests = append(digests, string(digest(data)))
+		}
+		if digests[0] == digests[1] {
+			logrus.Infof("%s is reproducible: %s", name, digests[0])
+			continue
+		}
+		reproducible = false
+		fmt.Printf("Builds of %s differ: %s -> %s\n", name, digests[0], digests[1])
+		differ, err := diffBuilds(os.Stdout, outputs[0], outputs[1])
+		if err != nil {
+			logrus.Errorf("Failed to compare builds: %v", err)
+			return false
+		}
+		if !differ {
+			fmt.Printf("Images match, layout differs in index or extra blobs\n")
+		}
+	}
+	if !reproducible {
+		logrus.Errorf("Build is not reproducible")
+		return false
+	}
+	return true
+}
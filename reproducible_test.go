@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuildTime(t *testing.T) {
+	defer os.Setenv(sourceDateEpochEnv, os.Getenv(sourceDateEpochEnv))
+	os.Setenv(sourceDateEpochEnv, "1500000000")
+	if got := buildTime(true); !got.Equal(time.Unix(1500000000, 0)) {
+		t.Fatalf("buildTime with %s returned %v", sourceDateEpochEnv, got)
+	}
+	if got := buildTime(false); got.Equal(time.Unix(1500000000, 0)) {
+		t.Fatalf("Normal build used %s", sourceDateEpochEnv)
+	}
+	os.Setenv(sourceDateEpochEnv, "")
+	if got := buildTime(true); !got.Equal(time.Unix(0, 0)) {
+		t.Fatalf("reproducible buildTime returned %v", got)
+	}
+}
+
+// buildTestImage builds an image containing a file with content in its own
+// directory and a package named after content and writes it to out with
+// pinned compression.
+func buildTestImage(t *testing.T, dir, content, out string) {
+	rootDir := filepath.Join(dir, rootfs)
+	if err := os.MkdirAll(filepath.Join(rootDir, "etc"), 0755); err != nil {
+		t.Fatalf("%v", err)
+	}
+	for name, data := range map[string]string{"etc/config": content, "data": "data"} {
+		if err := ioutil.WriteFile(filepath.Join(rootDir, name), []byte(data), 0644); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	image, err := imageFromBuild(&ConfigDef{}, dir, hostPlatform(), true)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	image.Metadata = &ImageMetadata{BuildTime: buildTime(true)}
+	image.AdditionalBlobs = []OpaqueBlob{{packagesMT, []byte("pkg-" + content)}}
+	if err := WriteOciTarGz([]*Image{image}, out, true); err != nil {
+		t.Fatalf("%v", err)
+	}
+}
+
+func TestReproducibleBuild(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smith-test-")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	outputs := []string{}
+	for i, content := range []string{"a", "a", "b"} {
+		out := filepath.Join(dir, fmt.Sprintf("image%d.tar.gz", i))
+		buildTestImage(t, filepath.Join(dir, fmt.Sprintf("build%d", i)), content, out)
+		outputs = append(outputs, out)
+	}
+	first, err := ioutil.ReadFile(outputs[0])
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	second, err := ioutil.ReadFile(outputs[1])
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !bytes.Equal(first, second) {
+		t.Fatalf("Builds from identical input differ")
+	}
+
+	var out bytes.Buffer
+	differ, err := diffBuilds(&out, outputs[0], outputs[1])
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if differ {
+		t.Fatalf("diffBuilds reported differences for identical builds:\n%s", out.String())
+	}
+	differ, err = diffBuilds(&out, outputs[0], outputs[2])
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !differ || !strings.Contains(out.String(), "~ /etc/config content changed") {
+		t.Fatalf("diffBuilds didn't report the changed file:\n%s", out.String())
+	}
+	if !strings.Contains(out.String(), "+ pkg-b") {
+		t.Fatalf("diffBuilds didn't report the changed package:\n%s", out.String())
+	}
+}
@@ -0,0 +1,766 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	rpmLeadSize = 96
+
+	rpmTagName              = 1000
+	rpmTagVersion           = 1001
+	rpmTagRelease           = 1002
+	rpmTagEpoch             = 1003
+	rpmTagArch              = 1022
+	rpmTagPreIn             = 1023
+	rpmTagPostIn            = 1024
+	rpmTagOldFilenames      = 1027
+	rpmTagProvideName       = 1047
+	rpmTagRequireFlags      = 1048
+	rpmTagRequireName       = 1049
+	rpmTagRequireVersion    = 1050
+	rpmTagPreInProg         = 1085
+	rpmTagPostInProg        = 1086
+	rpmTagProvideFlags      = 1112
+	rpmTagProvideVersion    = 1113
+	rpmTagDirIndexes        = 1116
+	rpmTagBasenames         = 1117
+	rpmTagDirNames          = 1118
+	rpmTagPayloadCompressor = 1125
+
+	rpmSenseLess    = 1 << 1
+	rpmSenseGreater = 1 << 2
+	rpmSenseEqual   = 1 << 3
+	rpmSenseRpmlib  = 1 << 24
+
+	rpmTypeInt8        = 2
+	rpmTypeInt16       = 3
+	rpmTypeInt32       = 4
+	rpmTypeInt64       = 5
+	rpmTypeString      = 6
+	rpmTypeStringArray = 8
+	rpmTypeI18nString  = 9
+
+	rpmRepodata = "repodata"
+
+	// rpm limits the entries and data of a header to these sizes
+	rpmMaxEntries = 0xffff
+	rpmMaxData    = 256 * 1024 * 1024
+	// cpioMaxName is the longest file name accepted in a payload
+	cpioMaxName = 4096
+)
+
+var (
+	rpmLeadMagic   = []byte{0xed, 0xab, 0xee, 0xdb}
+	rpmHeaderMagic = []byte{0x8e, 0xad, 0xe8, 0x01}
+	cpioMagic      = "070701"
+	cpioTrailer    = "TRAILER!!!"
+)
+
+type rpmEntry struct {
+	Tag    int32
+	Type   uint32
+	Offset int32
+	Count  uint32
+}
+
+// rpmHeader is the signature or main header of an rpm file.
+type rpmHeader struct {
+	entries map[int32]rpmEntry
+	store   []byte
+}
+
+// readRpmHeader reads a header from r. The signature header is padded to a
+// multiple of 8 bytes.
+func readRpmHeader(r io.Reader, pad bool) (*rpmHeader, error) {
+	intro := make([]byte, 16)
+	if _, err := io.ReadFull(r, intro); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(intro[:4], rpmHeaderMagic) {
+		return nil, fmt.Errorf("bad rpm header magic")
+	}
+	count := binary.BigEndian.Uint32(intro[8:])
+	size := binary.BigEndian.Uint32(intro[12:])
+	if count > rpmMaxEntries || size > rpmMaxData {
+		return nil, fmt.Errorf("rpm header is too large: %d entries, %d bytes", count, size)
+	}
+	h := &rpmHeader{entries: map[int32]rpmEntry{}}
+	for i := uint32(0); i < count; i++ {
+		var entry rpmEntry
+		if err := binary.Read(r, binary.BigEndian, &entry); err != nil {
+			return nil, err
+		}
+		h.entries[entry.Tag] = entry
+	}
+	h.store = make([]byte, size)
+	if _, err := io.ReadFull(r, h.store); err != nil {
+		return nil, err
+	}
+	if pad && size%8 != 0 {
+		if _, err := io.CopyN(ioutil.Discard, r, int64(8-size%8)); err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+// strings returns the value of a string or string array tag.
+func (h *rpmHeader) strings(tag int32) []string {
+	entry, ok := h.entries[tag]
+	if !ok || entry.Offset < 0 || int(entry.Offset) > len(h.store) {
+		return nil
+	}
+	count := int(entry.Count)
+	switch entry.Type {
+	case rpmTypeString:
+		count = 1
+	case rpmTypeStringArray, rpmTypeI18nString:
+	default:
+		return nil
+	}
+	data := h.store[entry.Offset:]
+	result := []string{}
+	for i := 0; i < count; i++ {
+		end := bytes.IndexByte(data, 0)
+		if end == -1 {
+			break
+		}
+		result = append(result, string(data[:end]))
+		data = data[end+1:]
+	}
+	return result
+}
+
+func (h *rpmHeader) string(tag int32) string {
+	if s := h.strings(tag); len(s) != 0 {
+		return s[0]
+	}
+	return ""
+}
+
+// ints returns the value of an integer tag.
+func (h *rpmHeader) ints(tag int32) []int64 {
+	entry, ok := h.entries[tag]
+	if !ok || entry.Offset < 0 {
+		return nil
+	}
+	size := map[uint32]int{rpmTypeInt8: 1, rpmTypeInt16: 2, rpmTypeInt32: 4, rpmTypeInt64: 8}[entry.Type]
+	if size == 0 || int(entry.Offset)+size*int(entry.Count) > len(h.store) {
+		return nil
+	}
+	result := []int64{}
+	for i := 0; i < int(entry.Count); i++ {
+		b := h.store[int(entry.Offset)+i*size:]
+		switch size {
+		case 1:
+			result = append(result, int64(b[0]))
+		case 2:
+			result = append(result, int64(binary.BigEndian.Uint16(b)))
+		case 4:
+			result = append(result, int64(binary.BigEndian.Uint32(b)))
+		case 8:
+			result = append(result, int64(binary.BigEndian.Uint64(b)))
+		}
+	}
+	return result
+}
+
+// rpmFile is an open rpm positioned at the start of its payload.
+type rpmFile struct {
+	*os.File
+	header *rpmHeader
+	reader *bufio.Reader
+}
+
+func openRpm(path string) (*rpmFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(f)
+	lead := make([]byte, rpmLeadSize)
+	if _, err := io.ReadFull(r, lead); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if !bytes.Equal(lead[:4], rpmLeadMagic) {
+		f.Close()
+		return nil, fmt.Errorf("%s is not an rpm", path)
+	}
+	if _, err := readRpmHeader(r, true); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: signature: %v", path, err)
+	}
+	header, err := readRpmHeader(r, false)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: header: %v", path, err)
+	}
+	return &rpmFile{f, header, r}, nil
+}
+
+// payload returns a reader for the decompressed cpio payload.
+func (f *rpmFile) payload() (io.ReadCloser, error) {
+	compressor := f.header.string(rpmTagPayloadCompressor)
+	if compressor == "" {
+		compressor = "gzip"
+	}
+	return decompressReader(f.reader, compressor)
+}
+
+// rpmArch returns the rpm arch names usable on platform in order of
+// preference.
+func rpmArch(platform v1.Platform) []string {
+	arch := map[string]string{
+		"amd64":   "x86_64",
+		"arm64":   "aarch64",
+		"arm":     "armv7hl",
+		"386":     "i686",
+		"ppc64le": "ppc64le",
+		"s390x":   "s390x",
+	}[platform.Architecture]
+	if arch == "" {
+		arch = platform.Architecture
+	}
+	return []string{arch, "noarch"}
+}
+
+// rpmOp converts rpm sense flags to a comparison operator.
+func rpmOp(flags int64) string {
+	op := ""
+	if flags&rpmSenseLess != 0 {
+		op += "<"
+	}
+	if flags&rpmSenseGreater != 0 {
+		op += ">"
+	}
+	if flags&rpmSenseEqual != 0 {
+		op += "="
+	}
+	return op
+}
+
+// rpmDeps zips the names, flags and versions of a dependency tag set.
+// Dependencies on rpmlib features and rich dependencies are skipped.
+func rpmDeps(names []string, flags []int64, versions []string) []pkgDep {
+	deps := []pkgDep{}
+	for i, name := range names {
+		dep := pkgDep{Name: name}
+		if i < len(flags) {
+			if flags[i]&rpmSenseRpmlib != 0 {
+				continue
+			}
+			dep.Op = rpmOp(flags[i])
+		}
+		if i < len(versions) && dep.Op != "" {
+			dep.Version = versions[i]
+		}
+		if strings.HasPrefix(name, "rpmlib(") {
+			continue
+		}
+		if strings.HasPrefix(name, "(") {
+			logrus.Warnf("Ignoring rich dependency %v", name)
+			continue
+		}
+		deps = append(deps, dep)
+	}
+	return deps
+}
+
+// rpmInfo describes the rpm with header h at path.
+func rpmInfo(h *rpmHeader, path string) *pkgInfo {
+	version := h.string(rpmTagVersion) + "-" + h.string(rpmTagRelease)
+	if epoch := h.ints(rpmTagEpoch); len(epoch) != 0 {
+		version = fmt.Sprintf("%d:%s", epoch[0], version)
+	}
+	p := &pkgInfo{
+		Name:    h.string(rpmTagName),
+		Version: version,
+		Arch:    h.string(rpmTagArch),
+		Path:    path,
+	}
+	p.ID = p.Name + "-" + h.string(rpmTagVersion) + "-" + h.string(rpmTagRelease) + "." + p.Arch
+	p.Provides = rpmDeps(h.strings(rpmTagProvideName), h.ints(rpmTagProvideFlags), h.strings(rpmTagProvideVersion))
+	for _, dep := range rpmDeps(h.strings(rpmTagRequireName), h.ints(rpmTagRequireFlags), h.strings(rpmTagRequireVersion)) {
+		p.Requires = append(p.Requires, []pkgDep{dep})
+	}
+	p.Files = h.strings(rpmTagOldFilenames)
+	dirs := h.strings(rpmTagDirNames)
+	indexes := h.ints(rpmTagDirIndexes)
+	for i, base := range h.strings(rpmTagBasenames) {
+		if i < len(indexes) && int(indexes[i]) < len(dirs) {
+			p.Files = append(p.Files, dirs[indexes[i]]+base)
+		}
+	}
+	return p
+}
+
+// readRpmInfo reads the description of the rpm at path.
+func readRpmInfo(path string) (*pkgInfo, error) {
+	f, err := openRpm(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return rpmInfo(f.header, path), nil
+}
+
+// rpmvercmp compares two version segments the way rpm does. Runs of digits
+// compare numerically and are newer than letters, ~ sorts before
+// everything and ^ after everything but the end of the version.
+func rpmvercmp(a, b string) int {
+	if a == b {
+		return 0
+	}
+	isDigit := func(c byte) bool { return c >= '0' && c <= '9' }
+	isAlnum := func(c byte) bool {
+		return isDigit(c) || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+	}
+	for len(a) != 0 || len(b) != 0 {
+		for len(a) != 0 && !isAlnum(a[0]) && a[0] != '~' && a[0] != '^' {
+			a = a[1:]
+		}
+		for len(b) != 0 && !isAlnum(b[0]) && b[0] != '~' && b[0] != '^' {
+			b = b[1:]
+		}
+		if strings.HasPrefix(a, "~") || strings.HasPrefix(b, "~") {
+			if !strings.HasPrefix(a, "~") {
+				return 1
+			}
+			if !strings.HasPrefix(b, "~") {
+				return -1
+			}
+			a, b = a[1:], b[1:]
+			continue
+		}
+		if strings.HasPrefix(a, "^") || strings.HasPrefix(b, "^") {
+			if len(a) == 0 {
+				return -1
+			}
+			if len(b) == 0 {
+				return 1
+			}
+			if !strings.HasPrefix(a, "^") {
+				return 1
+			}
+			if !strings.HasPrefix(b, "^") {
+				return -1
+			}
+			a, b = a[1:], b[1:]
+			continue
+		}
+		if len(a) == 0 || len(b) == 0 {
+			break
+		}
+		digits := isDigit(a[0])
+		segment := func(s string) (string, string) {
+			i := 0
+			for i < len(s) && isAlnum(s[i]) && isDigit(s[i]) == digits {
+				i++
+			}
+			return s[:i], s[i:]
+		}
+		var sa, sb string
+		sa, a = segment(a)
+		sb, b = segment(b)
+		if sb == "" {
+			if digits {
+				return 1
+			}
+			return -1
+		}
+		if digits {
+			sa = strings.TrimLeft(sa, "0")
+			sb = strings.TrimLeft(sb, "0")
+			if len(sa) != len(sb) {
+				if len(sa) > len(sb) {
+					return 1
+				}
+				return -1
+			}
+		}
+		if c := strings.Compare(sa, sb); c != 0 {
+			return c
+		}
+	}
+	if len(a) == 0 && len(b) == 0 {
+		return 0
+	}
+	if len(a) == 0 {
+		return -1
+	}
+	return 1
+}
+
+// splitEVR splits [epoch:]version[-release].
+func splitEVR(evr string) (int, string, string) {
+	epoch := 0
+	if i := strings.Index(evr, ":"); i != -1 {
+		epoch, _ = strconv.Atoi(evr[:i])
+		evr = evr[i+1:]
+	}
+	release := ""
+	if i := strings.LastIndex(evr, "-"); i != -1 {
+		evr, release = evr[:i], evr[i+1:]
+	}
+	return epoch, evr, release
+}
+
+// compareEVR compares two [epoch:]version[-release] strings. The release
+// is only compared if both have one so a dependency on a version matches
+// every release of it.
+func compareEVR(a, b string) int {
+	ea, va, ra := splitEVR(a)
+	eb, vb, rb := splitEVR(b)
+	if ea != eb {
+		if ea > eb {
+			return 1
+		}
+		return -1
+	}
+	if c := rpmvercmp(va, vb); c != 0 || ra == "" || rb == "" {
+		return c
+	}
+	return rpmvercmp(ra, rb)
+}
+
+type repoMd struct {
+	Data []struct {
+		Type     string `xml:"type,attr"`
+		Location struct {
+			Href string `xml:"href,attr"`
+		} `xml:"location"`
+	} `xml:"data"`
+}
+
+type primaryEntry struct {
+	Name  string `xml:"name,attr"`
+	Flags string `xml:"flags,attr"`
+	Epoch string `xml:"epoch,attr"`
+	Ver   string `xml:"ver,attr"`
+	Rel   string `xml:"rel,attr"`
+}
+
+type primaryPackage struct {
+	Type    string `xml:"type,attr"`
+	Name    string `xml:"name"`
+	Arch    string `xml:"arch"`
+	Version struct {
+		Epoch string `xml:"epoch,attr"`
+		Ver   string `xml:"ver,attr"`
+		Rel   string `xml:"rel,attr"`
+	} `xml:"version"`
+	Location struct {
+		Href string `xml:"href,attr"`
+	} `xml:"location"`
+	Provides []primaryEntry `xml:"format>provides>entry"`
+	Requires []primaryEntry `xml:"format>requires>entry"`
+	Files    []string       `xml:"format>file"`
+}
+
+type primaryMetadata struct {
+	Packages []primaryPackage `xml:"package"`
+}
+
+// primaryEVR formats the version attributes of repodata.
+func primaryEVR(epoch, ver, rel string) string {
+	evr := ver
+	if rel != "" {
+		evr += "-" + rel
+	}
+	if epoch != "" && epoch != "0" {
+		evr = epoch + ":" + evr
+	}
+	return evr
+}
+
+func primaryDeps(entries []primaryEntry) []pkgDep {
+	ops := map[string]string{"LT": "<", "LE": "<=", "EQ": "=", "GE": ">=", "GT": ">"}
+	deps := []pkgDep{}
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name, "rpmlib(") {
+			continue
+		}
+		if strings.HasPrefix(e.Name, "(") {
+			logrus.Warnf("Ignoring rich dependency %v", e.Name)
+			continue
+		}
+		dep := pkgDep{Name: e.Name, Op: ops[e.Flags]}
+		if dep.Op != "" {
+			dep.Version = primaryEVR(e.Epoch, e.Ver, e.Rel)
+		}
+		deps = append(deps, dep)
+	}
+	return deps
+}
+
+// rpmRepoIndex returns the path of the primary metadata of the repo in
+// dir, either from repomd.xml or at repodata/primary.xml.
+func rpmRepoIndex(dir string) (string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, rpmRepodata, "repomd.xml"))
+	if os.IsNotExist(err) {
+		return filepath.Join(dir, rpmRepodata, "primary.xml"), nil
+	}
+	if err != nil {
+		return "", err
+	}
+	var md repoMd
+	if err := xml.Unmarshal(data, &md); err != nil {
+		return "", fmt.Errorf("%s: %v", dir, err)
+	}
+	for _, d := range md.Data {
+		if d.Type == "primary" {
+			return filepath.Join(dir, d.Location.Href), nil
+		}
+	}
+	return "", fmt.Errorf("%s has no primary metadata", dir)
+}
+
+// readRpmRepo returns the packages in the local repo in dir.
+func readRpmRepo(dir string) ([]*pkgInfo, error) {
+	path, err := rpmRepoIndex(dir)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	format := strings.TrimPrefix(filepath.Ext(path), ".")
+	if format == "xml" {
+		format = ""
+	}
+	r, err := decompressReader(f, format)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	var md primaryMetadata
+	if err := xml.NewDecoder(r).Decode(&md); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	pkgs := []*pkgInfo{}
+	for _, mp := range md.Packages {
+		if mp.Type != "" && mp.Type != "rpm" || mp.Arch == "src" {
+			continue
+		}
+		p := &pkgInfo{
+			ID:       mp.Name + "-" + mp.Version.Ver + "-" + mp.Version.Rel + "." + mp.Arch,
+			Name:     mp.Name,
+			Version:  primaryEVR(mp.Version.Epoch, mp.Version.Ver, mp.Version.Rel),
+			Arch:     mp.Arch,
+			Path:     filepath.Join(dir, mp.Location.Href),
+			Provides: primaryDeps(mp.Provides),
+			Files:    mp.Files,
+		}
+		for _, dep := range primaryDeps(mp.Requires) {
+			p.Requires = append(p.Requires, []pkgDep{dep})
+		}
+		pkgs = append(pkgs, p)
+	}
+	return pkgs, nil
+}
+
+// cpioMode converts the mode bits of a cpio header.
+func cpioMode(mode uint64) os.FileMode {
+	m := os.FileMode(mode & 0777)
+	switch mode & 0170000 {
+	case 0040000:
+		m |= os.ModeDir
+	case 0120000:
+		m |= os.ModeSymlink
+	case 0100000:
+	default:
+		m |= os.ModeDevice
+	}
+	if mode&04000 != 0 {
+		m |= os.ModeSetuid
+	}
+	if mode&02000 != 0 {
+		m |= os.ModeSetgid
+	}
+	if mode&01000 != 0 {
+		m |= os.ModeSticky
+	}
+	return m
+}
+
+// cpioLink is a hard link whose data comes with a later link.
+type cpioLink struct {
+	name string
+	mode os.FileMode
+}
+
+// extractCpio writes the files of a newc cpio archive into t.
+func extractCpio(r io.Reader, t *treeExtractor) error {
+	header := make([]byte, 110)
+	// hard linked files only store their data in the last link
+	pending := map[uint64][]cpioLink{}
+	offset := int64(0)
+	skip := func(n int64) error {
+		_, err := io.CopyN(ioutil.Discard, r, n)
+		offset += n
+		return err
+	}
+	align := func() error {
+		if offset%4 != 0 {
+			return skip(4 - offset%4)
+		}
+		return nil
+	}
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return err
+		}
+		offset += int64(len(header))
+		if string(header[:6]) != cpioMagic {
+			return fmt.Errorf("unsupported cpio format %q", header[:6])
+		}
+		fields := make([]uint64, 13)
+		for i := range fields {
+			v, err := strconv.ParseUint(string(header[6+i*8:14+i*8]), 16, 64)
+			if err != nil {
+				return fmt.Errorf("bad cpio header: %v", err)
+			}
+			fields[i] = v
+		}
+		ino, mode, nlink, size, namesize := fields[0], fields[1], fields[4], fields[6], fields[11]
+		if namesize > cpioMaxName {
+			return fmt.Errorf("cpio file name is too long: %d bytes", namesize)
+		}
+		nameBytes := make([]byte, namesize)
+		if _, err := io.ReadFull(r, nameBytes); err != nil {
+			return err
+		}
+		offset += int64(namesize)
+		name := strings.TrimRight(string(nameBytes), "\x00")
+		if err := align(); err != nil {
+			return err
+		}
+		if name == cpioTrailer {
+			return extractPendingLinks(pending, t)
+		}
+		fileMode := cpioMode(mode)
+		data := io.LimitReader(r, int64(size))
+		link := ""
+		if fileMode&os.ModeSymlink != 0 {
+			b, err := ioutil.ReadAll(data)
+			if err != nil {
+				return err
+			}
+			link = string(b)
+		}
+		if fileMode.IsRegular() && nlink > 1 && size == 0 {
+			pending[ino] = append(pending[ino], cpioLink{name, fileMode})
+		} else {
+			if err := t.file(name, fileMode, link, data); err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+			for _, other := range pending[ino] {
+				if err := t.link(other.name, name); err != nil {
+					return fmt.Errorf("%s: %v", other.name, err)
+				}
+			}
+			delete(pending, ino)
+		}
+		// skip whatever wasn't read of the data
+		if _, err := io.Copy(ioutil.Discard, data); err != nil {
+			return err
+		}
+		offset += int64(size)
+		if err := align(); err != nil {
+			return err
+		}
+	}
+}
+
+// extractPendingLinks creates the hard links that never got their data,
+// which happens when the linked file is empty.
+func extractPendingLinks(pending map[uint64][]cpioLink, t *treeExtractor) error {
+	inodes := []uint64{}
+	for ino := range pending {
+		inodes = append(inodes, ino)
+	}
+	sort.Slice(inodes, func(i, j int) bool { return inodes[i] < inodes[j] })
+	for _, ino := range inodes {
+		links := pending[ino]
+		first := links[0]
+		if err := t.file(first.name, first.mode, "", strings.NewReader("")); err != nil {
+			return fmt.Errorf("%s: %v", first.name, err)
+		}
+		for _, other := range links[1:] {
+			if err := t.link(other.name, first.name); err != nil {
+				return fmt.Errorf("%s: %v", other.name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// rpmScriptlet runs a scriptlet of the rpm in the build root. Scriptlets
+// for the embedded lua interpreter can't run outside of rpm and are skipped.
+func rpmScriptlet(h *rpmHeader, root string, ex executor, name string, scriptTag, progTag int32) error {
+	script := h.string(scriptTag)
+	prog := h.strings(progTag)
+	if script == "" && len(prog) == 0 {
+		return nil
+	}
+	if len(prog) == 0 {
+		prog = []string{"/bin/sh"}
+	}
+	if prog[0] == "<lua>" {
+		logrus.Warnf("Skipping lua scriptlet of %v", name)
+		return nil
+	}
+	// the argument is the number of installed instances of the package
+	return runScript(root, ex, name, prog, script, "1")
+}
+
+// installRpm extracts the payload of the rpm at path into the tree of t and
+// runs its scriptlets if scripts is set. It returns the description of the
+// rpm from its header, which unlike repodata lists all of its files.
+func installRpm(path string, t *treeExtractor, ex executor, scripts bool) (*pkgInfo, error) {
+	f, err := openRpm(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	name := filepath.Base(path)
+	logrus.Debugf("Installing %v", name)
+	if scripts {
+		if err := rpmScriptlet(f.header, t.root, ex, name, rpmTagPreIn, rpmTagPreInProg); err != nil {
+			return nil, err
+		}
+	}
+	payload, err := f.payload()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	err = extractCpio(payload, t)
+	if cerr := payload.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	if scripts {
+		err = rpmScriptlet(f.header, t.root, ex, name, rpmTagPostIn, rpmTagPostInProg)
+	}
+	return rpmInfo(f.header, path), err
+}
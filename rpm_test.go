@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRpmvercmp(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		expected int
+	}{
+		{"1.0", "1.0", 0},
+		{"1.0", "2.0", -1},
+		{"2.0.1", "2.0", 1},
+		{"1.10", "1.9", 1},
+		{"1.0a", "1.0", 1},
+		{"1.0", "1.0~rc1", 1},
+		{"1.0^git1", "1.0", 1},
+		{"1.0^git1", "1.0.1", -1},
+		{"a", "1", -1},
+		{"001", "1", 0},
+	}
+	for _, test := range tests {
+		if got := rpmvercmp(test.a, test.b); got != test.expected {
+			t.Errorf("rpmvercmp(%q, %q) = %d, expected %d", test.a, test.b, got, test.expected)
+		}
+	}
+	if compareEVR("1:1.0-1", "2.0-1") != 1 {
+		t.Errorf("Epoch didn't win over version")
+	}
+	if compareEVR("1.0-3", "1.0") != 0 {
+		t.Errorf("Version without release didn't match all releases")
+	}
+}
+
+// testRpmHeader encodes a header with string, string array and int32 tags.
+func testRpmHeader(tags map[int32]interface{}) []byte {
+	var index, store bytes.Buffer
+	keys := []int{}
+	for tag := range tags {
+		keys = append(keys, int(tag))
+	}
+	// entries must be sorted by tag
+	for i := range keys {
+		for j := i + 1; j < len(keys); j++ {
+			if keys[j] < keys[i] {
+				keys[i], keys[j] = keys[j], keys[i]
+			}
+		}
+	}
+	for _, key := range keys {
+		tag := int32(key)
+		entry := rpmEntry{Tag: tag}
+		switch v := tags[tag].(type) {
+		case string:
+			entry.Type, entry.Count, entry.Offset = rpmTypeString, 1, int32(store.Len())
+			store.WriteString(v + "\x00")
+		case []string:
+			entry.Type, entry.Count, entry.Offset = rpmTypeStringArray, uint32(len(v)), int32(store.Len())
+			for _, s := range v {
+				store.WriteString(s + "\x00")
+			}
+		case []int32:
+			for store.Len()%4 != 0 {
+				store.WriteByte(0)
+			}
+			entry.Type, entry.Count, entry.Offset = rpmTypeInt32, uint32(len(v)), int32(store.Len())
+			binary.Write(&store, binary.BigEndian, v)
+		}
+		binary.Write(&index, binary.BigEndian, entry)
+	}
+	var b bytes.Buffer
+	b.Write(rpmHeaderMagic)
+	binary.Write(&b, binary.BigEndian, []uint32{0, uint32(len(tags)), uint32(store.Len())})
+	b.Write(index.Bytes())
+	b.Write(store.Bytes())
+	return b.Bytes()
+}
+
+// writeTestRpm writes an rpm with the given files and requires to path.
+func writeTestRpm(t *testing.T, path, name string, requires []string, files map[string]string) {
+	var cpio bytes.Buffer
+	add := func(name string, mode int, data string) {
+		fmt.Fprintf(&cpio, "070701%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x",
+			cpio.Len(), mode, 0, 0, 1, 0, len(data), 0, 0, 0, 0, len(name)+1, 0)
+		cpio.WriteString(name + "\x00")
+		for cpio.Len()%4 != 0 {
+			cpio.WriteByte(0)
+		}
+		cpio.WriteString(data)
+		for cpio.Len()%4 != 0 {
+			cpio.WriteByte(0)
+		}
+	}
+	dirs := []string{}
+	bases := []string{}
+	indexes := []int32{}
+	for file, data := range files {
+		add("."+file, 0100755, data)
+		dirs = append(dirs, filepath.Dir(file)+"/")
+		bases = append(bases, filepath.Base(file))
+		indexes = append(indexes, int32(len(dirs)-1))
+	}
+	add(cpioTrailer, 0, "")
+
+	flags := make([]int32, len(requires))
+	versions := make([]string, len(requires))
+	header := testRpmHeader(map[int32]interface{}{
+		rpmTagName:           name,
+		rpmTagVersion:        "1.0",
+		rpmTagRelease:        "1",
+		rpmTagArch:           "noarch",
+		rpmTagRequireName:    requires,
+		rpmTagRequireFlags:   flags,
+		rpmTagRequireVersion: versions,
+		rpmTagDirNames:       dirs,
+		rpmTagBasenames:      bases,
+		rpmTagDirIndexes:     indexes,
+	})
+
+	var b bytes.Buffer
+	lead := make([]byte, rpmLeadSize)
+	copy(lead, rpmLeadMagic)
+	b.Write(lead)
+	b.Write(testRpmHeader(map[int32]interface{}{}))
+	b.Write(header)
+	gz := gzip.NewWriter(&b)
+	gz.Write(cpio.Bytes())
+	gz.Close()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := ioutil.WriteFile(path, b.Bytes(), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+}
+
+func TestBuildRpm(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smith-test-")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo := filepath.Join(dir, "repo")
+	writeTestRpm(t, filepath.Join(repo, "lib-1.0-1.noarch.rpm"), "lib", nil,
+		map[string]string{"/usr/lib/libtest.txt": "lib"})
+	primary := `<?xml version="1.0" encoding="UTF-8"?>
+<metadata xmlns="http://linux.duke.edu/metadata/common" xmlns:rpm="http://linux.duke.edu/metadata/rpm" packages="1">
+<package type="rpm">
+  <name>lib</name>
+  <arch>noarch</arch>
+  <version epoch="0" ver="1.0" rel="1"/>
+  <location href="lib-1.0-1.noarch.rpm"/>
+  <format>
+    <rpm:provides>
+      <rpm:entry name="libtest" flags="EQ" epoch="0" ver="1.0" rel="1"/>
+    </rpm:provides>
+  </format>
+</package>
+</metadata>
+`
+	if err := os.MkdirAll(filepath.Join(repo, rpmRepodata), 0755); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(repo, rpmRepodata, "primary.xml"), []byte(primary), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+	app := filepath.Join(dir, "app-1.0-1.noarch.rpm")
+	writeTestRpm(t, app, "app", []string{"libtest", "rpmlib(CompressedFileNames)"},
+		map[string]string{"/usr/bin/app": "app"})
+
+	pkg := &ConfigDef{
+		Type:    "rpm",
+		Package: app,
+		Paths:   []string{"/usr/bin/app", "/usr/lib/libtest.txt"},
+		Rpm:     NativeDef{Repos: []string{repo}},
+	}
+	outputDir := filepath.Join(dir, "out")
+	packages, err := buildNative(&buildOptions{}, outputDir, pkg, hostPlatform())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if expected := []string{"app-1.0-1.noarch", "lib-1.0-1.noarch"}; !reflect.DeepEqual(packages, expected) {
+		t.Fatalf("Installed %v, expected %v", packages, expected)
+	}
+	for path, content := range map[string]string{"usr/bin/app": "app", "usr/lib/libtest.txt": "lib"} {
+		data, err := ioutil.ReadFile(filepath.Join(outputDir, path))
+		if err != nil || string(data) != content {
+			t.Fatalf("Unexpected content of %v: %q %v", path, data, err)
+		}
+	}
+
+	// missing dependencies are an error
+	pkg.Rpm.Repos = nil
+	if _, err := buildNative(&buildOptions{}, outputDir, pkg, hostPlatform()); err == nil {
+		t.Fatalf("buildNative succeeded with a missing dependency")
+	}
+}
+
+// testCpioEntry appends a newc cpio entry for a file with inode ino and
+// nlink links to cpio.
+func testCpioEntry(cpio *bytes.Buffer, name string, ino, nlink, namesize int, data string) {
+	fmt.Fprintf(cpio, "070701%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x",
+		ino, 0100644, 0, 0, nlink, 0, len(data), 0, 0, 0, 0, namesize, 0)
+	cpio.WriteString(name + "\x00")
+	for cpio.Len()%4 != 0 {
+		cpio.WriteByte(0)
+	}
+	cpio.WriteString(data)
+	for cpio.Len()%4 != 0 {
+		cpio.WriteByte(0)
+	}
+}
+
+func TestExtractCpioLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smith-test-")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// empty hard linked files never get a link with data
+	var cpio bytes.Buffer
+	for _, name := range []string{"./empty-a", "./empty-b"} {
+		testCpioEntry(&cpio, name, 1, 2, len(name)+1, "")
+	}
+	testCpioEntry(&cpio, "./full-a", 2, 2, len("./full-a")+1, "")
+	testCpioEntry(&cpio, "./full-b", 2, 2, len("./full-b")+1, "data")
+	testCpioEntry(&cpio, cpioTrailer, 0, 1, len(cpioTrailer)+1, "")
+	tree := newTreeExtractor(dir)
+	if err := extractCpio(&cpio, tree); err != nil {
+		t.Fatalf("%v", err)
+	}
+	for name, content := range map[string]string{"empty-a": "", "empty-b": "", "full-a": "data", "full-b": "data"} {
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil || string(data) != content {
+			t.Errorf("%s wasn't extracted: %q %v", name, data, err)
+		}
+	}
+	a, _ := os.Stat(filepath.Join(dir, "empty-a"))
+	b, _ := os.Stat(filepath.Join(dir, "empty-b"))
+	if a == nil || b == nil || !os.SameFile(a, b) {
+		t.Errorf("Empty files weren't hard linked")
+	}
+
+	cpio.Reset()
+	testCpioEntry(&cpio, "./file", 1, 1, 1<<30, "")
+	if err := extractCpio(&cpio, tree); err == nil || !strings.Contains(err.Error(), "too long") {
+		t.Errorf("Huge cpio name size wasn't rejected: %v", err)
+	}
+
+	var header bytes.Buffer
+	header.Write(rpmHeaderMagic)
+	binary.Write(&header, binary.BigEndian, []uint32{0, 1, 0xffffffff})
+	if _, err := readRpmHeader(&header, false); err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Errorf("Huge rpm header wasn't rejected: %v", err)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+)
+
+const schemaID = "https://github.com/oracle/smith/raw/master/smith.schema.json"
+
+// configSchema returns a json schema for smith.yaml generated from
+// ConfigDef so the two can't drift apart.
+func configSchema() map[string]interface{} {
+	schema := typeSchema(reflect.TypeOf(ConfigDef{}))
+	schema["$schema"] = "http://json-schema.org/draft-07/schema#"
+	schema["$id"] = schemaID
+	schema["title"] = "smith.yaml"
+	return schema
+}
+
+func typeSchema(t reflect.Type) map[string]interface{} {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return typeSchema(t.Elem())
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Int, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": typeSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": typeSchema(t.Elem())}
+	case reflect.Struct:
+		properties := map[string]interface{}{}
+		required := []string{}
+		for name, field := range jsonFields(t) {
+			properties[name] = typeSchema(field.Type)
+			if !strings.Contains(field.Tag.Get("json"), "omitempty") {
+				required = append(required, name)
+			}
+		}
+		schema := map[string]interface{}{
+			"type":                 "object",
+			"properties":           properties,
+			"additionalProperties": false,
+		}
+		if len(required) != 0 {
+			sort.Strings(required)
+			schema["required"] = required
+		}
+		return schema
+	}
+	return map[string]interface{}{}
+}
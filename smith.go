@@ -64,6 +64,9 @@ func main() {
 				cmd.Usage()
 				return
 			}
+			if buildOpts.reproducible && !cmd.Flags().Changed("buildnumber") {
+				buildOpts.buildNo = ""
+			}
 			if !buildContainer(image, &buildOpts) {
 				cmdExitCode = 1
 			}
@@ -75,14 +78,122 @@ func main() {
 	f.StringVarP(&buildOpts.dir, "dir", "d", ".", "directory to build container image from")
 	f.StringVarP(&image, "image", "i", "image.tar.gz", "container image file")
 	f.StringVarP(&buildOpts.buildNo, "buildnumber", "b", defaultBuild, "unique build number")
+	f.BoolVarP(&buildOpts.reproducible, "reproducible", "", false, "build identical output from identical input")
+	f.BoolVarP(&buildOpts.noCache, "no-cache", "", false, "don't use or update the build cache")
+	f.Int64VarP(&buildOpts.cacheSize, "cache-size", "", defaultCacheSize, "maximum size of the build cache in bytes")
 	f.Lookup("image").Annotations = annotations
 	f = buildCmd.PersistentFlags()
 	f.BoolVarP(&opts.verbose, "verbose", "v", false, "verbose output")
 	f.BoolVarP(&opts.version, "version", "V", false, "show version")
 	f.BoolVarP(&buildOpts.insecure, "insecure", "k", false, "skip tls verification")
 
+	verifyCmd := cobra.Command{
+		Use:   "verify-reproducible",
+		Short: "build twice and report any differences",
+		Run: func(cmd *cobra.Command, args []string) {
+			if opts.version {
+				version()
+				return
+			}
+			if len(args) != 0 {
+				cmdExitCode = 1
+				cmd.Usage()
+				return
+			}
+			if !cmd.Flags().Changed("buildnumber") {
+				buildOpts.buildNo = ""
+			}
+			if !verifyReproducible(&buildOpts) {
+				cmdExitCode = 1
+			}
+		},
+	}
+	f = verifyCmd.Flags()
+	f.StringVarP(&buildOpts.conf, "conf", "c", "smith.yaml", "name of config file")
+	f.StringVarP(&buildOpts.dir, "dir", "d", ".", "directory to build container image from")
+	f.StringVarP(&buildOpts.buildNo, "buildnumber", "b", defaultBuild, "unique build number")
+	buildCmd.AddCommand(&verifyCmd)
+
+	var printSchema, printConfig bool
+	validateCmd := cobra.Command{
+		Use:   "validate",
+		Short: "check smith.yaml for errors",
+		Run: func(cmd *cobra.Command, args []string) {
+			if opts.version {
+				version()
+				return
+			}
+			if len(args) != 0 {
+				cmdExitCode = 1
+				cmd.Usage()
+				return
+			}
+			if !validateConfigFile(buildOpts.conf, buildOpts.dir, printSchema, printConfig) {
+				cmdExitCode = 1
+			}
+		},
+	}
+	f = validateCmd.Flags()
+	f.StringVarP(&buildOpts.conf, "conf", "c", "smith.yaml", "name of config file")
+	f.StringVarP(&buildOpts.dir, "dir", "d", ".", "directory of the project to validate")
+	f.BoolVarP(&printSchema, "schema", "s", false, "print the json schema for smith.yaml")
+	f.BoolVarP(&printConfig, "print", "p", false, "print the config with extends and include resolved")
+	buildCmd.AddCommand(&validateCmd)
+
+	cacheCmd := cobra.Command{
+		Use:   "cache",
+		Short: "manage the build cache",
+	}
+	buildCmd.AddCommand(&cacheCmd)
+
+	cacheLsCmd := cobra.Command{
+		Use:   "ls",
+		Short: "list the entries in the build cache",
+		Run: func(cmd *cobra.Command, args []string) {
+			if opts.version {
+				version()
+				return
+			}
+			if len(args) != 0 {
+				cmdExitCode = 1
+				cmd.Usage()
+				return
+			}
+			if !listCache() {
+				cmdExitCode = 1
+			}
+		},
+	}
+	cacheCmd.AddCommand(&cacheLsCmd)
+
+	var pruneAll bool
+	cachePruneCmd := cobra.Command{
+		Use:   "prune",
+		Short: "remove least recently used entries from the build cache",
+		Run: func(cmd *cobra.Command, args []string) {
+			if opts.version {
+				version()
+				return
+			}
+			if len(args) != 0 {
+				cmdExitCode = 1
+				cmd.Usage()
+				return
+			}
+			if !pruneCacheCommand(buildOpts.cacheSize, pruneAll) {
+				cmdExitCode = 1
+			}
+		},
+	}
+	f = cachePruneCmd.Flags()
+	f.Int64VarP(&buildOpts.cacheSize, "max-size", "s", defaultCacheSize, "size in bytes to shrink the cache to")
+	f.BoolVarP(&pruneAll, "all", "a", false, "remove every entry")
+	cacheCmd.AddCommand(&cachePruneCmd)
+
 	var remote string
-	var docker bool
+	var platform string
+	var tags []string
+	var uploadOpts uploadOptions
 	uploadCmd := cobra.Command{
 		Use:   "upload",
 		Short: "upload oci to repository",
@@ -96,7 +207,8 @@ func main() {
 				cmd.Usage()
 				return
 			}
-			if !uploadContainer(image, remote, buildOpts.insecure, docker) {
+			uploadOpts.insecure = buildOpts.insecure
+			if !uploadContainer(image, remote, &uploadOpts) {
 				cmdExitCode = 1
 			}
 		},
@@ -104,7 +216,11 @@ func main() {
 	f = uploadCmd.Flags()
 	f.StringVarP(&image, "image", "i", "image.tar.gz", "container image file")
 	f.StringVarP(&remote, "remote", "r", "", "remote repository path to upload to")
-	f.BoolVarP(&docker, "docker", "d", false, "upload in docker format")
+	f.BoolVarP(&uploadOpts.docker, "docker", "d", false, "upload in docker format")
+	f.StringSliceVarP(&uploadOpts.mountFrom, "mount-from", "m", nil, "repositories in the same registry to mount blobs from")
+	f.BoolVarP(&uploadOpts.all, "all", "a", false, "upload every image in the file to the tag with its name")
+	f.StringSliceVarP(&uploadOpts.tags, "tag", "t", nil, "tags to upload to, may use {{.Buildno}} and {{.Labels.name}}")
+	f.Int64VarP(&uploadOpts.chunkSize, "chunk-size", "s", 0, "upload blobs in chunks of this many bytes, 0 for monolithic uploads")
 	buildCmd.AddCommand(&uploadCmd)
 
 	downloadCmd := cobra.Command{
@@ -120,7 +236,7 @@ func main() {
 				cmd.Usage()
 				return
 			}
-			if !downloadContainer(image, remote, buildOpts.insecure) {
+			if !downloadContainer(image, remote, buildOpts.insecure, platform, tags) {
 				cmdExitCode = 1
 			}
 		},
@@ -128,8 +244,256 @@ func main() {
 	f = downloadCmd.Flags()
 	f.StringVarP(&image, "image", "i", "image.tar.gz", "container image file")
 	f.StringVarP(&remote, "remote", "r", "", "remote repository path to download from")
+	f.StringVarP(&platform, "platform", "p", "", "platform to download as os/arch[/variant]")
+	f.StringSliceVarP(&tags, "tag", "t", nil, "additional tags to download")
 	buildCmd.AddCommand(&downloadCmd)
 
+	var jsonOutput bool
+	inspectCmd := cobra.Command{
+		Use:   "inspect",
+		Short: "show the contents of an image",
+		Run: func(cmd *cobra.Command, args []string) {
+			if opts.version {
+				version()
+				return
+			}
+			if len(args) != 0 {
+				cmdExitCode = 1
+				cmd.Usage()
+				return
+			}
+			if !inspectContainer(image, remote, buildOpts.insecure, jsonOutput) {
+				cmdExitCode = 1
+			}
+		},
+	}
+	f = inspectCmd.Flags()
+	f.StringVarP(&image, "image", "i", "image.tar.gz", "container image file")
+	f.StringVarP(&remote, "remote", "r", "", "remote repository path to inspect instead of a file")
+	f.BoolVarP(&jsonOutput, "json", "j", false, "output json")
+	f.Lookup("image").Annotations = annotations
+	buildCmd.AddCommand(&inspectCmd)
+
+	var exitCode bool
+	diffCmd := cobra.Command{
+		Use:   "diff OLD[:NAME] NEW[:NAME]",
+		Short: "show the differences between two images",
+		Run: func(cmd *cobra.Command, args []string) {
+			if opts.version {
+				version()
+				return
+			}
+			if len(args) != 2 {
+				cmdExitCode = 1
+				cmd.Usage()
+				return
+			}
+			// like git diff, 1 means the images differ and 2 is an error
+			ok, differ := diffContainers(args[0], args[1], jsonOutput)
+			switch {
+			case !ok && exitCode:
+				cmdExitCode = 2
+			case !ok || (exitCode && differ):
+				cmdExitCode = 1
+			}
+		},
+	}
+	f = diffCmd.Flags()
+	f.BoolVarP(&jsonOutput, "json", "j", false, "output json")
+	f.BoolVarP(&exitCode, "exit-code", "e", false, "exit with 1 if the images differ and 2 on errors")
+	buildCmd.AddCommand(&diffCmd)
+
+	lsCmd := cobra.Command{
+		Use:   "ls [PATH]",
+		Short: "list the files in an image",
+		Run: func(cmd *cobra.Command, args []string) {
+			if opts.version {
+				version()
+				return
+			}
+			if len(args) > 1 {
+				cmdExitCode = 1
+				cmd.Usage()
+				return
+			}
+			dir := ""
+			if len(args) == 1 {
+				dir = args[0]
+			}
+			if !listImage(image, dir) {
+				cmdExitCode = 1
+			}
+		},
+	}
+	f = lsCmd.Flags()
+	f.StringVarP(&image, "image", "i", "image.tar.gz", "container image file")
+	f.Lookup("image").Annotations = annotations
+	buildCmd.AddCommand(&lsCmd)
+
+	cpCmd := cobra.Command{
+		Use:   "cp IMAGE[:NAME]:/PATH DEST",
+		Short: "copy files out of an image",
+		Run: func(cmd *cobra.Command, args []string) {
+			if opts.version {
+				version()
+				return
+			}
+			if len(args) != 2 {
+				cmdExitCode = 1
+				cmd.Usage()
+				return
+			}
+			if !copyFromContainer(args[0], args[1]) {
+				cmdExitCode = 1
+			}
+		},
+	}
+	buildCmd.AddCommand(&cpCmd)
+
+	layoutCmd := cobra.Command{
+		Use:   "layout",
+		Short: "manage the named images in an oci layout",
+	}
+	f = layoutCmd.PersistentFlags()
+	f.StringVarP(&image, "image", "i", "image.tar.gz", "container image file")
+	f.Lookup("image").Annotations = annotations
+	buildCmd.AddCommand(&layoutCmd)
+
+	layoutLsCmd := cobra.Command{
+		Use:   "ls",
+		Short: "list the images in an oci layout",
+		Run: func(cmd *cobra.Command, args []string) {
+			if opts.version {
+				version()
+				return
+			}
+			if len(args) != 0 {
+				cmdExitCode = 1
+				cmd.Usage()
+				return
+			}
+			if !listLayout(image) {
+				cmdExitCode = 1
+			}
+		},
+	}
+	layoutCmd.AddCommand(&layoutLsCmd)
+
+	layoutAddCmd := cobra.Command{
+		Use:   "add SOURCE[:NAME] [NEWNAME]",
+		Short: "add an image from another oci layout",
+		Run: func(cmd *cobra.Command, args []string) {
+			if opts.version {
+				version()
+				return
+			}
+			if len(args) < 1 || len(args) > 2 {
+				cmdExitCode = 1
+				cmd.Usage()
+				return
+			}
+			name := ""
+			if len(args) == 2 {
+				name = args[1]
+			}
+			if !addToLayout(image, args[0], name) {
+				cmdExitCode = 1
+			}
+		},
+	}
+	layoutCmd.AddCommand(&layoutAddCmd)
+
+	layoutRmCmd := cobra.Command{
+		Use:   "rm NAME...",
+		Short: "remove images from an oci layout",
+		Run: func(cmd *cobra.Command, args []string) {
+			if opts.version {
+				version()
+				return
+			}
+			if len(args) == 0 {
+				cmdExitCode = 1
+				cmd.Usage()
+				return
+			}
+			if !removeFromLayout(image, args) {
+				cmdExitCode = 1
+			}
+		},
+	}
+	layoutCmd.AddCommand(&layoutRmCmd)
+
+	var move bool
+	layoutTagCmd := cobra.Command{
+		Use:   "tag NAME NEWNAME",
+		Short: "add another name for an image in an oci layout",
+		Run: func(cmd *cobra.Command, args []string) {
+			if opts.version {
+				version()
+				return
+			}
+			if len(args) != 2 {
+				cmdExitCode = 1
+				cmd.Usage()
+				return
+			}
+			if !tagInLayout(image, args[0], args[1], move) {
+				cmdExitCode = 1
+			}
+		},
+	}
+	f = layoutTagCmd.Flags()
+	f.BoolVarP(&move, "move", "m", false, "remove the old name")
+	layoutCmd.AddCommand(&layoutTagCmd)
+
+	var username string
+	var passwordStdin bool
+	loginCmd := cobra.Command{
+		Use:   "login",
+		Short: "store credentials for a registry",
+		Run: func(cmd *cobra.Command, args []string) {
+			if opts.version {
+				version()
+				return
+			}
+			if len(args) != 0 {
+				cmdExitCode = 1
+				cmd.Usage()
+				return
+			}
+			if !loginRegistry(remote, username, passwordStdin, buildOpts.insecure) {
+				cmdExitCode = 1
+			}
+		},
+	}
+	f = loginCmd.Flags()
+	f.StringVarP(&remote, "remote", "r", "", "registry to login to")
+	f.StringVarP(&username, "username", "u", "", "username for the registry")
+	f.BoolVarP(&passwordStdin, "password-stdin", "", false, "read password from stdin")
+	buildCmd.AddCommand(&loginCmd)
+
+	logoutCmd := cobra.Command{
+		Use:   "logout",
+		Short: "remove stored credentials for a registry",
+		Run: func(cmd *cobra.Command, args []string) {
+			if opts.version {
+				version()
+				return
+			}
+			if len(args) != 0 {
+				cmdExitCode = 1
+				cmd.Usage()
+				return
+			}
+			if !logoutRegistry(remote) {
+				cmdExitCode = 1
+			}
+		},
+	}
+	f = logoutCmd.Flags()
+	f.StringVarP(&remote, "remote", "r", "", "registry to logout from")
+	buildCmd.AddCommand(&logoutCmd)
+
 	buildCmd.Execute()
 	os.Exit(cmdExitCode)
 }
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// pkgDep is a dependency on or a provide of a name with an optional version
+// constraint. Op is one of "", "<", "<=", "=", ">=" or ">".
+type pkgDep struct {
+	Name    string
+	Op      string
+	Version string
+}
+
+func (d pkgDep) String() string {
+	if d.Op == "" {
+		return d.Name
+	}
+	return d.Name + " " + d.Op + " " + d.Version
+}
+
+// pkgInfo describes a package that can be installed into a build root by
+// one of the native package types.
+type pkgInfo struct {
+	ID       string // name, version and arch as the package manager prints it
+	Name     string
+	Version  string
+	Arch     string
+	Path     string // file holding the package
+	Provides []pkgDep
+	Requires [][]pkgDep // each entry is satisfied by any of its alternatives
+	Files    []string
+}
+
+type pkgProvide struct {
+	pkg *pkgInfo
+	dep pkgDep
+}
+
+// pkgIndex finds the packages providing a dependency. Versions are ordered
+// by compare and only packages for one of arches are used. Provides without
+// a version only satisfy versioned dependencies if unversioned is set, as
+// rpm allows and dpkg and apk don't.
+type pkgIndex struct {
+	provides    map[string][]pkgProvide
+	compare     func(a, b string) int
+	arches      []string
+	unversioned bool
+}
+
+func newPkgIndex(compare func(a, b string) int, arches []string, unversioned bool) *pkgIndex {
+	return &pkgIndex{provides: map[string][]pkgProvide{}, compare: compare, arches: arches, unversioned: unversioned}
+}
+
+// add indexes the package under its name, its provides and its files.
+func (idx *pkgIndex) add(p *pkgInfo) {
+	provides := append([]pkgDep{{Name: p.Name, Op: "=", Version: p.Version}}, p.Provides...)
+	for _, file := range p.Files {
+		provides = append(provides, pkgDep{Name: file})
+	}
+	for _, dep := range provides {
+		idx.provides[dep.Name] = append(idx.provides[dep.Name], pkgProvide{p, dep})
+	}
+}
+
+// satisfies returns whether provide satisfies the constraint of dep.
+// Provides are exact versions.
+func (idx *pkgIndex) satisfies(dep, provide pkgDep) bool {
+	if dep.Op == "" {
+		return true
+	}
+	if provide.Version == "" {
+		return idx.unversioned
+	}
+	c := idx.compare(provide.Version, dep.Version)
+	switch dep.Op {
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case "=":
+		return c == 0
+	case ">=":
+		return c >= 0
+	case ">":
+		return c > 0
+	}
+	return false
+}
+
+func (idx *pkgIndex) archIndex(arch string) int {
+	if len(idx.arches) == 0 {
+		return 0
+	}
+	for i, a := range idx.arches {
+		if a == arch {
+			return i
+		}
+	}
+	return -1
+}
+
+// best returns the package to install for the first alternative that any
+// package satisfies. Packages named like the dependency win over ones that
+// provide it, then newer versions and then the preferred arch.
+func (idx *pkgIndex) best(alts []pkgDep) *pkgInfo {
+	for _, dep := range alts {
+		var best *pkgInfo
+		for _, provide := range idx.provides[dep.Name] {
+			p := provide.pkg
+			if idx.archIndex(p.Arch) == -1 || !idx.satisfies(dep, provide.dep) {
+				continue
+			}
+			if best == nil {
+				best = p
+				continue
+			}
+			if (p.Name == dep.Name) != (best.Name == dep.Name) {
+				if p.Name == dep.Name {
+					best = p
+				}
+				continue
+			}
+			if c := idx.compare(p.Version, best.Version); c != 0 {
+				if c > 0 {
+					best = p
+				}
+				continue
+			}
+			if idx.archIndex(p.Arch) < idx.archIndex(best.Arch) {
+				best = p
+			}
+		}
+		if best != nil {
+			return best
+		}
+	}
+	return nil
+}
+
+// lookup returns the package to install for each name, which is either
+// the name of a package or a provide.
+func (idx *pkgIndex) lookup(names []string) ([]*pkgInfo, error) {
+	pkgs := []*pkgInfo{}
+	for _, name := range names {
+		p := idx.best([]pkgDep{{Name: name}})
+		if p == nil {
+			return nil, fmt.Errorf("no package provides %s", name)
+		}
+		pkgs = append(pkgs, p)
+	}
+	return pkgs, nil
+}
+
+// resolve returns pkgs and everything they require with dependencies
+// ordered before the packages that need them. It fails if two versions of
+// a package would be installed.
+func (idx *pkgIndex) resolve(pkgs []*pkgInfo) ([]*pkgInfo, error) {
+	// pkgs satisfy dependencies before they are visited so requires don't
+	// pull in other versions of them
+	wanted := map[*pkgInfo]bool{}
+	for _, p := range pkgs {
+		wanted[p] = true
+	}
+	selected := map[*pkgInfo]bool{}
+	names := map[string]*pkgInfo{}
+	order := []*pkgInfo{}
+	provider := func(alts []pkgDep) *pkgInfo {
+		for _, dep := range alts {
+			for _, provide := range idx.provides[dep.Name] {
+				if (selected[provide.pkg] || wanted[provide.pkg]) && idx.satisfies(dep, provide.dep) {
+					return provide.pkg
+				}
+			}
+		}
+		return idx.best(alts)
+	}
+	var visit func(p *pkgInfo) error
+	visit = func(p *pkgInfo) error {
+		if selected[p] {
+			return nil
+		}
+		if other, ok := names[p.Name]; ok {
+			if other.ID == p.ID {
+				// the same package from another repo
+				return nil
+			}
+			return fmt.Errorf("%s conflicts with %s", p.ID, other.ID)
+		}
+		selected[p] = true
+		names[p.Name] = p
+		for _, alts := range p.Requires {
+			dep := provider(alts)
+			if dep == nil {
+				return fmt.Errorf("nothing provides %s needed by %s", depString(alts), p.ID)
+			}
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		order = append(order, p)
+		return nil
+	}
+	for _, p := range pkgs {
+		if err := visit(p); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
+
+func depString(alts []pkgDep) string {
+	s := []string{}
+	for _, dep := range alts {
+		s = append(s, dep.String())
+	}
+	return strings.Join(s, " | ")
+}
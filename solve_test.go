@@ -0,0 +1,42 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestResolveConflict(t *testing.T) {
+	idx := newPkgIndex(compareEVR, nil, true)
+	app := &pkgInfo{ID: "app-1.0-1", Name: "app", Version: "1.0-1",
+		Requires: [][]pkgDep{{{Name: "lib", Op: ">=", Version: "2.0"}}}}
+	old := &pkgInfo{ID: "lib-1.0-1", Name: "lib", Version: "1.0-1"}
+	lib := &pkgInfo{ID: "lib-2.0-1", Name: "lib", Version: "2.0-1"}
+	for _, p := range []*pkgInfo{app, old, lib} {
+		idx.add(p)
+	}
+
+	order, err := idx.resolve([]*pkgInfo{app})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(order) != 2 || order[0] != lib || order[1] != app {
+		t.Fatalf("Wrong packages resolved: %v", order)
+	}
+
+	// asking for the old version can't satisfy app
+	_, err = idx.resolve([]*pkgInfo{old, app})
+	if err == nil || !strings.Contains(err.Error(), "conflicts with") {
+		t.Fatalf("Expected a conflict, got %v", err)
+	}
+}
+
+func TestUnversionedProvides(t *testing.T) {
+	dep := pkgDep{Name: "mail-transport-agent", Op: ">=", Version: "1.0"}
+	provide := pkgDep{Name: "mail-transport-agent"}
+	if !newPkgIndex(compareEVR, nil, true).satisfies(dep, provide) {
+		t.Errorf("Unversioned rpm provide didn't satisfy %v", dep)
+	}
+	if newPkgIndex(compareDebVersions, nil, false).satisfies(dep, provide) {
+		t.Errorf("Unversioned deb provide satisfied %v", dep)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"debug/elf"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	staticBinDir = "/usr/bin"
+	staticCerts  = "/etc/ssl/certs/ca-certificates.crt"
+	zoneinfoDir  = "/usr/share/zoneinfo"
+)
+
+// hostCerts are the locations of the ca bundle on common distributions.
+var hostCerts = []string{
+	"/etc/pki/tls/certs/ca-bundle.crt",
+	"/etc/ssl/certs/ca-certificates.crt",
+	"/etc/ssl/ca-bundle.pem",
+	"/etc/ssl/cert.pem",
+}
+
+// staticBinary splits a binary of the form src[:dest] into the file on the
+// host and its path in the image, which defaults to /usr/bin/<name>.
+func staticBinary(binary string) (string, string) {
+	parts := strings.SplitN(binary, ":", 2)
+	if len(parts) == 2 && parts[1] != "" {
+		return parts[0], parts[1]
+	}
+	return parts[0], filepath.Join(staticBinDir, filepath.Base(parts[0]))
+}
+
+// dynamicDeps returns the interpreter and libraries that the elf at path
+// needs. It returns nil for static binaries and files that aren't elfs and
+// an error for elfs of another machine type unless machine is EM_NONE.
+func dynamicDeps(path string, machine elf.Machine) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	f, err := elf.NewFile(file)
+	if err != nil {
+		logrus.Warnf("%v is not an ELF", path)
+		return nil, nil
+	}
+
+	if machine != elf.EM_NONE && f.Machine != machine {
+		return nil, fmt.Errorf("machine type %v doesn't match the target %v", f.Machine, machine)
+	}
+	deps := []string{}
+	if section := f.Section(".interp"); section != nil {
+		data, err := section.Data()
+		if err != nil {
+			return nil, err
+		}
+		deps = append(deps, strings.TrimRight(string(data), "\x00"))
+	}
+	needs, err := f.DynString(elf.DT_NEEDED)
+	if err != nil {
+		return nil, err
+	}
+	return append(deps, needs...), nil
+}
+
+// buildStatic copies the static binaries listed in pkg from the host into
+// outputDir along with the optional ca certificates and timezone data. No
+// dependencies are followed, so dynamically linked binaries are copied with
+// a warning that lists what they are missing. Binaries must match the
+// machine type of platform.
+func buildStatic(buildOpts *buildOptions, outputDir string, pkg *ConfigDef, platform v1.Platform) error {
+	for _, binary := range pkg.Static.Binaries {
+		src, dest := staticBinary(binary)
+		deps, err := dynamicDeps(src, platformMachine(platform))
+		if err != nil {
+			return fmt.Errorf("%s: %v", src, err)
+		}
+		if len(deps) != 0 {
+			logrus.Warnf("%v is dynamically linked, the image is missing %v", src, strings.Join(deps, ", "))
+		}
+		if err := copyHostFile(src, filepath.Join(outputDir, dest)); err != nil {
+			return err
+		}
+	}
+
+	if pkg.Static.Certs {
+		found := false
+		for _, certs := range hostCerts {
+			if _, err := os.Stat(certs); err != nil {
+				continue
+			}
+			if err := copyHostFile(certs, filepath.Join(outputDir, staticCerts)); err != nil {
+				return err
+			}
+			found = true
+			break
+		}
+		if !found {
+			return fmt.Errorf("no ca certificates found in %v", strings.Join(hostCerts, ", "))
+		}
+	}
+
+	if pkg.Static.Tzdata {
+		if err := copyDir(zoneinfoDir, filepath.Join(outputDir, zoneinfoDir)); err != nil {
+			return fmt.Errorf("failed to copy timezone data: %v", err)
+		}
+	}
+	return nil
+}
+
+// copyHostFile copies the file at src to dst, following symlinks and
+// creating the parent directories of dst.
+func copyHostFile(src, dst string) error {
+	src, err := filepath.EvalSymlinks(src)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	os.Remove(dst)
+	if err := Copy(src, dst); err != nil {
+		return err
+	}
+	return os.Chmod(dst, info.Mode().Perm())
+}
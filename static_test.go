@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeTestStaticElf writes an elf without an interpreter or dynamic
+// section to path.
+func writeTestStaticElf(t *testing.T, path string) {
+	header := elf.Header64{
+		Type:      uint16(elf.ET_EXEC),
+		Machine:   uint16(platformMachine(hostPlatform())),
+		Version:   uint32(elf.EV_CURRENT),
+		Ehsize:    uint16(binary.Size(elf.Header64{})),
+		Phentsize: uint16(binary.Size(elf.Prog64{})),
+		Shentsize: uint16(binary.Size(elf.Section64{})),
+	}
+	copy(header.Ident[:], elf.ELFMAG)
+	header.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+	header.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	header.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, header)
+	if err := ioutil.WriteFile(path, b.Bytes(), 0755); err != nil {
+		t.Fatalf("%v", err)
+	}
+}
+
+func TestStaticBinary(t *testing.T) {
+	tests := []struct {
+		binary, src, dest string
+	}{
+		{"./bin/app", "./bin/app", "/usr/bin/app"},
+		{"./bin/app:/app", "./bin/app", "/app"},
+		{"./bin/app:", "./bin/app", "/usr/bin/app"},
+	}
+	for _, test := range tests {
+		src, dest := staticBinary(test.binary)
+		if src != test.src || dest != test.dest {
+			t.Errorf("staticBinary(%q) = %q, %q, expected %q, %q", test.binary, src, dest, test.src, test.dest)
+		}
+	}
+}
+
+func TestDynamicDeps(t *testing.T) {
+	skipIfNotLinux(t)
+	dir, err := ioutil.TempDir("", "smith-test-")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	static := filepath.Join(dir, "static")
+	writeTestStaticElf(t, static)
+	deps, err := dynamicDeps(static, elf.EM_NONE)
+	if err != nil || len(deps) != 0 {
+		t.Fatalf("Static elf has deps %v: %v", deps, err)
+	}
+	deps, err = dynamicDeps("/usr/bin/env", elf.EM_NONE)
+	if err != nil || len(deps) < 2 {
+		t.Fatalf("Expected an interpreter and libraries for env, got %v: %v", deps, err)
+	}
+}
+
+func TestBuildStatic(t *testing.T) {
+	skipIfNotLinux(t)
+	dir, err := ioutil.TempDir("", "smith-test-")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	app := filepath.Join(dir, "app")
+	writeTestStaticElf(t, app)
+	pkg := &ConfigDef{
+		Type:   "static",
+		Static: StaticDef{Binaries: []string{app, app + ":/app"}},
+	}
+	outputDir := filepath.Join(dir, "out")
+	if err := buildStatic(&buildOptions{}, outputDir, pkg, hostPlatform()); err != nil {
+		t.Fatalf("%v", err)
+	}
+	expected, err := ioutil.ReadFile(app)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	for _, path := range []string{"usr/bin/app", "app"} {
+		data, err := ioutil.ReadFile(filepath.Join(outputDir, path))
+		if err != nil || !reflect.DeepEqual(data, expected) {
+			t.Fatalf("Unexpected content of %v: %v", path, err)
+		}
+		info, err := os.Stat(filepath.Join(outputDir, path))
+		if err != nil || info.Mode().Perm() != 0755 {
+			t.Fatalf("Unexpected mode of %v: %v", path, err)
+		}
+	}
+
+	// binaries for another machine are an error
+	other := hostPlatform()
+	other.Architecture = "s390x"
+	if other.Architecture == hostPlatform().Architecture {
+		other.Architecture = "amd64"
+	}
+	if err := buildStatic(&buildOptions{}, outputDir, pkg, other); err == nil || !strings.Contains(err.Error(), "machine type") {
+		t.Fatalf("buildStatic didn't reject a binary for another machine: %v", err)
+	}
+
+	// missing binaries are an error
+	pkg.Static.Binaries = []string{filepath.Join(dir, "missing")}
+	if err := buildStatic(&buildOptions{}, outputDir, pkg, hostPlatform()); err == nil {
+		t.Fatalf("buildStatic succeeded with a missing binary")
+	}
+}
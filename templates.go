@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const templatesDir = "templates"
+
+// templateData is available to the files in the templates directory.
+type templateData struct {
+	Values   map[string]string
+	Env      map[string]string
+	Labels   map[string]string
+	Buildno  string
+	Platform string
+}
+
+func newTemplateData(buildOpts *buildOptions, pkg *ConfigDef, platform v1.Platform) *templateData {
+	env := map[string]string{}
+	for _, e := range os.Environ() {
+		parts := strings.SplitN(e, "=", 2)
+		if len(parts) == 2 {
+			env[parts[0]] = parts[1]
+		}
+	}
+	return &templateData{
+		Values:   pkg.Values,
+		Env:      env,
+		Labels:   pkg.Labels,
+		Buildno:  buildOpts.buildNo,
+		Platform: platformString(platform),
+	}
+}
+
+// renderTemplate renders the template in path with data.
+func renderTemplate(path string, data *templateData) ([]byte, error) {
+	text, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := template.New(filepath.Base(path)).Option("missingkey=error").Parse(string(text))
+	if err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, data); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// renderTemplates renders each file in the templates dir of projectDir into
+// the same location below outputDir. Directories and symlinks are copied.
+func renderTemplates(projectDir, outputDir string, data *templateData) error {
+	srcDir := filepath.Join(projectDir, templatesDir)
+	if _, err := os.Stat(srcDir); os.IsNotExist(err) {
+		return nil
+	}
+	logrus.Infof("Rendering templates")
+	return filepath.Walk(srcDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(srcDir, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." || filepath.Base(path) == ".gitignore" {
+			return nil
+		}
+		target := filepath.Join(outputDir, rel)
+		switch {
+		case info.IsDir():
+			return os.MkdirAll(target, 0755)
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			os.RemoveAll(target)
+			return os.Symlink(link, target)
+		case info.Mode().IsRegular():
+			logrus.Debugf("Rendering %v to %v", path, target)
+			out, err := renderTemplate(path, data)
+			if err != nil {
+				return fmt.Errorf("failed to render %v: %v", rel, err)
+			}
+			os.RemoveAll(target)
+			return ioutil.WriteFile(target, out, info.Mode().Perm())
+		}
+		logrus.Warnf("Skipping special file %v", path)
+		return nil
+	})
+}
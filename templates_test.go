@@ -0,0 +1,52 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRenderTemplates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smith-test-")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, templatesDir, "read", "app.conf")
+	if err := os.MkdirAll(filepath.Dir(src), 0755); err != nil {
+		t.Fatalf("%v", err)
+	}
+	text := "db={{.Values.db}}\npassword={{.Env.SMITH_TEST_SECRET}}\nbuild={{.Buildno}}\n"
+	if err := ioutil.WriteFile(src, []byte(text), 0600); err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.Unsetenv("SMITH_TEST_SECRET")
+	os.Setenv("SMITH_TEST_SECRET", "hunter2")
+
+	pkg := &ConfigDef{Values: map[string]string{"db": "prod.example.com"}}
+	data := newTemplateData(&buildOptions{buildNo: "42"}, pkg, hostPlatform())
+	outputDir := filepath.Join(dir, rootfs)
+	if err := renderTemplates(dir, outputDir, data); err != nil {
+		t.Fatalf("%v", err)
+	}
+	out := filepath.Join(outputDir, "read", "app.conf")
+	rendered, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	expected := "db=prod.example.com\npassword=hunter2\nbuild=42\n"
+	if string(rendered) != expected {
+		t.Fatalf("Rendered %q, expected %q", rendered, expected)
+	}
+	if info, err := os.Stat(out); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("Rendered file doesn't keep the template mode: %v", err)
+	}
+
+	// missing values are an error instead of an empty string
+	pkg.Values = nil
+	data = newTemplateData(&buildOptions{}, pkg, hostPlatform())
+	if err := renderTemplates(dir, outputDir, data); err == nil {
+		t.Fatalf("renderTemplates succeeded with a missing value")
+	}
+}
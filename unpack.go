@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	unpackComplete = ".complete"
+	unpackLock     = ".lock"
+	// unpackMaxAge is how long an unused unpack dir is kept.
+	unpackMaxAge = 7 * 24 * time.Hour
+)
+
+// unpackRoot returns the directory that holds the unpack dirs of the user.
+func unpackRoot() string {
+	return filepath.Join(os.TempDir(), "smith-unpack-"+strconv.Itoa(os.Getuid()))
+}
+
+// lockFile takes an exclusive lock on path, creating it if necessary. If
+// block is false it fails instead of waiting for the lock.
+func lockFile(path string, block bool) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	how := syscall.LOCK_EX
+	if !block {
+		how |= syscall.LOCK_NB
+	}
+	if err := syscall.Flock(int(f.Fd()), how); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func unlockFile(f *os.File) {
+	syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+	f.Close()
+}
+
+// unpackImage returns a directory containing the extracted filesystem of
+// image. Directories are keyed on the manifest digest of the image, so a
+// changed base image is always unpacked again. The directory is locked until
+// release is called. If fast is false it is always extracted from scratch.
+func unpackImage(image *Image, fast bool) (string, func(), error) {
+	if image.Digest == "" {
+		return "", nil, fmt.Errorf("base image has no manifest digest")
+	}
+	root := unpackRoot()
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return "", nil, err
+	}
+	dir := filepath.Join(root, image.Digest.Hex())
+	logrus.Debugf("Locking %v", dir)
+	lock, err := lockFile(dir+unpackLock, true)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to lock %v: %v", dir, err)
+	}
+	release := func() {
+		logrus.Debugf("Unlocking %v", dir)
+		unlockFile(lock)
+	}
+
+	marker := dir + unpackComplete
+	_, err = os.Stat(marker)
+	if fast && err == nil {
+		logrus.Infof("Reusing %v for %v", dir, image.Digest)
+		now := time.Now()
+		os.Chtimes(marker, now, now)
+		return dir, release, nil
+	}
+	// remove anything left over from a previous or interrupted unpack
+	os.Remove(marker)
+	logrus.Debugf("Removing %v", dir)
+	if err := os.RemoveAll(dir); err != nil {
+		release()
+		return "", nil, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		release()
+		return "", nil, err
+	}
+	logrus.Infof("Unpacking %v into %v", image.Digest, dir)
+	if err := ExtractOci(image, dir); err != nil {
+		release()
+		return "", nil, err
+	}
+	if err := ioutil.WriteFile(marker, nil, 0644); err != nil {
+		release()
+		return "", nil, err
+	}
+	pruneUnpackDirs(root, unpackMaxAge)
+	return dir, release, nil
+}
+
+// pruneUnpackDirs removes unpack dirs that haven't been used for maxAge.
+// Dirs that are locked by another build are skipped.
+func pruneUnpackDirs(root string, maxAge time.Duration) {
+	infos, err := ioutil.ReadDir(root)
+	if err != nil {
+		logrus.Warnf("Failed to read %v: %v", root, err)
+		return
+	}
+	for _, info := range infos {
+		if !strings.HasSuffix(info.Name(), unpackComplete) || time.Since(info.ModTime()) < maxAge {
+			continue
+		}
+		dir := filepath.Join(root, strings.TrimSuffix(info.Name(), unpackComplete))
+		lock, err := lockFile(dir+unpackLock, false)
+		if err != nil {
+			continue
+		}
+		logrus.Debugf("Removing unused %v", dir)
+		os.Remove(dir + unpackComplete)
+		if err := os.RemoveAll(dir); err != nil {
+			logrus.Warnf("Failed to remove %v: %v", dir, err)
+		}
+		unlockFile(lock)
+	}
+}
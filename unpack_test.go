@@ -0,0 +1,68 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUnpackImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smith-test-")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+	defer os.Setenv("TMPDIR", os.Getenv("TMPDIR"))
+	os.Setenv("TMPDIR", dir)
+
+	out := filepath.Join(dir, "base.tar.gz")
+	buildTestImage(t, filepath.Join(dir, "build"), "base", out)
+	image, err := imageFromFile(out, nil)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer image.Close()
+
+	unpackDir, release, err := unpackImage(image, true)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if filepath.Base(unpackDir) != image.Digest.Hex() {
+		t.Fatalf("Unpack dir %v isn't keyed on the digest %v", unpackDir, image.Digest)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(unpackDir, "etc", "config")); err != nil || string(data) != "base" {
+		t.Fatalf("Image wasn't unpacked: %v", err)
+	}
+	// concurrent builds have to wait for the lock
+	if _, err := lockFile(unpackDir+unpackLock, false); err == nil {
+		t.Fatalf("Unpack dir wasn't locked")
+	}
+	release()
+
+	sentinel := filepath.Join(unpackDir, "sentinel")
+	if err := ioutil.WriteFile(sentinel, nil, 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+	for _, fast := range []bool{true, false} {
+		_, release, err := unpackImage(image, fast)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		release()
+		if _, err := os.Stat(sentinel); fast != (err == nil) {
+			t.Fatalf("Unpack with fast %v reused dir: %v", fast, err == nil)
+		}
+	}
+
+	// unused dirs are removed after a while
+	old := time.Now().Add(-2 * unpackMaxAge)
+	if err := os.Chtimes(unpackDir+unpackComplete, old, old); err != nil {
+		t.Fatalf("%v", err)
+	}
+	pruneUnpackDirs(unpackRoot(), unpackMaxAge)
+	if _, err := os.Stat(unpackDir); !os.IsNotExist(err) {
+		t.Fatalf("Old unpack dir wasn't removed")
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const maxUploadRetries = 5
+
+// PutChunked uploads blob to the upload session at uploadURL in chunks of
+// r.ChunkSize using PATCH requests and completes the upload with a PUT. If a
+// chunk fails, the status of the session is queried from the registry and
+// the upload resumes from the last byte the registry received.
+func (r *RegistryClient) PutChunked(info *RepoInfo, path, uploadURL string, blob Blob) error {
+	var in io.ReadCloser
+	defer func() {
+		if in != nil {
+			in.Close()
+		}
+	}()
+	size := blob.Size()
+	offset := int64(0)
+	retries := 0
+	resume := false
+	for offset < size {
+		if resume {
+			next, received, err := r.uploadStatus(info, uploadURL)
+			if err == nil && received == 0 {
+				// the registry can't tell an empty session from one that
+				// holds a single byte, so start over in a new session
+				r.cancelUpload(info, uploadURL)
+				next, err = r.PrepPutObject(info, path)
+			}
+			if err != nil {
+				if retries >= maxUploadRetries {
+					return err
+				}
+				retries++
+				logrus.Warnf("Failed to get status of upload of %s, retrying: %v", path, err)
+				continue
+			}
+			uploadURL, offset, resume = next, received, false
+			logrus.Infof("Resuming upload of %s at byte %d", path, offset)
+			continue
+		}
+		if in == nil {
+			var err error
+			in, err = openBlobAt(blob, offset)
+			if err != nil {
+				return err
+			}
+		}
+		length := r.ChunkSize
+		if offset+length > size {
+			length = size - offset
+		}
+		next, received, err := r.patchChunk(info, uploadURL, in, offset, length)
+		if err == nil && received <= offset {
+			err = fmt.Errorf("registry did not accept any data")
+		}
+		if err == nil {
+			uploadURL = next
+			if received != offset+length {
+				// the registry didn't take all of the data so reopen
+				in.Close()
+				in = nil
+			}
+			offset = received
+			retries = 0
+			continue
+		}
+		if retries >= maxUploadRetries {
+			return err
+		}
+		retries++
+		logrus.Warnf("Upload of %s interrupted, resuming: %v", path, err)
+		in.Close()
+		in = nil
+		resume = true
+	}
+
+	// complete the upload
+	u := addQuery(uploadURL, "digest", path[len("blobs/"):])
+	req, err := http.NewRequest("PUT", u, nil)
+	if err != nil {
+		return err
+	}
+	if err := r.authorize(req, info); err != nil {
+		return err
+	}
+	req.ContentLength = 0
+	resp, err := r.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 201 {
+		return responseError("Put request", resp)
+	}
+	logrus.Infof("Uploaded %s", path)
+	return nil
+}
+
+// patchChunk sends length bytes from in as the chunk starting at offset. It
+// returns the url for the next request and the offset of the next byte the
+// registry expects.
+func (r *RegistryClient) patchChunk(info *RepoInfo, uploadURL string, in io.Reader, offset, length int64) (string, int64, error) {
+	req, err := http.NewRequest("PATCH", uploadURL, ioutil.NopCloser(io.LimitReader(in, length)))
+	if err != nil {
+		return "", 0, err
+	}
+	if err := r.authorize(req, info); err != nil {
+		return "", 0, err
+	}
+	req.ContentLength = length
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Range", fmt.Sprintf("%d-%d", offset, offset+length-1))
+	logrus.Debugf("Uploading bytes %d-%d to %s", offset, offset+length-1, uploadURL)
+	resp, err := r.Client.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == 401 {
+		if err := r.reauthorize(resp, info); err != nil {
+			return "", 0, err
+		}
+		return "", 0, fmt.Errorf("Patch request was not authorized")
+	}
+	if resp.StatusCode != 202 {
+		return "", 0, responseError("Patch request", resp)
+	}
+	next := uploadURL
+	if location := resp.Header.Get("Location"); location != "" {
+		next = absoluteURL(info, location)
+	}
+	received, ok := parseRange(resp.Header.Get("Range"))
+	if !ok {
+		received = offset + length
+	}
+	return next, received, nil
+}
+
+// uploadStatus queries the registry for the progress of the upload session
+// at uploadURL. It returns the url to continue the upload and the offset of
+// the next byte the registry expects, which is 0 if it received at most one
+// byte.
+func (r *RegistryClient) uploadStatus(info *RepoInfo, uploadURL string) (string, int64, error) {
+	req, err := http.NewRequest("GET", uploadURL, nil)
+	if err != nil {
+		return "", 0, err
+	}
+	if err := r.authorize(req, info); err != nil {
+		return "", 0, err
+	}
+	resp, err := r.Client.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == 401 {
+		if err := r.reauthorize(resp, info); err != nil {
+			return "", 0, err
+		}
+		return r.uploadStatus(info, uploadURL)
+	}
+	if resp.StatusCode != 204 {
+		return "", 0, responseError("Upload status request", resp)
+	}
+	next := uploadURL
+	if location := resp.Header.Get("Location"); location != "" {
+		next = absoluteURL(info, location)
+	}
+	// the range is inclusive, so an empty session is reported as 0-0 or
+	// without a range
+	received, ok := parseRange(resp.Header.Get("Range"))
+	if !ok || received == 1 {
+		received = 0
+	}
+	return next, received, nil
+}
+
+// MountObject attempts to mount the blob at path from each of the
+// repositories in info.MountFrom. It returns true if the blob was mounted.
+// If the registry declines the mount it starts an upload session instead and
+// the url of the last session is returned so it can be used for the upload.
+func (r *RegistryClient) MountObject(info *RepoInfo, path string) (bool, string, error) {
+	digest := path[len("blobs/"):]
+	session := ""
+	for _, repo := range info.MountFrom {
+		if session != "" {
+			// clean up the unused session from the previous attempt
+			r.cancelUpload(info, session)
+			session = ""
+		}
+		postURL := fmt.Sprintf("%s://%s/v2/%s/blobs/uploads/",
+			info.Scheme, info.Host, info.Reponame)
+		postURL = addQuery(postURL, "mount", digest)
+		postURL = addQuery(postURL, "from", repo)
+		req, err := http.NewRequest("POST", postURL, nil)
+		if err != nil {
+			return false, "", err
+		}
+		if err := r.authorize(req, info); err != nil {
+			return false, "", err
+		}
+		logrus.Debugf("Attempting to mount %s from %s", path, repo)
+		resp, err := r.Client.Do(req)
+		if err != nil {
+			return false, "", err
+		}
+		resp.Body.Close()
+		switch resp.StatusCode {
+		case 201:
+			logrus.Infof("Mounted %s from %s", path, repo)
+			return true, "", nil
+		case 202:
+			if location := resp.Header.Get("Location"); location != "" {
+				session = absoluteURL(info, location)
+			}
+		default:
+			logrus.Debugf("Mount of %s from %s returned %d", path, repo, resp.StatusCode)
+		}
+	}
+	return false, session, nil
+}
+
+// cancelUpload deletes an upload session. Failures are ignored because the
+// registry will eventually expire the session anyway.
+func (r *RegistryClient) cancelUpload(info *RepoInfo, uploadURL string) {
+	req, err := http.NewRequest("DELETE", uploadURL, nil)
+	if err != nil {
+		return
+	}
+	if err := r.authorize(req, info); err != nil {
+		return
+	}
+	resp, err := r.Client.Do(req)
+	if err != nil {
+		logrus.Debugf("Failed to cancel upload %s: %v", uploadURL, err)
+		return
+	}
+	resp.Body.Close()
+}
+
+// parseRange parses a Range header in the form 0-<end> returned by
+// registries and returns the offset of the next byte.
+func parseRange(value string) (int64, bool) {
+	value = strings.TrimPrefix(value, "bytes=")
+	parts := strings.Split(value, "-")
+	if len(parts) != 2 {
+		return 0, false
+	}
+	end, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return end + 1, true
+}
+
+// openBlobAt opens blob and positions it at offset.
+func openBlobAt(blob Blob, offset int64) (io.ReadCloser, error) {
+	in, err := blob.Open()
+	if err != nil {
+		return nil, err
+	}
+	if offset == 0 {
+		return in, nil
+	}
+	if seeker, ok := in.(io.Seeker); ok {
+		if _, err := seeker.Seek(offset, io.SeekStart); err == nil {
+			return in, nil
+		}
+	}
+	if _, err := io.CopyN(ioutil.Discard, in, offset); err != nil {
+		in.Close()
+		return nil, err
+	}
+	return in, nil
+}
+
+// responseError creates an error including the body of an unexpected
+// response from the registry.
+func responseError(name string, resp *http.Response) error {
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(resp.Body); err != nil {
+		logrus.Warnf("Failed to read response body: %v", err)
+	}
+	return fmt.Errorf("%s returned invalid response %d:\n%s",
+		name, resp.StatusCode, string(buf.Bytes()))
+}
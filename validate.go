@@ -0,0 +1,550 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/ghodss/yaml"
+)
+
+// buildTypes are the supported values of type in smith.yaml.
+var buildTypes = []string{"mock", "oci", "rpm", "deb", "apk", "dir", "tar", "static"}
+
+var (
+	portPattern = regexp.MustCompile(`^([0-9]+)(/tcp|/udp)?$`)
+	namePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+)
+
+// configError is a problem with a field of smith.yaml. Line and Column are
+// zero if the position of the field isn't known. File is set if the field
+// is in a file included from smith.yaml.
+type configError struct {
+	File   string
+	Path   string
+	Line   int
+	Column int
+	Msg    string
+}
+
+func (e *configError) Error() string {
+	msg := e.Msg
+	if e.Path != "" {
+		msg = e.Path + ": " + msg
+	}
+	if e.Line == 0 {
+		return msg
+	}
+	return fmt.Sprintf("%d:%d: %s", e.Line, e.Column, msg)
+}
+
+type position struct {
+	line   int
+	column int
+}
+
+// yamlPositions maps field paths like mock.deps[1] to their position in
+// data. Only block style yaml is indexed, values in flow style yaml share
+// the position of their parent.
+type yamlPositions map[string]position
+
+type yamlFrame struct {
+	indent int
+	path   string
+	seq    bool
+	index  int
+}
+
+// yamlKey splits a line into a mapping key and value.
+func yamlKey(content string) (string, string, bool) {
+	i := strings.Index(content, ":")
+	for i != -1 && i+1 < len(content) && content[i+1] != ' ' {
+		j := strings.Index(content[i+1:], ":")
+		if j == -1 {
+			return "", "", false
+		}
+		i += j + 1
+	}
+	if i <= 0 {
+		return "", "", false
+	}
+	key := strings.TrimSpace(content[:i])
+	if len(key) >= 2 && (key[0] == '"' || key[0] == '\'') && key[len(key)-1] == key[0] {
+		key = key[1 : len(key)-1]
+	}
+	return key, strings.TrimSpace(content[i+1:]), true
+}
+
+func joinPath(parent, key string) string {
+	if parent == "" {
+		return key
+	}
+	return parent + "." + key
+}
+
+func newYamlPositions(data []byte) yamlPositions {
+	positions := yamlPositions{}
+	frames := []yamlFrame{{indent: -1}}
+	pending := ""
+	blockIndent := -1
+	for i, line := range strings.Split(string(data), "\n") {
+		trimmed := strings.TrimLeft(line, " ")
+		indent := len(line) - len(trimmed)
+		if blockIndent >= 0 {
+			if indent > blockIndent || strings.TrimSpace(trimmed) == "" {
+				continue
+			}
+			blockIndent = -1
+		}
+		if trimmed == "" || trimmed[0] == '#' || trimmed == "---" {
+			continue
+		}
+		for len(frames) > 1 && frames[len(frames)-1].indent > indent {
+			frames = frames[:len(frames)-1]
+		}
+		col := indent
+		content := trimmed
+		if content == "-" || strings.HasPrefix(content, "- ") {
+			top := &frames[len(frames)-1]
+			if top.seq && top.indent == col {
+				top.index++
+			} else {
+				frames = append(frames, yamlFrame{indent: col, path: pending, seq: true})
+				top = &frames[len(frames)-1]
+			}
+			pending = fmt.Sprintf("%s[%d]", top.path, top.index)
+			positions[pending] = position{i + 1, col + 1}
+			rest := strings.TrimLeft(content[1:], " ")
+			col += len(content) - len(rest)
+			content = rest
+		}
+		key, value, ok := yamlKey(content)
+		if !ok {
+			continue
+		}
+		top := frames[len(frames)-1]
+		if top.seq && top.indent == col {
+			frames = frames[:len(frames)-1]
+			top = frames[len(frames)-1]
+		}
+		if top.seq || top.indent < col {
+			frames = append(frames, yamlFrame{indent: col, path: pending})
+			top = frames[len(frames)-1]
+		}
+		pending = joinPath(top.path, key)
+		positions[pending] = position{i + 1, col + 1}
+		if strings.HasPrefix(value, "|") || strings.HasPrefix(value, ">") {
+			blockIndent = col
+		}
+	}
+	return positions
+}
+
+// find returns the position of path or its closest parent.
+func (p yamlPositions) find(path string) position {
+	for path != "" {
+		if pos, ok := p[path]; ok {
+			return pos
+		}
+		i := strings.LastIndexAny(path, ".[")
+		if i == -1 {
+			break
+		}
+		path = path[:i]
+	}
+	return position{}
+}
+
+func (p yamlPositions) errorf(path, format string, args ...interface{}) *configError {
+	pos := p.find(path)
+	return &configError{Path: path, Line: pos.line, Column: pos.column, Msg: fmt.Sprintf(format, args...)}
+}
+
+// jsonFields returns the json names of the fields of struct type t.
+func jsonFields(t reflect.Type) map[string]reflect.StructField {
+	fields := map[string]reflect.StructField{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "-" || f.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields[name] = f
+	}
+	return fields
+}
+
+// editDistance is the levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+// suggestField returns the name in fields closest to name if there is one
+// that is likely to be a typo.
+func suggestField(name string, fields map[string]reflect.StructField) string {
+	best, bestDist := "", 3
+	for field := range fields {
+		dist := editDistance(strings.ToLower(name), strings.ToLower(field))
+		if dist < bestDist || (dist == bestDist && field < best) {
+			best, bestDist = field, dist
+		}
+	}
+	return best
+}
+
+// checkFields reports the keys in value that don't correspond to a field of
+// type t. Mismatched types are left to the decoder.
+func checkFields(value interface{}, t reflect.Type, path string, positions yamlPositions) []error {
+	errs := []error{}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		fields := jsonFields(t)
+		for _, key := range sortedValueKeys(obj) {
+			field, ok := fields[key]
+			if !ok {
+				msg := "unknown field"
+				if suggestion := suggestField(key, fields); suggestion != "" {
+					msg += fmt.Sprintf(", did you mean %q?", suggestion)
+				}
+				errs = append(errs, positions.errorf(joinPath(path, key), "%s", msg))
+				continue
+			}
+			errs = append(errs, checkFields(obj[key], field.Type, joinPath(path, key), positions)...)
+		}
+	case reflect.Slice:
+		if arr, ok := value.([]interface{}); ok {
+			for i, v := range arr {
+				errs = append(errs, checkFields(v, t.Elem(), fmt.Sprintf("%s[%d]", path, i), positions)...)
+			}
+		}
+	case reflect.Map:
+		if obj, ok := value.(map[string]interface{}); ok {
+			for _, key := range sortedValueKeys(obj) {
+				errs = append(errs, checkFields(obj[key], t.Elem(), joinPath(path, key), positions)...)
+			}
+		}
+	}
+	return errs
+}
+
+func sortedValueKeys(m map[string]interface{}) []string {
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// decodeConfig strictly decodes smith.yaml data into a ConfigDef.
+func decodeConfig(data []byte) (*ConfigDef, yamlPositions, []error) {
+	var def ConfigDef
+	if err := yaml.Unmarshal(data, &def); err != nil {
+		return nil, nil, []error{err}
+	}
+	j, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return nil, nil, []error{err}
+	}
+	var raw interface{}
+	if err := json.Unmarshal(j, &raw); err != nil {
+		return nil, nil, []error{err}
+	}
+	positions := newYamlPositions(data)
+	if raw == nil {
+		return &def, positions, nil
+	}
+	if _, ok := raw.(map[string]interface{}); !ok {
+		return nil, nil, []error{fmt.Errorf("expected a mapping at the top level")}
+	}
+	return &def, positions, checkFields(raw, reflect.TypeOf(def), "", positions)
+}
+
+// validateUser checks that user is in the user[:group] format understood
+// by ParseUser.
+func validateUser(user string) error {
+	parts := strings.Split(user, ":")
+	if len(parts) > 2 {
+		return fmt.Errorf("expected user[:group]")
+	}
+	for _, part := range parts {
+		if !namePattern.MatchString(part) {
+			return fmt.Errorf("invalid user or group %q", part)
+		}
+	}
+	return nil
+}
+
+// validateConfig checks the values in def. Relative files are resolved
+// from dir.
+func validateConfig(def *ConfigDef, positions yamlPositions, dir string) []error {
+	errs := []error{}
+	if def.Type != "" {
+		found := false
+		for _, t := range buildTypes {
+			found = found || def.Type == t
+		}
+		if !found {
+			errs = append(errs, positions.errorf("type", "unknown type %q, expected one of %s", def.Type, strings.Join(buildTypes, ", ")))
+		}
+	}
+	for i, p := range def.Paths {
+		if !filepath.IsAbs(p) {
+			errs = append(errs, positions.errorf(fmt.Sprintf("paths[%d]", i), "path %q must be absolute", p))
+		}
+	}
+	if def.User != "" {
+		if err := validateUser(def.User); err != nil {
+			errs = append(errs, positions.errorf("user", "%v", err))
+		}
+	}
+	for _, port := range setKeys(def.Ports) {
+		match := portPattern.FindStringSubmatch(port)
+		valid := match != nil
+		if valid {
+			n, err := strconv.Atoi(match[1])
+			valid = err == nil && n > 0 && n < 65536
+		}
+		if !valid {
+			errs = append(errs, positions.errorf("ports."+port, "invalid port %q, expected N, N/tcp or N/udp", port))
+		}
+	}
+	if def.Parent != "" {
+		parent := strings.Split(def.Parent, ":")[0]
+		if _, err := os.Stat(filepath.Join(dir, parent)); err != nil {
+			errs = append(errs, positions.errorf("parent", "parent %s doesn't exist", parent))
+		}
+	}
+	if def.Platform != "" {
+		if _, err := parsePlatform(def.Platform); err != nil {
+			errs = append(errs, positions.errorf("platform", "%v", err))
+		}
+	}
+	for i, p := range def.Platforms {
+		if _, err := parsePlatform(p); err != nil {
+			errs = append(errs, positions.errorf(fmt.Sprintf("platforms[%d]", i), "%v", err))
+		}
+	}
+	if err := validateLayers(def); err != nil {
+		errs = append(errs, positions.errorf("layers", "%v", err))
+	}
+	for i, layer := range def.Layers {
+		for j, p := range layer.Paths {
+			if !filepath.IsAbs(p) {
+				errs = append(errs, positions.errorf(fmt.Sprintf("layers[%d].paths[%d]", i, j), "path %q must be absolute", p))
+			}
+		}
+	}
+	if def.Type == "dir" || def.Type == "tar" {
+		path := def.Package
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		info, err := os.Stat(path)
+		if err == nil && info.IsDir() != (def.Type == "dir") {
+			err = fmt.Errorf("wrong file type")
+		}
+		if def.Package == "" || err != nil {
+			kind := map[string]string{"dir": "directory", "tar": "tarball"}[def.Type]
+			errs = append(errs, positions.errorf("package", "package %q isn't a local %s", def.Package, kind))
+		}
+	}
+	if def.Type == "static" && len(def.Static.Binaries) == 0 {
+		errs = append(errs, positions.errorf("static.binaries", "static builds need at least one binary"))
+	}
+	for i, binary := range def.Static.Binaries {
+		src, dest := staticBinary(binary)
+		path := src
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		if _, err := os.Stat(path); err != nil {
+			errs = append(errs, positions.errorf(fmt.Sprintf("static.binaries[%d]", i), "binary %s doesn't exist", src))
+		}
+		if !filepath.IsAbs(dest) {
+			errs = append(errs, positions.errorf(fmt.Sprintf("static.binaries[%d]", i), "path %q must be absolute", dest))
+		}
+	}
+	for _, name := range buildTypes {
+		nt, ok := nativeTypes[name]
+		if !ok {
+			continue
+		}
+		for i, repo := range nativeDef(def, name).Repos {
+			path := repo
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(dir, path)
+			}
+			index, err := nt.repoIndex(path)
+			if err == nil {
+				_, err = os.Stat(index)
+			}
+			if err != nil {
+				errs = append(errs, positions.errorf(fmt.Sprintf("%s.repos[%d]", name, i), "%s isn't a %s repo: %v", repo, name, err))
+			}
+		}
+	}
+	names := map[string]struct{}{}
+	for i, image := range def.Images {
+		prefix := fmt.Sprintf("images[%d]", i)
+		if !namePattern.MatchString(image.Name) {
+			errs = append(errs, positions.errorf(prefix+".name", "invalid image name %q", image.Name))
+		} else if _, ok := names[image.Name]; ok {
+			errs = append(errs, positions.errorf(prefix+".name", "image %s is listed more than once", image.Name))
+		}
+		names[image.Name] = struct{}{}
+		for j, p := range image.Paths {
+			if !filepath.IsAbs(p) {
+				errs = append(errs, positions.errorf(fmt.Sprintf("%s.paths[%d]", prefix, j), "path %q must be absolute", p))
+			}
+		}
+		if image.User != "" {
+			if err := validateUser(image.User); err != nil {
+				errs = append(errs, positions.errorf(prefix+".user", "%v", err))
+			}
+		}
+	}
+	return errs
+}
+
+// formatConfigError prefixes err with the file it occurred in.
+func formatConfigError(path string, err error) string {
+	cerr, ok := err.(*configError)
+	if ok && cerr.File != "" {
+		path = cerr.File
+	}
+	if ok && cerr.Line != 0 {
+		return path + ":" + err.Error()
+	}
+	return path + ": " + err.Error()
+}
+
+// sortErrors orders errors with positions by file, line and column.
+func sortErrors(errs []error) {
+	sort.SliceStable(errs, func(i, j int) bool {
+		a, aok := errs[i].(*configError)
+		b, bok := errs[j].(*configError)
+		if !aok || !bok {
+			return aok && !bok
+		}
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Column < b.Column
+	})
+}
+
+// loadConfigFile reads and decodes a single config file without resolving
+// extends and include. Setting both platform and platforms is checked here
+// since merging keeps only one of them.
+func loadConfigFile(path string) (*ConfigDef, yamlPositions, []error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, []error{err}
+	}
+	def, positions, errs := decodeConfig(data)
+	if def != nil && def.Platform != "" && len(def.Platforms) != 0 {
+		errs = append(errs, positions.errorf("platform", "platform and platforms can't both be set, list all targets in platforms"))
+	}
+	return def, positions, errs
+}
+
+// normalizePorts adds the default protocol tcp to ports given as a number.
+func normalizePorts(def *ConfigDef) {
+	for port := range def.Ports {
+		if !strings.Contains(port, "/") {
+			delete(def.Ports, port)
+			def.Ports[port+"/tcp"] = struct{}{}
+		}
+	}
+}
+
+// loadConfig reads the smith.yaml at path for the project in dir, merges in
+// the files it extends and includes and validates the result.
+func loadConfig(path, dir string) (*ConfigDef, []error) {
+	def, files, errs := resolveConfig(path, nil)
+	if def == nil {
+		return nil, errs
+	}
+	for _, err := range validateConfig(def, files[0].positions, dir) {
+		errs = append(errs, locateConfigError(err, files, dir))
+	}
+	normalizePorts(def)
+	sortErrors(errs)
+	return def, errs
+}
+
+func validateConfigFile(path, dir string, printSchema, printConfig bool) bool {
+	if printSchema {
+		data, err := json.MarshalIndent(configSchema(), "", "  ")
+		if err != nil {
+			logrus.Errorf("Failed to marshal schema: %v", err)
+			return false
+		}
+		fmt.Println(string(data))
+		return true
+	}
+	if dir != "" && !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	def, errs := loadConfig(path, dir)
+	for _, err := range errs {
+		fmt.Println(formatConfigError(path, err))
+	}
+	if len(errs) != 0 {
+		logrus.Errorf("%s has %d errors", path, len(errs))
+		return false
+	}
+	if printConfig {
+		if err := def.WriteConfig("-"); err != nil {
+			logrus.Errorf("Failed to print config: %v", err)
+			return false
+		}
+		return true
+	}
+	logrus.Infof("%s is valid", path)
+	return true
+}
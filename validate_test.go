@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestYamlPositions(t *testing.T) {
+	data := `# comment
+package: coreutils
+paths:
+- /usr/bin/cat
+- /usr/bin/ls
+mock:
+  config: /etc/mock/default.cfg
+  deps:
+    - bash
+script: |
+  paths: not a key
+layers:
+- name: data
+  paths:
+  - /data
+- name: other
+`
+	positions := newYamlPositions([]byte(data))
+	expected := map[string]position{
+		"package":            {2, 1},
+		"paths[1]":           {5, 1},
+		"mock.config":        {7, 3},
+		"mock.deps[0]":       {9, 5},
+		"script":             {10, 1},
+		"layers[0].name":     {13, 3},
+		"layers[0].paths":    {14, 3},
+		"layers[0].paths[0]": {15, 3},
+		"layers[1].name":     {16, 3},
+	}
+	for path, pos := range expected {
+		if positions[path] != pos {
+			t.Errorf("Position of %s is %v, expected %v", path, positions[path], pos)
+		}
+	}
+	if _, ok := positions["script.paths"]; ok {
+		t.Errorf("Block scalar contents were indexed")
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smith-test-")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+	data := `pakage: coreutils
+type: rpmm
+paths:
+- /usr/bin/cat
+- usr/bin/ls
+mock:
+  deps: [bash]
+  debugInfo: true
+parent: missing.tar.gz
+user: "a:b:c"
+ports:
+  80/tcp: {}
+  70000/tcp: {}
+images:
+- name: server
+  paths:
+  - usr/bin/server
+- name: server
+platform: linux/amd64
+platforms: [linux/arm64]
+`
+	path := filepath.Join(dir, "smith.yaml")
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+	_, errs := loadConfig(path, dir)
+	messages := []string{}
+	for _, err := range errs {
+		messages = append(messages, err.Error())
+	}
+	expected := []string{
+		`1:1: pakage: unknown field, did you mean "package"?`,
+		`2:1: type: unknown type "rpmm", expected one of mock, oci, rpm, deb, apk, dir, tar, static`,
+		`5:1: paths[1]: path "usr/bin/ls" must be absolute`,
+		`8:3: mock.debugInfo: unknown field, did you mean "debuginfo"?`,
+		`9:1: parent: parent missing.tar.gz doesn't exist`,
+		`10:1: user: expected user[:group]`,
+		`13:3: ports.70000/tcp: invalid port "70000/tcp", expected N, N/tcp or N/udp`,
+		`17:3: images[0].paths[0]: path "usr/bin/server" must be absolute`,
+		`18:3: images[1].name: image server is listed more than once`,
+		`19:1: platform: platform and platforms can't both be set, list all targets in platforms`,
+	}
+	if strings.Join(messages, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("loadConfig returned:\n%s\nexpected:\n%s", strings.Join(messages, "\n"), strings.Join(expected, "\n"))
+	}
+
+	repo := filepath.Join(dir, "repo")
+	if err := os.MkdirAll(repo, 0755); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(repo, apkIndex), nil, 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+	valid := "package: coreutils\npaths:\n- /usr/bin/cat\nuser: 1000:1000\nports:\n  8080/tcp: {}\n  9090: {}\n" +
+		"apk:\n  repos: [" + repo + "]\n"
+	if err := ioutil.WriteFile(path, []byte(valid), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+	def, errs := loadConfig(path, dir)
+	if len(errs) != 0 {
+		t.Fatalf("Valid config has errors: %v", errs)
+	}
+	if ports := strings.Join(setKeys(def.Ports), " "); ports != "8080/tcp 9090/tcp" {
+		t.Fatalf("Ports were not normalized: %s", ports)
+	}
+
+	local := "type: dir\npackage: " + repo + "\npaths:\n- /usr/bin/cat\n"
+	if err := ioutil.WriteFile(path, []byte(local), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, errs := loadConfig(path, dir); len(errs) != 0 {
+		t.Fatalf("Absolute local package has errors: %v", errs)
+	}
+}
+
+func TestConfigSchema(t *testing.T) {
+	published, err := ioutil.ReadFile("smith.schema.json")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	generated, err := json.MarshalIndent(configSchema(), "", "  ")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if strings.TrimSpace(string(published)) != string(generated) {
+		t.Fatalf("smith.schema.json is out of date, regenerate it with smith validate --schema")
+	}
+}